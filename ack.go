@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const ackPath = "/services/collector/ack"
+
+var errAckTimeout = errors.New("timed out waiting for indexer acknowledgement")
+
+var ackTimeoutCounter prometheus.Counter
+
+type pendingAck struct {
+	batch    []*message
+	callback func(*message, error)
+	deadline time.Time
+}
+
+// ackTracker keeps the ackIds returned by HEC for a channel and polls the ack endpoint
+// until the events are indexed or the acknowledgement times out.
+type ackTracker struct {
+	sync.Mutex
+	client    *http.Client
+	url       string
+	token     string
+	channel   string
+	timeout   time.Duration
+	interval  time.Duration
+	pending   map[int64]*pendingAck
+	ticker    *time.Ticker
+	done      chan struct{}
+	uppLogger *logger.UPPLogger
+}
+
+type ackRequest struct {
+	Acks []int64 `json:"acks"`
+}
+
+type ackResponse struct {
+	Acks map[string]bool `json:"acks"`
+}
+
+func newAckTracker(client *http.Client, config appConfig, channel string) *ackTracker {
+	if ackTimeoutCounter == nil {
+		ackTimeoutCounter = registerCounter("ack_timeout_count", "Number of events not acknowledged by the indexers in time")
+	}
+	// the forward URL has already been validated
+	ackEndpoint, _ := ackURL(config.fwdURL)
+	return &ackTracker{
+		client:    client,
+		url:       ackEndpoint,
+		token:     config.token,
+		channel:   channel,
+		timeout:   config.ackTimeout,
+		interval:  config.ackPollInterval,
+		pending:   map[int64]*pendingAck{},
+		uppLogger: config.UPPLogger,
+	}
+}
+
+// ackURL derives the HEC ack endpoint from the event endpoint the forwarder posts to
+func ackURL(fwdURL string) (string, error) {
+	u, err := url.Parse(fwdURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = ackPath
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// add tracks the ackId of a batch. HEC may hand out an ackId again after a restart, in
+// which case the batch it was tracked for is given up on, as it will never be acknowledged.
+func (tracker *ackTracker) add(ackID int64, batch []*message, callback func(*message, error)) {
+	tracker.Lock()
+	replaced := tracker.pending[ackID]
+	tracker.pending[ackID] = &pendingAck{
+		batch:    batch,
+		callback: callback,
+		deadline: time.Now().Add(tracker.timeout),
+	}
+	tracker.Unlock()
+
+	if replaced != nil {
+		tracker.uppLogger.Infof("Indexer acknowledgement id %v reused, giving up on %v events\n", ackID, len(replaced.batch))
+		ackTimeoutCounter.Add(float64(len(replaced.batch)))
+		for _, m := range replaced.batch {
+			replaced.callback(m, errAckTimeout)
+		}
+	}
+}
+
+func (tracker *ackTracker) start() {
+	tracker.ticker = time.NewTicker(tracker.interval)
+	tracker.done = make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-tracker.ticker.C:
+				tracker.poll()
+			case <-tracker.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops polling. Pending acknowledgements are left to the callers.
+func (tracker *ackTracker) stop() {
+	tracker.ticker.Stop()
+	close(tracker.done)
+}
+
+// poll queries the ack endpoint for all pending ackIds and completes the acknowledged
+// and expired ones. Callbacks are invoked outside of the lock.
+func (tracker *ackTracker) poll() {
+	ids := tracker.pendingIDs()
+	if len(ids) > 0 {
+		acked, err := tracker.query(ids)
+		if err != nil {
+			tracker.uppLogger.Infof("Failure polling indexer acknowledgements: %v\n", err)
+		}
+		for _, ack := range tracker.remove(acked) {
+			for _, m := range ack.batch {
+				ack.callback(m, nil)
+			}
+		}
+	}
+
+	for _, ack := range tracker.expire(time.Now()) {
+		tracker.uppLogger.Infof("No indexer acknowledgement received for %v events\n", len(ack.batch))
+		ackTimeoutCounter.Add(float64(len(ack.batch)))
+		for _, m := range ack.batch {
+			ack.callback(m, errAckTimeout)
+		}
+	}
+}
+
+func (tracker *ackTracker) query(ids []int64) ([]int64, error) {
+	body, err := json.Marshal(ackRequest{Acks: ids})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", tracker.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Splunk "+tracker.token)
+	req.Header.Set(channelHeader, tracker.channel)
+	r, err := tracker.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != 200 {
+		return nil, errors.New(r.Status)
+	}
+
+	resp := ackResponse{}
+	if err = json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	acked := []int64{}
+	for id, ok := range resp.Acks {
+		if !ok {
+			continue
+		}
+		ackID, err := strconv.ParseInt(id, 10, 64)
+		if err == nil {
+			acked = append(acked, ackID)
+		}
+	}
+	return acked, nil
+}
+
+func (tracker *ackTracker) pendingIDs() []int64 {
+	tracker.Lock()
+	defer tracker.Unlock()
+	ids := make([]int64, 0, len(tracker.pending))
+	for id := range tracker.pending {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (tracker *ackTracker) remove(ids []int64) []*pendingAck {
+	tracker.Lock()
+	defer tracker.Unlock()
+	acks := []*pendingAck{}
+	for _, id := range ids {
+		if ack, ok := tracker.pending[id]; ok {
+			acks = append(acks, ack)
+			delete(tracker.pending, id)
+		}
+	}
+	return acks
+}
+
+func (tracker *ackTracker) expire(now time.Time) []*pendingAck {
+	tracker.Lock()
+	defer tracker.Unlock()
+	acks := []*pendingAck{}
+	for id, ack := range tracker.pending {
+		if now.After(ack.deadline) {
+			acks = append(acks, ack)
+			delete(tracker.pending, id)
+		}
+	}
+	return acks
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type ackServerMock struct {
+	sync.Mutex
+	channels []string
+	indexed  bool
+}
+
+func (mock *ackServerMock) setIndexed(indexed bool) {
+	mock.Lock()
+	defer mock.Unlock()
+	mock.indexed = indexed
+}
+
+func (mock *ackServerMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mock.Lock()
+	defer mock.Unlock()
+	mock.channels = append(mock.channels, r.Header.Get(channelHeader))
+	if r.URL.Path == ackPath {
+		req := ackRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		resp := ackResponse{Acks: map[string]bool{}}
+		for _, id := range req.Acks {
+			resp.Acks[strconv.FormatInt(id, 10)] = mock.indexed
+		}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	w.Write([]byte(`{"text":"Success","code":0,"ackId":0}`))
+}
+
+func newAckForwarder(url string, timeout time.Duration) *splunkClient {
+	ackConfig := config
+	ackConfig.fwdURL = url + "/services/collector/event"
+	ackConfig.ack = true
+	ackConfig.ackTimeout = timeout
+	ackConfig.ackPollInterval = time.Hour
+	return NewSplunkForwarder(ackConfig).(*splunkClient)
+}
+
+func Test_Ack_Indexed(t *testing.T) {
+	mock := &ackServerMock{}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+	forwarder := newAckForwarder(server.URL, time.Minute)
+
+	results := make(chan error, 2)
+	forwarder.forward(messages(`{"event":"first"}`, `{"event":"second"}`), func(m *message, err error) {
+		results <- err
+	})
+	assert.Len(t, results, 0, "callback should wait for the acknowledgement")
+
+	forwarder.acks.poll()
+	assert.Len(t, results, 0, "events are not indexed yet")
+
+	mock.setIndexed(true)
+	forwarder.acks.poll()
+	assert.Len(t, results, 2)
+	assert.NoError(t, <-results)
+	assert.NoError(t, <-results)
+	assert.Empty(t, forwarder.acks.pendingIDs())
+
+	for _, channel := range mock.channels {
+		assert.Equal(t, forwarder.channel, channel)
+	}
+}
+
+func Test_Ack_Timeout(t *testing.T) {
+	mock := &ackServerMock{}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+	forwarder := newAckForwarder(server.URL, -time.Second)
+
+	results := make(chan error, 1)
+	forwarder.forward(messages(`{"event":"lost"}`), func(m *message, err error) {
+		results <- err
+	})
+
+	forwarder.acks.poll()
+	assert.Len(t, results, 1)
+	assert.Equal(t, errAckTimeout, <-results)
+	assert.Empty(t, forwarder.acks.pendingIDs())
+}
+
+func Test_Ack_ReusedID(t *testing.T) {
+	mock := &ackServerMock{}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+	forwarder := newAckForwarder(server.URL, time.Minute)
+
+	results := make(chan error, 2)
+	callback := func(m *message, err error) {
+		results <- err
+	}
+	// the mock hands out the same ackId every time, like HEC after a restart
+	forwarder.forward(messages(`{"event":"before restart"}`), callback)
+	forwarder.forward(messages(`{"event":"after restart"}`), callback)
+	assert.Len(t, results, 1)
+	assert.Equal(t, errAckTimeout, <-results)
+
+	mock.setIndexed(true)
+	forwarder.acks.poll()
+	assert.NoError(t, <-results)
+}
+
+func Test_Ack_Stop(t *testing.T) {
+	ackConfig := config
+	ackConfig.fwdURL = "http://localhost:8088/services/collector/event"
+	ackConfig.ackPollInterval = time.Millisecond
+	tracker := newAckTracker(http.DefaultClient, ackConfig, "channel")
+	tracker.start()
+	tracker.stop()
+
+	// nothing is polled once stopped
+	tracker.add(1, messages(`{"event":"late"}`), func(*message, error) {})
+	time.Sleep(20 * time.Millisecond)
+	assert.Len(t, tracker.pendingIDs(), 1)
+}
+
+func Test_AckURL(t *testing.T) {
+	u, err := ackURL("https://splunk.example.com:8088/services/collector/event?channel=abc")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "https://splunk.example.com:8088/services/collector/ack", u)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// circuitState is reported by the circuit_state metric
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+var (
+	circuitStateGauge      *prometheus.GaugeVec
+	circuitOpenedCounter   *prometheus.CounterVec
+	circuitRejectedCounter *prometheus.CounterVec
+)
+
+// Breaker is implemented by forwarders that stop sending to a failing destination
+type Breaker interface {
+	// ready tells whether events may be sent, or would be failed straight away
+	ready() bool
+}
+
+// circuitBreaker counts the outcome of the events sent to a destination over a sliding
+// window. When too many of them fail it opens, failing events straight away, and after a
+// while lets a few probe requests through. The circuit closes again once the probes
+// succeed, and opens again as soon as one fails.
+type circuitBreaker struct {
+	sync.Mutex
+	name string
+	now  func() time.Time
+	// outcomes per second over the window
+	buckets     []circuitBucket
+	failureRate float64
+	minEvents   int
+	openFor     time.Duration
+	probes      int
+	state       circuitState
+	openedAt    time.Time
+	// probe requests sent and succeeded since the circuit went half-open
+	probing   int
+	succeeded int
+}
+
+type circuitBucket struct {
+	second   int64
+	events   int
+	failures int
+}
+
+func newCircuitBreaker(name string, config appConfig, now func() time.Time) *circuitBreaker {
+	if circuitStateGauge == nil {
+		circuitStateGauge = registerGaugeVec("circuit_state", "State of the circuit breaker by destination: 0 closed, 1 half-open, 2 open", "destination")
+		circuitOpenedCounter = registerCounterVec("circuit_opened_count", "Number of times the circuit breaker has opened by destination", "destination")
+		circuitRejectedCounter = registerCounterVec("circuit_rejected_count", "Number of messages failed by an open circuit breaker by destination", "destination")
+	}
+	seconds := int(config.breakerWindow / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	probes := config.breakerProbes
+	if probes < 1 {
+		probes = 1
+	}
+	circuitStateGauge.WithLabelValues(name).Set(float64(circuitClosed))
+	return &circuitBreaker{
+		name:        name,
+		now:         now,
+		buckets:     make([]circuitBucket, seconds),
+		failureRate: float64(config.breakerFailureRate) / 100,
+		minEvents:   config.breakerMinEvents,
+		openFor:     config.breakerOpenTime,
+		probes:      probes,
+	}
+}
+
+// allow tells whether a request may be sent, and whether it is a probe whose outcome
+// must be reported with probed
+func (b *circuitBreaker) allow() (bool, bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.halfOpenIfDue()
+	switch b.state {
+	case circuitOpen:
+		return false, false
+	case circuitHalfOpen:
+		if b.probing > b.succeeded {
+			// one probe at a time
+			return false, false
+		}
+		b.probing++
+		return true, true
+	}
+	return true, false
+}
+
+func (b *circuitBreaker) ready() bool {
+	b.Lock()
+	defer b.Unlock()
+	b.halfOpenIfDue()
+	switch b.state {
+	case circuitOpen:
+		return false
+	case circuitHalfOpen:
+		// events sent while a probe is pending would be failed straight away
+		return b.probing <= b.succeeded
+	}
+	return true
+}
+
+func (b *circuitBreaker) getState() circuitState {
+	b.Lock()
+	defer b.Unlock()
+	b.halfOpenIfDue()
+	return b.state
+}
+
+// record counts the outcome of an event sent while the circuit is closed
+func (b *circuitBreaker) record(failed bool) {
+	b.Lock()
+	defer b.Unlock()
+	if b.state != circuitClosed {
+		return
+	}
+	second := b.now().Unix()
+	bucket := &b.buckets[int(second%int64(len(b.buckets)))]
+	if bucket.second != second {
+		*bucket = circuitBucket{second: second}
+	}
+	bucket.events++
+	if failed {
+		bucket.failures++
+	}
+
+	events, failures := 0, 0
+	for _, bucket := range b.buckets {
+		if second-bucket.second < int64(len(b.buckets)) {
+			events += bucket.events
+			failures += bucket.failures
+		}
+	}
+	if events >= b.minEvents && float64(failures) >= b.failureRate*float64(events) {
+		b.open()
+	}
+}
+
+// probed reports the outcome of a probe request
+func (b *circuitBreaker) probed(failed bool) {
+	b.Lock()
+	defer b.Unlock()
+	if b.state != circuitHalfOpen {
+		return
+	}
+	if failed {
+		b.open()
+		return
+	}
+	b.succeeded++
+	if b.succeeded >= b.probes {
+		b.buckets = make([]circuitBucket, len(b.buckets))
+		b.setState(circuitClosed)
+	}
+}
+
+func (b *circuitBreaker) open() {
+	b.openedAt = b.now()
+	b.setState(circuitOpen)
+	circuitOpenedCounter.WithLabelValues(b.name).Inc()
+}
+
+func (b *circuitBreaker) halfOpenIfDue() {
+	if b.state == circuitOpen && !b.now().Before(b.openedAt.Add(b.openFor)) {
+		b.probing = 0
+		b.succeeded = 0
+		b.setState(circuitHalfOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(state circuitState) {
+	b.state = state
+	circuitStateGauge.WithLabelValues(b.name).Set(float64(state))
+}
+
+// breakerForwarder guards a forwarder with a circuit breaker
+type breakerForwarder struct {
+	Forwarder
+	breaker *circuitBreaker
+}
+
+// withBreaker guards a forwarder with a circuit breaker, unless the breaker is disabled
+func withBreaker(name string, forwarder Forwarder, config appConfig) Forwarder {
+	if config.breakerFailureRate == 0 {
+		return forwarder
+	}
+	return &breakerForwarder{Forwarder: forwarder, breaker: newCircuitBreaker(name, config, time.Now)}
+}
+
+func (f *breakerForwarder) stopping() {
+	notifyStopping(f.Forwarder)
+}
+
+func (f *breakerForwarder) pausedUntil() time.Time {
+	return pausedUntilOf(f.Forwarder)
+}
+
+func (f *breakerForwarder) forward(batch []*message, callback func(*message, error)) {
+	allowed, probe := f.breaker.allow()
+	if !allowed {
+		circuitRejectedCounter.WithLabelValues(f.breaker.name).Add(float64(len(batch)))
+		for _, m := range batch {
+			callback(m, errCircuitOpen)
+		}
+		return
+	}
+	mutex := sync.Mutex{}
+	pending := len(batch)
+	failed := false
+	f.Forwarder.forward(batch, func(m *message, err error) {
+		// only errors that are worth retrying tell that the destination is failing
+		failure := err != nil && err != errRateLimited && err != errThrottled && policyOf(err) == policyRetry
+		if probe {
+			mutex.Lock()
+			failed = failed || failure
+			pending--
+			done := pending == 0
+			mutex.Unlock()
+			if done {
+				f.breaker.probed(failed)
+			}
+		} else {
+			f.breaker.record(failure)
+		}
+		callback(m, err)
+	})
+}
+
+func (f *breakerForwarder) ready() bool {
+	return f.breaker.ready()
+}
+
+func (f *breakerForwarder) circuitHealth() error {
+	if state := f.breaker.getState(); state != circuitClosed {
+		return fmt.Errorf("circuit breaker is %v", state)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is moved forward by the tests
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newBreakerMock(forwarder Forwarder, clock *fakeClock) *breakerForwarder {
+	breakerConfig := config
+	breakerConfig.breakerFailureRate = 50
+	breakerConfig.breakerMinEvents = 4
+	breakerConfig.breakerWindow = 10 * time.Second
+	breakerConfig.breakerOpenTime = 30 * time.Second
+	breakerConfig.breakerProbes = 2
+	return &breakerForwarder{Forwarder: forwarder, breaker: newCircuitBreaker("test", breakerConfig, clock.now)}
+}
+
+func Test_Breaker_OpensOnFailureRate(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	failing := &rejectingForwarderMock{err: errors.New("connection refused")}
+	b := newBreakerMock(failing, clock)
+
+	collectResults(b, messages("a", "b", "c"))
+	assert.Equal(t, circuitClosed, b.breaker.getState(), "too few events to tell")
+
+	collectResults(b, messages("d"))
+	assert.Equal(t, circuitOpen, b.breaker.getState())
+	assert.False(t, b.ready())
+	assert.Error(t, b.circuitHealth())
+
+	results := collectResults(b, messages("e"))
+	assert.Equal(t, errCircuitOpen, results["e"])
+}
+
+func Test_Breaker_SlidingWindow(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	failing := &rejectingForwarderMock{err: errors.New("connection refused")}
+	b := newBreakerMock(failing, clock)
+
+	collectResults(b, messages("a", "b", "c"))
+	// the failures have left the window by now
+	clock.t = clock.t.Add(15 * time.Second)
+	b.Forwarder = &rejectingForwarderMock{}
+	collectResults(b, messages("d", "e", "f"))
+	b.Forwarder = failing
+	collectResults(b, messages("g"))
+	assert.Equal(t, circuitClosed, b.breaker.getState())
+
+	// events rejected for good don't mean the destination is failing
+	b.Forwarder = &rejectingForwarderMock{err: newHecError(400, hecResponse{Code: 7, Text: "Incorrect index"})}
+	collectResults(b, messages("h", "i", "j", "k"))
+	assert.Equal(t, circuitClosed, b.breaker.getState())
+}
+
+func Test_Breaker_HalfOpenProbes(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	b := newBreakerMock(&rejectingForwarderMock{err: errors.New("connection refused")}, clock)
+	collectResults(b, messages("a", "b", "c", "d"))
+	assert.Equal(t, circuitOpen, b.breaker.getState())
+
+	// a failed probe opens the circuit again
+	clock.t = clock.t.Add(30 * time.Second)
+	assert.True(t, b.ready())
+	assert.Equal(t, circuitHalfOpen, b.breaker.getState())
+	results := collectResults(b, messages("e"))
+	assert.EqualError(t, results["e"], "connection refused")
+	assert.Equal(t, circuitOpen, b.breaker.getState())
+
+	clock.t = clock.t.Add(30 * time.Second)
+	b.Forwarder = &rejectingForwarderMock{}
+	allowed, probe := b.breaker.allow()
+	assert.True(t, allowed)
+	assert.True(t, probe)
+	allowed, _ = b.breaker.allow()
+	assert.False(t, allowed, "probes are sent one at a time")
+	assert.False(t, b.ready(), "no events should be read while a probe is pending")
+	b.breaker.probed(false)
+	assert.Equal(t, circuitHalfOpen, b.breaker.getState())
+	assert.True(t, b.ready())
+
+	results = collectResults(b, messages("f"))
+	assert.NoError(t, results["f"])
+	assert.Equal(t, circuitClosed, b.breaker.getState())
+	assert.NoError(t, b.circuitHealth())
+}
+
+func Test_Breaker_ProcessorKeepsEventsCachedWhileOpen(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	b := newBreakerMock(&rejectingForwarderMock{err: errors.New("connection refused")}, clock)
+	collectResults(b, messages("a", "b", "c", "d"))
+	s3 := &s3ServiceMock{}
+	processor := NewLogProcessor(b, s3, config)
+	processor.Start()
+	defer processor.Stop(time.Now())
+
+	s3.Put(`{event:"waiting"}`)
+
+	time.Sleep(300 * time.Millisecond)
+	s3.RLock()
+	defer s3.RUnlock()
+	assert.Len(t, s3.cache, 1, "the cache should not be read while the circuit is open")
+	assert.Equal(t, 0, s3.acked)
+}
+
+func Test_Breaker_Disabled(t *testing.T) {
+	forwarder := &rejectingForwarderMock{}
+	assert.Equal(t, forwarder, withBreaker("test", forwarder, config))
+}
+
+func Test_ValidateParamsBreaker(t *testing.T) {
+	breakerConfig := config
+	breakerConfig.breakerFailureRate = 150
+	assert.Error(t, validateParams(breakerConfig))
+
+	breakerConfig.breakerFailureRate = 50
+	assert.Error(t, validateParams(breakerConfig))
+
+	breakerConfig.breakerWindow = time.Minute
+	assert.NoError(t, validateParams(breakerConfig))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// factors the limit shrinks by when requests time out, fail, or get slower than the
+// latency target
+const (
+	timeoutDecrease = 0.25
+	failureDecrease = 0.5
+	latencyDecrease = 0.9
+)
+
+var concurrencyLimitGauge *prometheus.GaugeVec
+
+// concurrencyLimit bounds the requests sent to a destination at once, adapting the bound
+// with AIMD: it grows by one request for every round of successful requests faster than
+// the latency target, and shrinks by a factor when requests fail or get slower. A
+// decrease only applies to requests started after the previous one, so that a burst of
+// failed requests sent together shrinks the limit once.
+type concurrencyLimit struct {
+	sync.Mutex
+	cond         *sync.Cond
+	name         string
+	now          func() time.Time
+	limit        float64
+	min          int
+	max          int
+	target       time.Duration
+	inFlight     int
+	lastDecrease time.Time
+}
+
+func newConcurrencyLimit(name string, config appConfig, now func() time.Time) *concurrencyLimit {
+	if concurrencyLimitGauge == nil {
+		concurrencyLimitGauge = registerGaugeVec("concurrency_limit", "Number of requests sent at once to the destination", "destination")
+	}
+	min := config.minWorkers
+	if min < 1 {
+		min = 1
+	}
+	l := &concurrencyLimit{
+		name:   name,
+		now:    now,
+		limit:  float64(config.workers),
+		min:    min,
+		max:    config.maxWorkers,
+		target: config.latencyTarget,
+	}
+	l.cond = sync.NewCond(l)
+	l.setLimit(l.limit)
+	return l
+}
+
+// acquire blocks until a request may be sent, and returns the time it is sent at
+func (l *concurrencyLimit) acquire() time.Time {
+	l.Lock()
+	defer l.Unlock()
+	for l.inFlight >= l.current() {
+		l.cond.Wait()
+	}
+	l.inFlight++
+	return l.now()
+}
+
+// release adapts the limit to the outcome of a request sent at the given time, given the
+// error it failed with, if any
+func (l *concurrencyLimit) release(sent time.Time, err error) {
+	l.Lock()
+	defer l.Unlock()
+	l.inFlight--
+	defer l.cond.Broadcast()
+	now := l.now()
+	factor := 0.0
+	switch {
+	case isTimeout(err):
+		factor = timeoutDecrease
+	case err != nil:
+		factor = failureDecrease
+	case now.Sub(sent) > l.target:
+		factor = latencyDecrease
+	default:
+		l.setLimit(l.limit + 1/l.limit)
+		return
+	}
+	if !sent.Before(l.lastDecrease) {
+		l.lastDecrease = now
+		l.setLimit(l.limit * factor)
+	}
+}
+
+// skip releases a request without adapting the limit, as its outcome does not tell how
+// the destination copes with the load, e.g. when it was held back by throttling
+func (l *concurrencyLimit) skip() {
+	l.Lock()
+	defer l.Unlock()
+	l.inFlight--
+	l.cond.Broadcast()
+}
+
+// current returns the number of requests that may be sent at once
+func (l *concurrencyLimit) current() int {
+	return int(l.limit)
+}
+
+func (l *concurrencyLimit) setLimit(limit float64) {
+	if limit < float64(l.min) {
+		limit = float64(l.min)
+	}
+	if limit > float64(l.max) {
+		limit = float64(l.max)
+	}
+	l.limit = limit
+	concurrencyLimitGauge.WithLabelValues(l.name).Set(float64(l.current()))
+}
+
+// limitedForwarder sends to a forwarder within a concurrency limit
+type limitedForwarder struct {
+	Forwarder
+	limit *concurrencyLimit
+}
+
+// withConcurrencyLimit adapts the requests sent at once to a forwarder between the
+// minimum and maximum number of workers, unless the maximum is not set
+func withConcurrencyLimit(name string, forwarder Forwarder, config appConfig) Forwarder {
+	if config.maxWorkers == 0 {
+		return forwarder
+	}
+	return &limitedForwarder{Forwarder: forwarder, limit: newConcurrencyLimit(name, config, time.Now)}
+}
+
+func (f *limitedForwarder) stopping() {
+	notifyStopping(f.Forwarder)
+}
+
+func (f *limitedForwarder) pausedUntil() time.Time {
+	return pausedUntilOf(f.Forwarder)
+}
+
+func (f *limitedForwarder) forward(batch []*message, callback func(*message, error)) {
+	sent := f.limit.acquire()
+	mutex := sync.Mutex{}
+	var failure error
+	f.Forwarder.forward(batch, func(m *message, err error) {
+		// events waiting to be indexed are called back later, only the outcome of the
+		// request itself counts
+		if err != nil && err != errThrottled && policyOf(err) == policyRetry {
+			mutex.Lock()
+			failure = err
+			mutex.Unlock()
+		}
+		callback(m, err)
+	})
+	mutex.Lock()
+	err := failure
+	mutex.Unlock()
+	if pausedUntilOf(f.Forwarder).After(sent) {
+		// the time spent waiting on a throttling destination is neither latency nor failure
+		f.limit.skip()
+		return
+	}
+	f.limit.release(sent, err)
+}
+
+// isTimeout tells whether a request failed because the destination did not answer in time
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
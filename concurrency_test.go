@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newConcurrencyLimitMock(workers int, maxWorkers int, clock *fakeClock) *concurrencyLimit {
+	limitConfig := config
+	limitConfig.workers = workers
+	limitConfig.minWorkers = 2
+	limitConfig.maxWorkers = maxWorkers
+	limitConfig.latencyTarget = time.Second
+	return newConcurrencyLimit("test", limitConfig, clock.now)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func Test_ConcurrencyLimit_GrowsWhenFast(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	l := newConcurrencyLimitMock(4, 16, clock)
+
+	// one more request for every round of successful requests
+	for i := 0; i < 4; i++ {
+		l.release(l.acquire(), nil)
+	}
+	assert.Equal(t, 4, l.current())
+	l.release(l.acquire(), nil)
+	assert.Equal(t, 5, l.current())
+
+	for i := 0; i < 1000; i++ {
+		l.release(l.acquire(), nil)
+	}
+	assert.Equal(t, 16, l.current(), "the limit should not grow beyond the ceiling")
+}
+
+func Test_ConcurrencyLimit_Shrinks(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	l := newConcurrencyLimitMock(16, 16, clock)
+
+	// requests sent together and failing together shrink the limit once
+	first, second := l.acquire(), l.acquire()
+	clock.t = clock.t.Add(100 * time.Millisecond)
+	l.release(first, errors.New("connection refused"))
+	l.release(second, errors.New("connection refused"))
+	assert.Equal(t, 8, l.current())
+
+	sent := l.acquire()
+	clock.t = clock.t.Add(2 * time.Second)
+	l.release(sent, nil)
+	assert.Equal(t, 7, l.current(), "slow requests should shrink the limit gently")
+
+	l.release(l.acquire(), timeoutError{})
+	assert.Equal(t, 2, l.current(), "timeouts should shrink the limit quickly, down to the floor")
+}
+
+// countingForwarderMock records the most requests it has been sent at once
+type countingForwarderMock struct {
+	Forwarder
+	lock    sync.Mutex
+	current int
+	most    int
+}
+
+func (forwarder *countingForwarderMock) forward(batch []*message, callback func(*message, error)) {
+	forwarder.lock.Lock()
+	forwarder.current++
+	if forwarder.current > forwarder.most {
+		forwarder.most = forwarder.current
+	}
+	forwarder.lock.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	forwarder.lock.Lock()
+	forwarder.current--
+	forwarder.lock.Unlock()
+	for _, m := range batch {
+		callback(m, nil)
+	}
+}
+
+func Test_ConcurrencyLimit_BoundsRequests(t *testing.T) {
+	counting := &countingForwarderMock{}
+	forwarder := &limitedForwarder{Forwarder: counting, limit: newConcurrencyLimitMock(3, 3, &fakeClock{t: time.Unix(1000, 0)})}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forwarder.forward(messages("a"), func(*message, error) {})
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 3, counting.most)
+}
+
+func Test_ConcurrencyLimit_RequestTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer server.Close()
+	timeoutConfig := config
+	timeoutConfig.fwdURL = server.URL
+	timeoutConfig.requestTimeout = 100 * time.Millisecond
+
+	for _, forwarder := range []Forwarder{NewSplunkForwarder(timeoutConfig), NewHTTPForwarder(timeoutConfig)} {
+		results := collectResults(forwarder, messages(`{"event":"slow"}`))
+		assert.True(t, isTimeout(results[`{"event":"slow"}`]), "requests the destination does not answer in time should time out")
+	}
+}
+
+func Test_ConcurrencyLimit_IgnoresThrottling(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	throttled := &pausedForwarderMock{rejectingForwarderMock: rejectingForwarderMock{err: errThrottled}, until: clock.t.Add(time.Minute)}
+	forwarder := &limitedForwarder{Forwarder: throttled, limit: newConcurrencyLimitMock(8, 64, clock)}
+
+	collectResults(forwarder, messages("a"))
+
+	assert.Equal(t, 8.0, forwarder.limit.limit, "waiting on a throttling destination should not adapt the limit")
+	assert.Equal(t, 0, forwarder.limit.inFlight)
+}
+
+func Test_ValidateParamsConcurrency(t *testing.T) {
+	limitConfig := config
+	limitConfig.workers = 8
+	limitConfig.minWorkers = 1
+	limitConfig.maxWorkers = 4
+	assert.Error(t, validateParams(limitConfig))
+
+	limitConfig.maxWorkers = 64
+	assert.NoError(t, validateParams(limitConfig))
+}
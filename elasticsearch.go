@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// elasticsearchClient delivers events to the _bulk API of Elasticsearch or OpenSearch
+type elasticsearchClient struct {
+	*httpSink
+}
+
+type bulkAction struct {
+	Index bulkIndex `json:"index"`
+}
+
+type bulkIndex struct {
+	Index string `json:"_index"`
+}
+
+type bulkResponse struct {
+	Errors bool                        `json:"errors"`
+	Items  []map[string]bulkItemResult `json:"items"`
+}
+
+type bulkItemResult struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+func NewElasticsearchForwarder(config appConfig) Forwarder {
+	return &elasticsearchClient{httpSink: newHTTPSink(config)}
+}
+
+func (es *elasticsearchClient) forward(batch []*message, callback func(*message, error)) {
+	body := &bytes.Buffer{}
+	for _, m := range batch {
+		index, doc := es.document(m.body)
+		action, _ := json.Marshal(bulkAction{Index: bulkIndex{Index: index}})
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(doc)
+		body.WriteByte('\n')
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-ndjson")
+	if es.config.token != "" {
+		header.Set("Authorization", "ApiKey "+es.config.token)
+	}
+	r, buf, err := es.post(es.config.fwdURL, header, body.Bytes())
+	if err != nil {
+		es.fail(batch, err, callback)
+		return
+	}
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		es.reject(batch, r, buf, callback)
+		return
+	}
+	es.setHealth(nil)
+
+	resp := bulkResponse{}
+	if err := json.Unmarshal(buf, &resp); err != nil || !resp.Errors || len(resp.Items) != len(batch) {
+		for _, m := range batch {
+			callback(m, nil)
+		}
+		return
+	}
+	// the bulk API reports the outcome of every single document
+	for i, m := range batch {
+		var result bulkItemResult
+		for _, item := range resp.Items[i] {
+			result = item
+		}
+		if result.Status >= 200 && result.Status <= 299 {
+			callback(m, nil)
+			continue
+		}
+		errorCounter.Inc()
+		callback(m, &sinkError{status: result.Status, text: string(result.Error), policy: policyForStatus(result.Status)})
+	}
+}
+
+// document maps an event to the index and the document to store. HEC envelopes are
+// unwrapped, other JSON objects are stored as they are and anything else is stored
+// as the message field of a document.
+func (es *elasticsearchClient) document(body string) (string, []byte) {
+	index := es.config.index
+	envelope := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(body), &envelope); err != nil {
+		doc, _ := json.Marshal(map[string]string{"message": body})
+		return index, doc
+	}
+	event, ok := envelope["event"]
+	if !ok {
+		return index, []byte(body)
+	}
+
+	doc, ok := event.(map[string]interface{})
+	if !ok {
+		doc = map[string]interface{}{"message": event}
+	}
+	for _, field := range []string{"host", "source", "sourcetype"} {
+		if value, ok := envelope[field]; ok {
+			if _, exists := doc[field]; !exists {
+				doc[field] = value
+			}
+		}
+	}
+	if t, ok := hecTime(envelope["time"]); ok {
+		doc["@timestamp"] = t.UTC().Format(time.RFC3339Nano)
+	}
+	if i, ok := envelope["index"].(string); ok && i != "" {
+		index = i
+	}
+	buf, _ := json.Marshal(doc)
+	return index, buf
+}
+
+// hecTime parses the epoch time of a HEC envelope, given in seconds as a number or a string
+func hecTime(value interface{}) (time.Time, bool) {
+	var seconds float64
+	switch v := value.(type) {
+	case float64:
+		seconds = v
+	case string:
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		seconds = parsed
+	default:
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), true
+}
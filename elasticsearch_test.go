@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newElasticsearchTestServer(t *testing.T, lines chan<- []string, response string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		assert.Equal(t, "ApiKey secret", r.Header.Get("Authorization"))
+		buf, _ := ioutil.ReadAll(r.Body)
+		lines <- strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+		w.Write([]byte(response))
+	}))
+}
+
+func Test_Elasticsearch_Forward(t *testing.T) {
+	lines := make(chan []string, 1)
+	server := newElasticsearchTestServer(t, lines, `{"errors":false,"items":[{"index":{"status":201}},{"index":{"status":201}}]}`)
+	defer server.Close()
+
+	esConfig := config
+	esConfig.fwdURL = server.URL + "/_bulk"
+	esConfig.index = "logs"
+	forwarder := NewElasticsearchForwarder(esConfig)
+
+	forwarder.forward(messages(
+		`{"event":{"msg":"hello"},"time":1500000000.5,"host":"node-1","index":"publish"}`,
+		`not json`,
+	), func(m *message, err error) {
+		assert.NoError(t, err)
+	})
+
+	bulk := <-lines
+	assert.Len(t, bulk, 4)
+	assert.JSONEq(t, `{"index":{"_index":"publish"}}`, bulk[0])
+	assert.JSONEq(t, `{"msg":"hello","host":"node-1","@timestamp":"2017-07-14T02:40:00.5Z"}`, bulk[1])
+	assert.JSONEq(t, `{"index":{"_index":"logs"}}`, bulk[2])
+	assert.JSONEq(t, `{"message":"not json"}`, bulk[3])
+	assert.NoError(t, forwarder.getHealth())
+}
+
+func Test_Elasticsearch_ItemErrors(t *testing.T) {
+	lines := make(chan []string, 1)
+	server := newElasticsearchTestServer(t, lines, `{"errors":true,"items":[
+		{"index":{"status":201}},
+		{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}},
+		{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}}]}`)
+	defer server.Close()
+
+	esConfig := config
+	esConfig.fwdURL = server.URL + "/_bulk"
+	forwarder := NewElasticsearchForwarder(esConfig)
+
+	results := map[string]error{}
+	forwarder.forward(messages(`{"a":1}`, `{"a":"b"}`, `{"a":2}`), func(m *message, err error) {
+		results[m.body] = err
+	})
+	<-lines
+
+	assert.NoError(t, results[`{"a":1}`])
+	assert.Equal(t, policyDeadLetter, policyOf(results[`{"a":"b"}`]))
+	assert.Contains(t, results[`{"a":"b"}`].Error(), "mapper_parsing_exception")
+	assert.Equal(t, policyRetry, policyOf(results[`{"a":2}`]))
+}
+
+func Test_Elasticsearch_Unauthorized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	esConfig := config
+	esConfig.fwdURL = server.URL + "/_bulk"
+	forwarder := NewElasticsearchForwarder(esConfig)
+
+	forwarder.forward(messages(`{"a":1}`), func(m *message, err error) {
+		assert.Equal(t, policyStop, policyOf(err))
+	})
+	assert.Error(t, forwarder.getHealth())
+}
+
+func Test_Elasticsearch_Document(t *testing.T) {
+	es := &elasticsearchClient{httpSink: &httpSink{config: appConfig{index: "logs"}}}
+
+	index, doc := es.document(`{"event":"plain text","sourcetype":"access","time":"1500000000"}`)
+	assert.Equal(t, "logs", index)
+	parsed := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(doc, &parsed))
+	assert.Equal(t, "plain text", parsed["message"])
+	assert.Equal(t, "access", parsed["sourcetype"])
+	assert.Equal(t, "2017-07-14T02:40:00Z", parsed["@timestamp"])
+
+	index, doc = es.document(`{"level":"info"}`)
+	assert.Equal(t, "logs", index)
+	assert.JSONEq(t, `{"level":"info"}`, string(doc))
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	health "github.com/Financial-Times/go-fthealth/v1_1"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// object metadata listing the destinations that have already taken the events of an object
+const fannedOutMetadata = "fanned-out"
+
+var (
+	fanoutDeliveredCounter *prometheus.CounterVec
+	fanoutCachedCounter    *prometheus.CounterVec
+	fanoutFailedCounter    *prometheus.CounterVec
+	destinationNamePattern = regexp.MustCompile(`^[a-z0-9-]+$`)
+	errDestinationBusy     = errors.New("destination is not keeping up, event cached for a later retry")
+)
+
+// destinationConfig is read from DESTINATION_<NAME>_SINK, DESTINATION_<NAME>_URL
+// and DESTINATION_<NAME>_TOKEN for every name listed in --destinations
+type destinationConfig struct {
+	name  string
+	sink  string
+	url   string
+	token string
+}
+
+// names that would make the prefix of a destination cache, <env>-<name>, collide with
+// the prefixes of the caches of the service or of another destination
+var reservedDestinationSuffixes = []string{deadLetterSuffix, inFlightSuffix, quarantineSuffix, membersSuffix}
+
+// destination is one of the forwarders events are fanned out to, along with the cache
+// holding the events it still has to retry
+type destination struct {
+	name      string
+	forwarder Forwarder
+	cache     Cache
+	// stops polling the destination for acknowledgements, if it is polled
+	stop func()
+}
+
+// fanoutForwarder delivers every event to all its destinations. An event that one
+// destination fails to take is cached for that destination only, so an event is done
+// once every destination has either delivered or cached it. Every destination has its
+// own queue and workers, so that a slow destination does not hold up the others: when
+// its queue is full, the events are cached for it straight away.
+type fanoutForwarder struct {
+	sync.Mutex
+	destinations []destination
+	queues       []chan fanoutBatch
+	latestError  error
+}
+
+// fanoutBatch is a batch waiting for a destination
+type fanoutBatch struct {
+	batch  []*message
+	settle func(*message, error)
+}
+
+// fanoutResult tracks the outcome of an event across destinations
+type fanoutResult struct {
+	pending int
+	err     error
+}
+
+func NewFanoutForwarder(destinations []destination, config appConfig) Forwarder {
+	if fanoutDeliveredCounter == nil {
+		fanoutDeliveredCounter = registerCounterVec("fanout_delivered_count", "Number of messages delivered by destination", "destination")
+		fanoutCachedCounter = registerCounterVec("fanout_cached_count", "Number of messages cached for a later retry by destination", "destination")
+		fanoutFailedCounter = registerCounterVec("fanout_failed_count", "Number of messages that could not be delivered nor cached by destination", "destination")
+	}
+	workers := config.workers
+	if config.maxWorkers > workers {
+		workers = config.maxWorkers
+	}
+	fanout := &fanoutForwarder{destinations: destinations}
+	for _, d := range destinations {
+		queue := make(chan fanoutBatch, config.chanBuffer)
+		fanout.queues = append(fanout.queues, queue)
+		for i := 0; i < workers; i++ {
+			go fanout.deliver(d, queue)
+		}
+	}
+	return fanout
+}
+
+// forward sends every event to the destinations that have not taken it yet. An event that
+// some destination could neither deliver nor cache fails, and is retried later with the
+// destinations that did take it recorded, so that they do not get it twice.
+func (fanout *fanoutForwarder) forward(batch []*message, callback func(*message, error)) {
+	mutex := sync.Mutex{}
+	results := make(map[*message]*fanoutResult, len(batch))
+	batches := make([][]*message, len(fanout.destinations))
+	for _, m := range batch {
+		result := &fanoutResult{}
+		results[m] = result
+		for i, d := range fanout.destinations {
+			if !hasFannedOut(m, d.name) {
+				batches[i] = append(batches[i], m)
+				result.pending++
+			}
+		}
+	}
+	settleFor := func(d destination) func(*message, error) {
+		return func(m *message, err error) {
+			mutex.Lock()
+			result := results[m]
+			result.pending--
+			if err != nil {
+				result.err = err
+			} else {
+				m.fannedOut = append(m.fannedOut, d.name)
+			}
+			done := result.pending == 0
+			mutex.Unlock()
+			if done {
+				callback(m, result.err)
+			}
+		}
+	}
+
+	for _, m := range batch {
+		if results[m].pending == 0 {
+			callback(m, nil)
+		}
+	}
+	for i, d := range fanout.destinations {
+		if len(batches[i]) == 0 {
+			continue
+		}
+		settle := settleFor(d)
+		select {
+		case fanout.queues[i] <- fanoutBatch{batch: batches[i], settle: settle}:
+		default:
+			// the destination is not keeping up, its processor retries the events from its cache
+			for _, m := range batches[i] {
+				settle(m, fanout.settle(d, m, errDestinationBusy))
+			}
+		}
+	}
+}
+
+// hasFannedOut tells whether a destination has already taken an event
+func hasFannedOut(m *message, name string) bool {
+	for _, taken := range m.fannedOut {
+		if taken == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFannedOut reads the destinations that have taken the events of an object from its
+// metadata
+func parseFannedOut(metadata map[string]*string) []string {
+	// S3 returns metadata keys in canonical header form
+	for key, value := range metadata {
+		if strings.EqualFold(key, fannedOutMetadata) && aws.StringValue(value) != "" {
+			return strings.Split(aws.StringValue(value), ",")
+		}
+	}
+	return nil
+}
+
+// deliver forwards the batches queued for a destination
+func (fanout *fanoutForwarder) deliver(d destination, queue <-chan fanoutBatch) {
+	for b := range queue {
+		b := b
+		d.forwarder.forward(b.batch, func(m *message, err error) {
+			b.settle(m, fanout.settle(d, m, err))
+		})
+	}
+}
+
+// stopping lets the destinations give up waiting on throttling
+func (fanout *fanoutForwarder) stopping() {
+	for _, d := range fanout.destinations {
+		notifyStopping(d.forwarder)
+	}
+}
+
+// stop stops the destinations polling for acknowledgements, once their processors have stopped
+func (fanout *fanoutForwarder) stop() {
+	for _, d := range fanout.destinations {
+		if d.stop != nil {
+			d.stop()
+		}
+	}
+}
+
+// settle applies the error policy of a destination to an event, using the cache of the
+// destination, and returns an error only when the event could not be dealt with
+func (fanout *fanoutForwarder) settle(d destination, m *message, err error) error {
+	if err == nil {
+		fanoutDeliveredCounter.WithLabelValues(d.name).Inc()
+		return nil
+	}
+	var cacheErr error
+	switch policyOf(err) {
+	case policyDiscard:
+		return nil
+	case policyDeadLetter:
+		cacheErr = d.cache.DeadLetter(m.body, err)
+	default:
+		cacheErr = d.cache.Put(m.body)
+	}
+	fanout.setHealth(cacheErr)
+	if cacheErr != nil {
+		fanoutFailedCounter.WithLabelValues(d.name).Inc()
+		return fmt.Errorf("destination %v: %v", d.name, cacheErr)
+	}
+	fanoutCachedCounter.WithLabelValues(d.name).Inc()
+	return nil
+}
+
+// getHealth reports failures to cache events for a destination, the health of each
+// destination is checked separately
+func (fanout *fanoutForwarder) getHealth() error {
+	fanout.Lock()
+	defer fanout.Unlock()
+	return fanout.latestError
+}
+
+func (fanout *fanoutForwarder) setHealth(err error) {
+	fanout.Lock()
+	defer fanout.Unlock()
+	fanout.latestError = err
+}
+
+// newFanout creates a forwarder and a retry cache for every destination, along with the
+// processors retrying the events cached for each destination and their healthchecks
+func newFanout(config appConfig) (Forwarder, []LogProcessor, []health.Check, error) {
+	destinations := []destination{}
+	processors := []LogProcessor{}
+	checks := []health.Check{}
+	for _, d := range config.destinations {
+		destinationConfig := config
+		destinationConfig.sink = d.sink
+		destinationConfig.fwdURL = d.url
+		destinationConfig.token = d.token
+		forwarder, err := NewForwarder(destinationConfig)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		var stop func()
+		if splunk, ok := forwarder.(*splunkClient); ok {
+			stop = splunk.stop
+		}
+		// shared by the fan-out and the processor retrying the events of the destination
+		forwarder = guardForwarder(d.name, forwarder, destinationConfig)
+		cache, err := NewS3Service(config.env+"-"+d.name, config)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		destinations = append(destinations, destination{name: d.name, forwarder: forwarder, cache: cache, stop: stop})
+		processors = append(processors, NewLogProcessor(forwarder, cache, destinationConfig))
+
+		s, _ := lookupSink(d.sink)
+		checks = append(checks, destinationChecks(fmt.Sprintf("%v %v", s.name, d.name), forwarder)...)
+	}
+
+	return NewFanoutForwarder(destinations, config), processors, checks, nil
+}
+
+// fanoutCacheCheck reports failures to cache events for a destination
+func fanoutCacheCheck(fanout *fanoutForwarder) health.Check {
+	return health.Check{
+		BusinessImpact:   "Logs that a destination failed to take may be lost",
+		Name:             "Destination retry cache",
+		PanicGuide:       "https://runbooks.in.ft.com/resilient-splunk-forwarder",
+		Severity:         1,
+		TechnicalSummary: "Latest attempt to cache a log for a destination has failed - check journal file",
+		Checker: func() (string, error) {
+			err := fanout.getHealth()
+			if err != nil {
+				return "Destination retry cache is not healthy", err
+			}
+			return "Destination retry cache is healthy", nil
+		},
+	}
+}
+
+func parseDestinations(names string, getenv func(string) string) ([]destinationConfig, error) {
+	destinations := []destinationConfig{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !destinationNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("destination name %q must only contain lowercase letters, digits and dashes", name)
+		}
+		for _, suffix := range reservedDestinationSuffixes {
+			if "-"+name == suffix || strings.HasSuffix(name, suffix) {
+				return nil, fmt.Errorf("destination name %q must not end with %v, which is used by other caches", name, strings.TrimPrefix(suffix, "-"))
+			}
+		}
+		env := "DESTINATION_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		d := destinationConfig{
+			name:  name,
+			sink:  getenv(env + "_SINK"),
+			url:   getenv(env + "_URL"),
+			token: getenv(env + "_TOKEN"),
+		}
+		if d.url == "" {
+			return nil, fmt.Errorf("%v_URL must be provided for destination %v", env, name)
+		}
+		if _, err := lookupSink(d.sink); err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, d)
+	}
+	return destinations, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// collectResults forwards a batch and records the error each event was settled with
+func collectResults(forwarder Forwarder, batch []*message) map[string]error {
+	mutex := sync.Mutex{}
+	results := map[string]error{}
+	forwarder.forward(batch, func(m *message, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		results[m.body] = err
+	})
+	return results
+}
+
+// awaitResults forwards a batch and waits until every event has been settled
+func awaitResults(t *testing.T, forwarder Forwarder, batch []*message) map[string]error {
+	mutex := sync.Mutex{}
+	results := map[string]error{}
+	forwarder.forward(batch, func(m *message, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		results[m.body] = err
+	})
+	assert.True(t, eventually(func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(results) == len(batch)
+	}, time.Second), "every event should be settled")
+	mutex.Lock()
+	defer mutex.Unlock()
+	return results
+}
+
+func Test_Fanout_CachesForFailingDestinationOnly(t *testing.T) {
+	healthyCache := &s3ServiceMock{}
+	failingCache := &s3ServiceMock{}
+	forwarder := NewFanoutForwarder([]destination{
+		{name: "healthy", forwarder: &rejectingForwarderMock{}, cache: healthyCache},
+		{name: "failing", forwarder: &rejectingForwarderMock{err: errors.New("connection refused")}, cache: failingCache},
+	}, config)
+
+	results := awaitResults(t, forwarder, messages("a", "b"))
+
+	assert.Equal(t, map[string]error{"a": nil, "b": nil}, results)
+	assert.Empty(t, healthyCache.cache)
+	assert.Equal(t, []string{"a", "b"}, failingCache.cache)
+	assert.Nil(t, forwarder.getHealth())
+}
+
+func Test_Fanout_AppliesPolicyPerDestination(t *testing.T) {
+	discardingCache := &s3ServiceMock{}
+	deadLetterCache := &s3ServiceMock{}
+	forwarder := NewFanoutForwarder([]destination{
+		{name: "discarding", forwarder: &rejectingForwarderMock{err: newHecError(400, hecResponse{Code: 5, Text: "No data"})}, cache: discardingCache},
+		{name: "deadletter", forwarder: &rejectingForwarderMock{err: &sinkError{status: 400, text: "bad event", policy: policyDeadLetter}}, cache: deadLetterCache},
+	}, config)
+
+	results := awaitResults(t, forwarder, messages("a"))
+
+	assert.Equal(t, map[string]error{"a": nil}, results)
+	assert.Empty(t, discardingCache.cache)
+	assert.Empty(t, discardingCache.deadLetters)
+	assert.Empty(t, deadLetterCache.cache)
+	assert.Equal(t, []string{"a"}, deadLetterCache.deadLetters)
+}
+
+// blockingForwarderMock holds batches until released
+type blockingForwarderMock struct {
+	Forwarder
+	release  chan struct{}
+	received int32
+}
+
+func (forwarder *blockingForwarderMock) forward(batch []*message, callback func(*message, error)) {
+	atomic.AddInt32(&forwarder.received, 1)
+	<-forwarder.release
+	for _, m := range batch {
+		callback(m, nil)
+	}
+}
+
+func Test_Fanout_SlowDestinationDoesNotHoldUpOthers(t *testing.T) {
+	slowConfig := config
+	slowConfig.workers = 1
+	slowConfig.chanBuffer = 1
+	slow := &blockingForwarderMock{release: make(chan struct{})}
+	slowCache := &s3ServiceMock{}
+	forwarder := NewFanoutForwarder([]destination{
+		{name: "fast", forwarder: &rejectingForwarderMock{}, cache: &s3ServiceMock{}},
+		{name: "slow", forwarder: slow, cache: slowCache},
+	}, slowConfig)
+
+	mutex := sync.Mutex{}
+	results := map[string]error{}
+	callback := func(m *message, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		results[m.body] = err
+	}
+	forwarder.forward(messages("a"), callback)
+	assert.True(t, eventually(func() bool { return atomic.LoadInt32(&slow.received) == 1 }, time.Second))
+	// queued for the slow destination
+	forwarder.forward(messages("b"), callback)
+	// no room left in the queue of the slow destination
+	forwarder.forward(messages("c"), callback)
+
+	assert.True(t, eventually(func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(results) == 1
+	}, time.Second))
+	mutex.Lock()
+	assert.Equal(t, map[string]error{"c": nil}, results, "only the event cached for the slow destination should be done")
+	mutex.Unlock()
+	assert.Equal(t, []string{"c"}, slowCache.cache)
+
+	close(slow.release)
+	assert.True(t, eventually(func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(results) == 3
+	}, time.Second))
+	assert.Equal(t, []string{"c"}, slowCache.cache)
+}
+
+type failingCacheMock struct {
+	s3ServiceMock
+}
+
+func (cache *failingCacheMock) Put(objs ...string) error {
+	return errors.New("bucket unavailable")
+}
+
+func (cache *failingCacheMock) Requeue(msgs ...*message) error {
+	return errors.New("bucket unavailable")
+}
+
+func Test_Fanout_FailsWhenEventCannotBeCached(t *testing.T) {
+	forwarder := NewFanoutForwarder([]destination{
+		{name: "healthy", forwarder: &rejectingForwarderMock{}, cache: &s3ServiceMock{}},
+		{name: "failing", forwarder: &rejectingForwarderMock{err: errors.New("connection refused")}, cache: &failingCacheMock{}},
+	}, config)
+
+	results := awaitResults(t, forwarder, messages("a"))
+
+	assert.Error(t, results["a"])
+	assert.Contains(t, results["a"].Error(), "failing")
+	assert.Error(t, forwarder.getHealth())
+}
+
+// flakyCacheMock fails to cache events a number of times before it recovers
+type flakyCacheMock struct {
+	s3ServiceMock
+	failures int32
+}
+
+func (cache *flakyCacheMock) Put(objs ...string) error {
+	if atomic.AddInt32(&cache.failures, -1) >= 0 {
+		return errors.New("bucket unavailable")
+	}
+	return cache.s3ServiceMock.Put(objs...)
+}
+
+func Test_Fanout_RetriesOnlyDestinationsThatDidNotTakeTheEvent(t *testing.T) {
+	healthy := &slowForwarderMock{}
+	failingCache := &flakyCacheMock{failures: 1}
+	forwarder := NewFanoutForwarder([]destination{
+		{name: "healthy", forwarder: healthy, cache: &s3ServiceMock{}},
+		{name: "failing", forwarder: &rejectingForwarderMock{err: errors.New("connection refused")}, cache: failingCache},
+	}, config)
+	batch := messages("a")
+
+	results := awaitResults(t, forwarder, batch)
+	assert.Error(t, results["a"])
+	assert.Equal(t, []string{"healthy"}, batch[0].fannedOut)
+
+	// retried once the cache of the failing destination is back
+	results = awaitResults(t, forwarder, batch)
+	assert.NoError(t, results["a"])
+	healthy.Lock()
+	assert.Equal(t, []string{"a"}, healthy.delivered, "the event should not be sent again to the destination that took it")
+	healthy.Unlock()
+	assert.Equal(t, []string{"a"}, failingCache.cache)
+}
+
+func Test_Fanout_StopsDestinations(t *testing.T) {
+	stopped := []string{}
+	forwarder := NewFanoutForwarder([]destination{
+		{name: "splunk", forwarder: &rejectingForwarderMock{}, cache: &s3ServiceMock{}, stop: func() { stopped = append(stopped, "splunk") }},
+		{name: "search", forwarder: &rejectingForwarderMock{}, cache: &s3ServiceMock{}},
+	}, config)
+
+	forwarder.(*fanoutForwarder).stop()
+
+	assert.Equal(t, []string{"splunk"}, stopped)
+}
+
+func Test_ParseDestinations(t *testing.T) {
+	env := map[string]string{
+		"DESTINATION_PRIMARY_URL":       "http://splunk",
+		"DESTINATION_PRIMARY_TOKEN":     "secret",
+		"DESTINATION_LONG_TERM_SINK":    "elasticsearch",
+		"DESTINATION_LONG_TERM_URL":     "http://elasticsearch",
+		"DESTINATION_LONG_TERM_TOKEN":   "key",
+		"DESTINATION_UNKNOWN_SINK":      "kafka",
+		"DESTINATION_UNKNOWN_URL":       "http://kafka",
+		"DESTINATION_MISSING_URL_SINK":  "http",
+		"DESTINATION_MISSING_URL_TOKEN": "key",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	destinations, err := parseDestinations("primary, long-term", getenv)
+	assert.NoError(t, err)
+	assert.Equal(t, []destinationConfig{
+		{name: "primary", url: "http://splunk", token: "secret"},
+		{name: "long-term", sink: "elasticsearch", url: "http://elasticsearch", token: "key"},
+	}, destinations)
+
+	destinations, err = parseDestinations("", getenv)
+	assert.NoError(t, err)
+	assert.Empty(t, destinations)
+
+	_, err = parseDestinations("unknown", getenv)
+	assert.Error(t, err)
+	_, err = parseDestinations("missing-url", getenv)
+	assert.Error(t, err)
+	_, err = parseDestinations("Primary", getenv)
+	assert.Error(t, err)
+	for _, reserved := range []string{"dlq", "inflight", "quarantine", "members", "primary-dlq"} {
+		env["DESTINATION_"+strings.ToUpper(strings.Replace(reserved, "-", "_", -1))+"_URL"] = "http://splunk"
+		_, err = parseDestinations(reserved, getenv)
+		assert.Error(t, err, reserved)
+	}
+}
+
+func Test_ValidateParamsDestinations(t *testing.T) {
+	fanoutConfig := config
+	fanoutConfig.fwdURL = ""
+	fanoutConfig.token = ""
+	fanoutConfig.destinations = []destinationConfig{
+		{name: "primary", url: "http://splunk", token: "secret"},
+		{name: "search", sink: "elasticsearch", url: "http://elasticsearch"},
+	}
+	assert.NoError(t, validateParams(fanoutConfig))
+
+	fanoutConfig.destinations = append(fanoutConfig.destinations, destinationConfig{name: "secondary", url: "http://splunk"})
+	assert.Error(t, validateParams(fanoutConfig))
+}
+
+func Test_Fanout_S3KeepsDestinations(t *testing.T) {
+	s3service := &s3Service{
+		bucketName:   "test-bucket",
+		prefix:       "test-prefix",
+		svc:          newMemoryS3Interface(),
+		leaseTimeout: time.Minute,
+		packing:      packing{size: 10},
+	}
+
+	assert.NoError(t, s3service.Requeue(
+		&message{body: "a", fannedOut: []string{"primary"}},
+		&message{body: "b", fannedOut: []string{"primary", "search"}},
+		&message{body: "c"},
+	))
+
+	result, err := s3service.Claim()
+	assert.NoError(t, err)
+	fannedOut := map[string][]string{}
+	for _, m := range result {
+		fannedOut[m.body] = m.fannedOut
+	}
+	assert.Equal(t, map[string][]string{"a": {"primary"}, "b": {"primary", "search"}, "c": nil}, fannedOut)
+}
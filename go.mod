@@ -6,12 +6,13 @@ require (
 	github.com/Financial-Times/go-fthealth v0.0.0-20171204124831-1b007e2b37b7
 	github.com/Financial-Times/go-logger/v2 v2.0.1
 	github.com/Financial-Times/service-status-go v0.0.0-20160323111542-3f5199736a3d
+	github.com/Shopify/sarama v1.21.0
 	github.com/aws/aws-sdk-go v1.12.27-0.20171113235433-395e6c4c7c39
 	github.com/beorn7/perks v0.0.0-20180321164747-3a771d992973 // indirect
-	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/go-ini/ini v1.51.1 // indirect
 	github.com/gogo/protobuf v1.1.2-0.20180830160456-5669497fd644 // indirect
 	github.com/golang/protobuf v1.2.1-0.20180910224916-e344474228f5 // indirect
+	github.com/golang/snappy v0.0.1 // indirect
 	github.com/hashicorp/go-version v0.0.0-20170202080759-03c5bf6be031 // indirect
 	github.com/jawher/mow.cli v0.0.0-20170430135212-8327d12beb75
 	github.com/jmespath/go-jmespath v0.0.0-20180206201540-c2b33e8439af // indirect
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+
 	health "github.com/Financial-Times/go-fthealth/v1_1"
 	"github.com/Financial-Times/service-status-go/gtg"
 )
@@ -10,6 +12,8 @@ const healthPath = "/__health"
 type healthService struct {
 	config *healthConfig
 	checks []health.Check
+	// names of the checks reported on /__health only, that the service does not depend on to take traffic
+	notGTG map[string]bool
 }
 
 type healthConfig struct {
@@ -23,14 +27,87 @@ type Healthy interface {
 }
 
 func newHealthService(config *healthConfig, checks []health.Check) *healthService {
-	service := &healthService{config: config, checks: checks}
+	service := &healthService{config: config, checks: checks, notGTG: map[string]bool{}}
 	return service
 }
 
+// excludeFromGTG keeps checks out of GTG, e.g. the health of the destination when the
+// service caches the events it takes while the destination is down
+func (service *healthService) excludeFromGTG(checks []health.Check) {
+	for _, check := range checks {
+		service.notGTG[check.Name] = true
+	}
+}
+
+// destinationChecks reports the health of a forwarder and, when it honours throttling,
+// whether the destination has paused it
+func destinationChecks(name string, forwarder Forwarder) []health.Check {
+	checks := []health.Check{
+		{
+			BusinessImpact:   fmt.Sprintf("Logs are not reaching %v therefore monitoring may be affected", name),
+			Name:             fmt.Sprintf("%v healthcheck", name),
+			PanicGuide:       "https://runbooks.in.ft.com/resilient-splunk-forwarder",
+			Severity:         1,
+			TechnicalSummary: fmt.Sprintf("Latest request to %v has returned an error - check journal file", name),
+			Checker: func() (string, error) {
+				err := forwarder.getHealth()
+				if err != nil {
+					return fmt.Sprintf("%v is not healthy", name), err
+				}
+				return fmt.Sprintf("%v is healthy", name), nil
+			},
+		},
+	}
+	if breaker, ok := forwarder.(*breakerForwarder); ok {
+		checks = append(checks, health.Check{
+			BusinessImpact:   fmt.Sprintf("Logs are not reaching %v until it recovers", name),
+			Name:             fmt.Sprintf("%v circuit breaker", name),
+			PanicGuide:       "https://runbooks.in.ft.com/resilient-splunk-forwarder",
+			Severity:         2,
+			TechnicalSummary: fmt.Sprintf("Too many requests to %v have failed, events stay cached while it is probed - check journal file", name),
+			Checker: func() (string, error) {
+				err := breaker.circuitHealth()
+				if err != nil {
+					return fmt.Sprintf("Circuit to %v is not closed", name), err
+				}
+				return fmt.Sprintf("Circuit to %v is closed", name), nil
+			},
+		})
+		forwarder = breaker.Forwarder
+	}
+	if rateLimited, ok := forwarder.(*rateLimitedForwarder); ok {
+		forwarder = rateLimited.Forwarder
+	}
+	if limited, ok := forwarder.(*limitedForwarder); ok {
+		forwarder = limited.Forwarder
+	}
+	if throttled, ok := forwarder.(Throttled); ok {
+		checks = append(checks, health.Check{
+			BusinessImpact:   fmt.Sprintf("Logs are reaching %v with delay", name),
+			Name:             fmt.Sprintf("%v throttling", name),
+			PanicGuide:       "https://runbooks.in.ft.com/resilient-splunk-forwarder",
+			Severity:         2,
+			TechnicalSummary: fmt.Sprintf("%v has asked the forwarder to back off - check its status", name),
+			Checker: func() (string, error) {
+				err := throttleHealth(throttled)
+				if err != nil {
+					return fmt.Sprintf("%v is throttling requests", name), err
+				}
+				return fmt.Sprintf("%v is not throttling requests", name), nil
+			},
+		})
+	}
+	return checks
+}
+
 func (service *healthService) GTG() gtg.Status {
 	gtgChecks := []gtg.StatusChecker{}
 
 	for _, check := range service.checks {
+		if service.notGTG[check.Name] {
+			continue
+		}
+		check := check
 		gtgCheckFunc := func() gtg.Status {
 			return gtgCheck(check.Checker)
 		}
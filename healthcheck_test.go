@@ -79,3 +79,26 @@ func TestGTGHealthyCluster(t *testing.T) {
 	assert.Equal(t, "no-cache", actual.Header.Get("Cache-Control"), "cache-control header")
 	assert.Equal(t, "OK", rr.Body.String(), "GTG response body")
 }
+
+func TestGTGExcludedChecks(t *testing.T) {
+	destinationCheck := []health.Check{
+		{
+			Name: "Splunk healthcheck",
+			Checker: func() (string, error) {
+				return "Splunk is not healthy", errors.New("test error")
+			},
+		},
+	}
+	testCheck := append(destinationCheck, health.Check{
+		Name: "S3 healthcheck",
+		Checker: func() (string, error) {
+			return "S3 is healthy", nil
+		},
+	})
+
+	healthService := newHealthService(nil, testCheck)
+	assert.False(t, healthService.GTG().GoodToGo, "every check should count")
+
+	healthService.excludeFromGTG(destinationCheck)
+	assert.True(t, healthService.GTG().GoodToGo)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// httpJSONClient delivers each batch as a JSON array of events to a generic HTTP endpoint
+type httpJSONClient struct {
+	*httpSink
+}
+
+func NewHTTPForwarder(config appConfig) Forwarder {
+	return &httpJSONClient{httpSink: newHTTPSink(config)}
+}
+
+func (h *httpJSONClient) forward(batch []*message, callback func(*message, error)) {
+	events := make([]json.RawMessage, len(batch))
+	for i, m := range batch {
+		if json.Valid([]byte(m.body)) {
+			events[i] = json.RawMessage(m.body)
+		} else {
+			// not JSON, send it as a string
+			events[i], _ = json.Marshal(m.body)
+		}
+	}
+	body, _ := json.Marshal(events)
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	if h.config.token != "" {
+		header.Set("Authorization", "Bearer "+h.config.token)
+	}
+	r, buf, err := h.post(h.config.fwdURL, header, body)
+	if err != nil {
+		h.fail(batch, err, callback)
+		return
+	}
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		h.reject(batch, r, buf, callback)
+		return
+	}
+	h.setHealth(nil)
+	for _, m := range batch {
+		callback(m, nil)
+	}
+}
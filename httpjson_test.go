@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HTTPJSON_Forward(t *testing.T) {
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		buf, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(buf)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	httpConfig := config
+	httpConfig.fwdURL = server.URL
+	forwarder := NewHTTPForwarder(httpConfig)
+
+	forwarder.forward(messages(`{"event":"json"}`, `plain text`), func(m *message, err error) {
+		assert.NoError(t, err)
+	})
+
+	assert.JSONEq(t, `[{"event":"json"},"plain text"]`, <-bodies)
+	assert.NoError(t, forwarder.getHealth())
+}
+
+func Test_HTTPJSON_Rejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("malformed"))
+	}))
+	defer server.Close()
+
+	httpConfig := config
+	httpConfig.fwdURL = server.URL
+	forwarder := NewHTTPForwarder(httpConfig)
+
+	forwarder.forward(messages(`{"event":"json"}`), func(m *message, err error) {
+		assert.Equal(t, policyDeadLetter, policyOf(err))
+		assert.Contains(t, err.Error(), "malformed")
+	})
+	assert.NoError(t, forwarder.getHealth(), "rejected events do not make the destination unhealthy")
+}
+
+func Test_HTTPJSON_Throttled(t *testing.T) {
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	httpConfig := config
+	httpConfig.fwdURL = server.URL
+	forwarder := NewHTTPForwarder(httpConfig)
+
+	start := time.Now()
+	forwarder.forward(messages(`{"event":"json"}`), func(m *message, err error) {
+		assert.NoError(t, err)
+	})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.True(t, time.Since(start) >= minThrottlePause, "the request should be retried after the shortest pause")
+}
+
+func Test_HTTPJSON_Unreachable(t *testing.T) {
+	httpConfig := config
+	httpConfig.fwdURL = "http://127.0.0.1:1"
+	forwarder := NewHTTPForwarder(httpConfig)
+
+	forwarder.forward(messages(`{"event":"json"}`), func(m *message, err error) {
+		assert.Equal(t, policyRetry, policyOf(err))
+	})
+	assert.Error(t, forwarder.getHealth())
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	ingestEventPath  = "/services/collector/event"
+	ingestRawPath    = "/services/collector/raw"
+	ingestHealthPath = "/services/collector/health"
+	// largest request body accepted by the ingest endpoints, after decompression
+	maxIngestBytes = 100 * 1024 * 1024
+	// how long a request waits for the destination before its events are cached
+	maxIngestWait = 10 * time.Second
+)
+
+var (
+	ingestCounter   *prometheus.CounterVec
+	errIngestCached = errors.New("destination is not taking events in time, event cached for a later retry")
+)
+
+// ingestHandler accepts events on the HEC endpoints and forwards them straight away.
+// Events the destination does not take are cached, so that producers get the same
+// buffering as the events written to S3 by other means.
+type ingestHandler struct {
+	tokens     []string
+	forwarder  Forwarder
+	cache      Cache
+	batchSize  int
+	batchBytes int
+	maxWait    time.Duration
+	uppLogger  *logger.UPPLogger
+	now        func() time.Time
+}
+
+// rawEnvelope is the HEC envelope wrapping each line sent to the raw endpoint
+type rawEnvelope struct {
+	Time       json.Number `json:"time"`
+	Host       string      `json:"host,omitempty"`
+	Source     string      `json:"source,omitempty"`
+	Sourcetype string      `json:"sourcetype,omitempty"`
+	Index      string      `json:"index,omitempty"`
+	Event      string      `json:"event"`
+}
+
+func newIngestHandler(forwarder Forwarder, cache Cache, config appConfig) *ingestHandler {
+	if ingestCounter == nil {
+		ingestCounter = registerCounterVec("ingest_count", "Number of events received on the HEC endpoints by outcome", "outcome")
+	}
+	return &ingestHandler{
+		tokens:     config.ingestTokens,
+		forwarder:  forwarder,
+		cache:      cache,
+		batchSize:  config.batchSize,
+		batchBytes: config.batchBytes,
+		maxWait:    maxIngestWait,
+		uppLogger:  config.UPPLogger,
+		now:        time.Now,
+	}
+}
+
+func (ingest *ingestHandler) register(serveMux *http.ServeMux) {
+	serveMux.HandleFunc("/services/collector", ingest.handleEvent)
+	serveMux.HandleFunc(ingestEventPath, ingest.handleEvent)
+	serveMux.HandleFunc(ingestRawPath, ingest.handleRaw)
+	serveMux.HandleFunc(ingestHealthPath, func(w http.ResponseWriter, r *http.Request) {
+		writeHecResponse(w, http.StatusOK, hecResponse{Text: "HEC is healthy", Code: 17})
+	})
+}
+
+func (ingest *ingestHandler) handleEvent(w http.ResponseWriter, r *http.Request) {
+	body, ok := ingest.readRequest(w, r)
+	if !ok {
+		return
+	}
+	received := ingest.receivedTime()
+	events := []string{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	for i := 0; ; i++ {
+		var envelope map[string]json.RawMessage
+		err := decoder.Decode(&envelope)
+		if err == io.EOF {
+			break
+		}
+		if err != nil || envelope == nil {
+			writeHecResponse(w, http.StatusBadRequest, hecResponse{Text: "Invalid data format", Code: 6, InvalidEventNumber: &i})
+			return
+		}
+		event, ok := envelope["event"]
+		if !ok {
+			writeHecResponse(w, http.StatusBadRequest, hecResponse{Text: "Event field is required", Code: 12, InvalidEventNumber: &i})
+			return
+		}
+		if s := string(event); s == `""` || s == "null" {
+			writeHecResponse(w, http.StatusBadRequest, hecResponse{Text: "Event field cannot be blank", Code: 13, InvalidEventNumber: &i})
+			return
+		}
+		// keep the time the event was received, as it may be delivered much later
+		if _, ok := envelope["time"]; !ok {
+			envelope["time"] = json.RawMessage(received)
+		}
+		buf, _ := json.Marshal(envelope)
+		events = append(events, string(buf))
+	}
+	ingest.deliver(w, events)
+}
+
+func (ingest *ingestHandler) handleRaw(w http.ResponseWriter, r *http.Request) {
+	body, ok := ingest.readRequest(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	envelope := rawEnvelope{
+		Time:       json.Number(ingest.receivedTime()),
+		Host:       query.Get("host"),
+		Source:     query.Get("source"),
+		Sourcetype: query.Get("sourcetype"),
+		Index:      query.Get("index"),
+	}
+	events := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), maxIngestBytes)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		envelope.Event = line
+		buf, _ := json.Marshal(envelope)
+		events = append(events, string(buf))
+	}
+	if err := scanner.Err(); err != nil {
+		writeHecResponse(w, http.StatusBadRequest, hecResponse{Text: "Invalid data format", Code: 6})
+		return
+	}
+	ingest.deliver(w, events)
+}
+
+// readRequest authorizes the request and reads its body, writing the HEC error response
+// when either fails
+func (ingest *ingestHandler) readRequest(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		writeHecResponse(w, http.StatusUnauthorized, hecResponse{Text: "Token is required", Code: 2})
+		return nil, false
+	}
+	parts := strings.SplitN(authorization, " ", 2)
+	if len(parts) != 2 || parts[0] != "Splunk" {
+		writeHecResponse(w, http.StatusUnauthorized, hecResponse{Text: "Invalid authorization", Code: 3})
+		return nil, false
+	}
+	if !ingest.validToken(strings.TrimSpace(parts[1])) {
+		writeHecResponse(w, http.StatusForbidden, hecResponse{Text: "Invalid token", Code: 4})
+		return nil, false
+	}
+
+	var reader io.Reader = http.MaxBytesReader(w, r.Body, maxIngestBytes)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			writeHecResponse(w, http.StatusBadRequest, hecResponse{Text: "Invalid data format", Code: 6})
+			return nil, false
+		}
+		defer gz.Close()
+		reader = io.LimitReader(gz, maxIngestBytes+1)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil || len(body) > maxIngestBytes {
+		writeHecResponse(w, http.StatusBadRequest, hecResponse{Text: "Invalid data format", Code: 6})
+		return nil, false
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		writeHecResponse(w, http.StatusBadRequest, hecResponse{Text: "No data", Code: 5})
+		return nil, false
+	}
+	return body, true
+}
+
+func (ingest *ingestHandler) validToken(token string) bool {
+	valid := false
+	for _, t := range ingest.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// deliver forwards the events in batches and caches the ones the destination did not take.
+// Producers are not held up by a destination that is down or throttling: the events are
+// cached straight away while the destination is not ready, and once the longest wait is
+// over for the events it has not answered for yet. The producer is only told to retry when
+// an event could neither be delivered nor cached.
+func (ingest *ingestHandler) deliver(w http.ResponseWriter, events []string) {
+	msgs := make([]*message, 0, len(events))
+	for _, event := range events {
+		msgs = append(msgs, &message{body: event})
+	}
+
+	mutex := sync.Mutex{}
+	settled := make(map[*message]bool, len(msgs))
+	failed := 0
+	wg := sync.WaitGroup{}
+	wg.Add(len(msgs))
+	settle := func(m *message, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if settled[m] {
+			// already cached after the longest wait
+			return
+		}
+		settled[m] = true
+		defer wg.Done()
+		if err := ingest.settle(m, err); err != nil {
+			ingest.uppLogger.Infof("Unexpected error when caching ingested event: %v\n", err)
+			failed++
+		}
+	}
+
+	if !takesEvents(ingest.forwarder) {
+		for _, m := range msgs {
+			settle(m, errIngestCached)
+		}
+	} else {
+		in := make(chan *message, len(msgs))
+		for _, m := range msgs {
+			in <- m
+		}
+		close(in)
+		// forwarding may block, e.g. while the destination is throttling
+		go func() {
+			b := &batcher{in: in, size: ingest.batchSize, bytes: ingest.batchBytes}
+			for batch := b.next(); len(batch) > 0; batch = b.next() {
+				// the callback may come later, e.g. once HEC has acknowledged the events
+				ingest.forwarder.forward(batch, settle)
+			}
+		}()
+		if !waitUntil(&wg, time.Now().Add(ingest.maxWait)) {
+			for _, m := range msgs {
+				settle(m, errIngestCached)
+			}
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if failed > 0 {
+		writeHecResponse(w, http.StatusServiceUnavailable, hecResponse{Text: "Server is busy", Code: 9})
+		return
+	}
+	writeHecResponse(w, http.StatusOK, hecResponse{Text: "Success", Code: 0})
+}
+
+// settle applies the error policy to an event the destination did not take
+func (ingest *ingestHandler) settle(m *message, err error) error {
+	if err == nil {
+		ingestCounter.WithLabelValues("forwarded").Inc()
+		return nil
+	}
+	switch policyOf(err) {
+	case policyDiscard:
+		ingestCounter.WithLabelValues("discarded").Inc()
+		return nil
+	case policyDeadLetter:
+		if err := ingest.cache.DeadLetter(m.body, err); err != nil {
+			ingestCounter.WithLabelValues("failed").Inc()
+			return err
+		}
+		ingestCounter.WithLabelValues("dead_lettered").Inc()
+		return nil
+	default:
+		// events are cached even when forwarding has stopped, they are retried once it resumes
+		if err := ingest.cache.Put(m.body); err != nil {
+			ingestCounter.WithLabelValues("failed").Inc()
+			return err
+		}
+		ingestCounter.WithLabelValues("cached").Inc()
+		return nil
+	}
+}
+
+// receivedTime is the current epoch time, as expected in the HEC time field
+func (ingest *ingestHandler) receivedTime() string {
+	return hecEpoch(ingest.now())
+}
+
+// hecEpoch formats a time in seconds since the epoch with millisecond precision
+func hecEpoch(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/float64(time.Second), 'f', 3, 64)
+}
+
+func writeHecResponse(w http.ResponseWriter, status int, resp hecResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newIngestTestServer(forwarder Forwarder, cache Cache) *httptest.Server {
+	ingestConfig := config
+	ingestConfig.ingestTokens = []string{"producer-token"}
+	ingest := newIngestHandler(forwarder, cache, ingestConfig)
+	ingest.now = func() time.Time { return time.Unix(1500000000, 250000000) }
+	serveMux := http.NewServeMux()
+	ingest.register(serveMux)
+	return httptest.NewServer(serveMux)
+}
+
+func postIngest(t *testing.T, url string, token string, body []byte, gzipped bool) (int, hecResponse) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	assert.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Splunk "+token)
+	}
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	r, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer r.Body.Close()
+	resp := hecResponse{}
+	json.NewDecoder(r.Body).Decode(&resp)
+	return r.StatusCode, resp
+}
+
+func Test_Ingest_ForwardsEvents(t *testing.T) {
+	forwarder := &slowForwarderMock{}
+	cache := &s3ServiceMock{}
+	server := newIngestTestServer(forwarder, cache)
+	defer server.Close()
+
+	status, resp := postIngest(t, server.URL+ingestEventPath, "producer-token",
+		[]byte(`{"event":"first","time":1400000000}{"event":{"message":"second"},"sourcetype":"app"}`), false)
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 0, resp.Code)
+	assert.Equal(t, []string{
+		`{"event":"first","time":1400000000}`,
+		`{"event":{"message":"second"},"sourcetype":"app","time":1500000000.250}`,
+	}, forwarder.delivered)
+	assert.Empty(t, cache.cache)
+}
+
+func Test_Ingest_Raw(t *testing.T) {
+	forwarder := &slowForwarderMock{}
+	server := newIngestTestServer(forwarder, &s3ServiceMock{})
+	defer server.Close()
+
+	status, _ := postIngest(t, server.URL+ingestRawPath+"?sourcetype=access&index=web", "producer-token",
+		[]byte("GET /one\r\n\nGET /two\n"), false)
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{
+		`{"time":1500000000.250,"sourcetype":"access","index":"web","event":"GET /one"}`,
+		`{"time":1500000000.250,"sourcetype":"access","index":"web","event":"GET /two"}`,
+	}, forwarder.delivered)
+}
+
+func Test_Ingest_Gzip(t *testing.T) {
+	forwarder := &slowForwarderMock{}
+	server := newIngestTestServer(forwarder, &s3ServiceMock{})
+	defer server.Close()
+
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Write([]byte(`{"event":"compressed","time":1}`))
+	w.Close()
+	status, _ := postIngest(t, server.URL+ingestEventPath, "producer-token", buf.Bytes(), true)
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{`{"event":"compressed","time":1}`}, forwarder.delivered)
+}
+
+func Test_Ingest_CachesFailedEvents(t *testing.T) {
+	cache := &s3ServiceMock{}
+	server := newIngestTestServer(&rejectingForwarderMock{err: errors.New("connection refused")}, cache)
+	defer server.Close()
+
+	status, _ := postIngest(t, server.URL+ingestEventPath, "producer-token", []byte(`{"event":"a","time":1}`), false)
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{`{"event":"a","time":1}`}, cache.cache)
+}
+
+func Test_Ingest_DeadLettersRejectedEvents(t *testing.T) {
+	cache := &s3ServiceMock{}
+	server := newIngestTestServer(&rejectingForwarderMock{err: newHecError(400, hecResponse{Code: 7, Text: "Incorrect index"})}, cache)
+	defer server.Close()
+
+	status, _ := postIngest(t, server.URL+ingestEventPath, "producer-token", []byte(`{"event":"a","time":1}`), false)
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, cache.cache)
+	assert.Equal(t, []string{`{"event":"a","time":1}`}, cache.deadLetters)
+}
+
+func Test_Ingest_BusyWhenCachingFails(t *testing.T) {
+	server := newIngestTestServer(&rejectingForwarderMock{err: errors.New("connection refused")}, &failingCacheMock{})
+	defer server.Close()
+
+	status, resp := postIngest(t, server.URL+ingestEventPath, "producer-token", []byte(`{"event":"a"}`), false)
+
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, 9, resp.Code)
+}
+
+func Test_Ingest_Rejections(t *testing.T) {
+	forwarder := &slowForwarderMock{}
+	server := newIngestTestServer(forwarder, &s3ServiceMock{})
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		token  string
+		body   string
+		status int
+		code   int
+	}{
+		{"missing token", "", `{"event":"a"}`, http.StatusUnauthorized, 2},
+		{"invalid token", "other-token", `{"event":"a"}`, http.StatusForbidden, 4},
+		{"no data", "producer-token", " \n", http.StatusBadRequest, 5},
+		{"invalid json", "producer-token", `{"event":"a"}{"event"`, http.StatusBadRequest, 6},
+		{"missing event", "producer-token", `{"event":"a"}{"host":"b"}`, http.StatusBadRequest, 12},
+		{"blank event", "producer-token", `{"event":""}`, http.StatusBadRequest, 13},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, resp := postIngest(t, server.URL+ingestEventPath, test.token, []byte(test.body), false)
+			assert.Equal(t, test.status, status)
+			assert.Equal(t, test.code, resp.Code)
+		})
+	}
+	// a request is rejected as a whole
+	assert.Empty(t, forwarder.delivered)
+
+	_, resp := postIngest(t, server.URL+ingestEventPath, "producer-token", []byte(`{"event":"a"}{"host":"b"}`), false)
+	assert.Equal(t, 1, *resp.InvalidEventNumber)
+}
+
+func Test_Ingest_Health(t *testing.T) {
+	server := newIngestTestServer(&slowForwarderMock{}, &s3ServiceMock{})
+	defer server.Close()
+
+	r, err := http.Get(server.URL + ingestHealthPath)
+	assert.NoError(t, err)
+	defer r.Body.Close()
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+
+	r, err = http.Get(server.URL + ingestEventPath)
+	assert.NoError(t, err)
+	defer r.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, r.StatusCode)
+}
+
+func Test_SplitList(t *testing.T) {
+	assert.Equal(t, []string{"a", "b"}, splitList(" a,, b ,"))
+	assert.Empty(t, splitList(""))
+}
+
+func Test_Ingest_CachesWhileDestinationIsPaused(t *testing.T) {
+	forwarder := &pausedForwarderMock{until: time.Now().Add(time.Minute)}
+	cache := &s3ServiceMock{}
+	server := newIngestTestServer(forwarder, cache)
+	defer server.Close()
+
+	status, _ := postIngest(t, server.URL+ingestEventPath, "producer-token", []byte(`{"event":"a","time":1}`), false)
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{`{"event":"a","time":1}`}, cache.cache, "events should be cached rather than wait for the destination")
+}
+
+func Test_Ingest_CachesAfterLongestWait(t *testing.T) {
+	cache := &s3ServiceMock{}
+	ingestConfig := config
+	ingestConfig.ingestTokens = []string{"producer-token"}
+	ingest := newIngestHandler(&slowForwarderMock{hang: true}, cache, ingestConfig)
+	ingest.maxWait = 100 * time.Millisecond
+	serveMux := http.NewServeMux()
+	ingest.register(serveMux)
+	server := httptest.NewServer(serveMux)
+	defer server.Close()
+
+	start := time.Now()
+	status, _ := postIngest(t, server.URL+ingestEventPath, "producer-token", []byte(`{"event":"a","time":1}`), false)
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, time.Since(start) < time.Second, "the producer should not wait on a destination that does not answer")
+	assert.Equal(t, []string{`{"event":"a","time":1}`}, cache.cache)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+)
+
+// width of the longest bar of the histogram
+const histogramWidth = 50
+
+// inspection summarises the objects cached under a prefix. Payloads are only read from
+// the first objects listed, up to a limit, as reading them all may take a while.
+type inspection struct {
+	objects int
+	bytes   int64
+	oldest  time.Time
+	newest  time.Time
+	// objects and bytes by the hour they were cached in
+	hourObjects map[time.Time]int
+	hourBytes   map[time.Time]int64
+	// objects and events whose payloads have been read
+	read        int
+	events      int
+	samples     []string
+	sourcetypes map[string]int
+	indexes     map[string]int
+	// in-flight objects are leased, and claimed again once their lease has expired
+	inFlight bool
+	expired  int
+}
+
+// inspectCommand reports on the objects cached under a prefix, and on those in flight under
+// its in-flight prefix, without deleting anything. The S3 options are those of the service.
+func inspectCommand(cmd *cli.Cmd, baseConfig func() appConfig) {
+	prefix := cmd.String(cli.StringOpt{
+		Name:  "prefix",
+		Value: "",
+		Desc:  "Prefix of the objects to inspect, e.g. <env>-dlq or <env>-quarantine, defaults to --env. Objects in flight under <prefix>-inflight are reported separately",
+	})
+	samples := cmd.Int(cli.IntOpt{
+		Name:  "samples",
+		Value: 5,
+		Desc:  "Number of payloads printed as a sample",
+	})
+	top := cmd.Int(cli.IntOpt{
+		Name:  "top",
+		Value: 10,
+		Desc:  "Number of most frequent sourcetypes and indexes printed",
+	})
+	readObjects := cmd.Int(cli.IntOpt{
+		Name:  "read-objects",
+		Value: 1000,
+		Desc:  "Number of objects whose payloads are read for the sample and the sourcetypes and indexes, 0 to read them all",
+	})
+
+	cmd.Action = func() {
+		config := baseConfig()
+		if *prefix == "" {
+			*prefix = config.env
+		}
+		if *samples < 0 || *top < 0 || *readObjects < 0 {
+			config.UPPLogger.Fatal("--samples, --top and --read-objects must not be negative")
+		}
+		s, err := newS3Service(*prefix, config)
+		if err != nil {
+			config.UPPLogger.Fatal(err)
+		}
+		cached, inFlight, err := inspect(s, *samples, *readObjects, time.Now())
+		if err != nil {
+			config.UPPLogger.Fatal(err)
+		}
+		cached.report(os.Stdout, *prefix, *top)
+		fmt.Fprintln(os.Stdout)
+		inFlight.report(os.Stdout, *prefix+inFlightSuffix, *top)
+	}
+}
+
+// inspect lists the objects cached under the prefix and those in flight, reading the
+// payloads of the first ones of each
+func inspect(s *s3Service, samples int, readObjects int, now time.Time) (*inspection, *inspection, error) {
+	cached := newInspection()
+	err := s.scan(func(key string, size int64, at time.Time) error {
+		return cached.addObject(s, key, size, at, samples, readObjects)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	inFlight := newInspection()
+	inFlight.inFlight = true
+	err = s.scanInFlight(func(key string, size int64, at time.Time, expiry time.Time) error {
+		if !expiry.After(now) {
+			inFlight.expired++
+		}
+		return inFlight.addObject(s, key, size, at, samples, readObjects)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return cached, inFlight, nil
+}
+
+func newInspection() *inspection {
+	return &inspection{
+		hourObjects: map[time.Time]int{},
+		hourBytes:   map[time.Time]int64{},
+		sourcetypes: map[string]int{},
+		indexes:     map[string]int{},
+	}
+}
+
+// addObject counts an object cached at the given time, and reads its payload unless
+// enough objects have been read already
+func (i *inspection) addObject(s *s3Service, key string, size int64, cached time.Time, samples int, readObjects int) error {
+	i.objects++
+	i.bytes += size
+	if i.oldest.IsZero() || cached.Before(i.oldest) {
+		i.oldest = cached
+	}
+	if cached.After(i.newest) {
+		i.newest = cached
+	}
+	hour := cached.UTC().Truncate(time.Hour)
+	i.hourObjects[hour]++
+	i.hourBytes[hour] += size
+
+	if readObjects > 0 && i.read >= readObjects {
+		return nil
+	}
+	msgs, err := s.get(key)
+	if err != nil {
+		if isNoSuchKey(err) {
+			// claimed, or delivered, in the meantime
+			return nil
+		}
+		return fmt.Errorf("failed to read %v: %v", key, err)
+	}
+	i.read++
+	for _, m := range msgs {
+		i.add(m.body, samples)
+	}
+	return nil
+}
+
+// add counts the sourcetype and index of an event, when it is a HEC event
+func (i *inspection) add(body string, samples int) {
+	i.events++
+	if len(i.samples) < samples {
+		i.samples = append(i.samples, body)
+	}
+	envelope := struct {
+		Event      json.RawMessage `json:"event"`
+		Sourcetype string          `json:"sourcetype"`
+		Index      string          `json:"index"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &envelope); err != nil || envelope.Event == nil {
+		return
+	}
+	i.sourcetypes[orNone(envelope.Sourcetype)]++
+	i.indexes[orNone(envelope.Index)]++
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "(none)"
+	}
+	return value
+}
+
+func (i *inspection) report(w io.Writer, prefix string, top int) {
+	fmt.Fprintf(w, "Objects under %v/: %v (%v bytes)\n", prefix, i.objects, i.bytes)
+	if i.objects == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Oldest: %v\n", i.oldest.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "Newest: %v\n", i.newest.UTC().Format(time.RFC3339))
+	if i.inFlight {
+		fmt.Fprintf(w, "Expired leases: %v, claimed again by the next replica reaping them\n", i.expired)
+	}
+
+	fmt.Fprintf(w, "\nObjects by hour:\n")
+	hours := []time.Time{}
+	most := 0
+	for hour, n := range i.hourObjects {
+		hours = append(hours, hour)
+		if n > most {
+			most = n
+		}
+	}
+	sort.Slice(hours, func(a, b int) bool { return hours[a].Before(hours[b]) })
+	for _, hour := range hours {
+		n := i.hourObjects[hour]
+		bar := strings.Repeat("#", (n*histogramWidth+most-1)/most)
+		fmt.Fprintf(w, "  %v  %8d objects %12d bytes  %v\n", hour.Format("2006-01-02T15:04Z"), n, i.hourBytes[hour], bar)
+	}
+
+	fmt.Fprintf(w, "\nPayloads read from %v objects: %v events\n", i.read, i.events)
+	writeTop(w, "sourcetypes", i.sourcetypes, top)
+	writeTop(w, "indexes", i.indexes, top)
+	if len(i.samples) > 0 {
+		fmt.Fprintf(w, "\nSample payloads:\n")
+		for _, sample := range i.samples {
+			fmt.Fprintf(w, "  %v\n", sample)
+		}
+	}
+}
+
+// writeTop writes the most frequent values first, alphabetically for the same count
+func writeTop(w io.Writer, name string, counts map[string]int, top int) {
+	if len(counts) == 0 || top == 0 {
+		return
+	}
+	values := []string{}
+	for value := range counts {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(a, b int) bool {
+		if counts[values[a]] != counts[values[b]] {
+			return counts[values[a]] > counts[values[b]]
+		}
+		return values[a] < values[b]
+	})
+	if len(values) > top {
+		values = values[:top]
+	}
+	fmt.Fprintf(w, "\nTop %v:\n", name)
+	for _, value := range values {
+		fmt.Fprintf(w, "  %8d  %v\n", counts[value], value)
+	}
+}
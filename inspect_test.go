@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Inspect(t *testing.T) {
+	s3InterfaceMock := newMemoryS3Interface()
+	start := time.Date(2020, 3, 1, 10, 15, 0, 0, time.UTC)
+	cacheAt(s3InterfaceMock, "test-prefix/03/%v_first", start, `{"event":"a","sourcetype":"access","index":"main"}`)
+	cacheAt(s3InterfaceMock, "test-prefix/0a/%v_packed"+packedSuffix, start.Add(time.Minute),
+		`{"event":"b","sourcetype":"access","index":"audit"}`+"\n"+`{"event":"c","index":"main"}`+"\n")
+	cacheAt(s3InterfaceMock, "test-prefix/%v_legacy", start.Add(2*time.Hour), "plain")
+	cacheAt(s3InterfaceMock, "test-prefix-dlq/%v_rejected", start, "rejected")
+	now := start.Add(3 * time.Hour)
+	cacheAt(s3InterfaceMock, fmt.Sprintf("test-prefix-inflight/%v_%%v_leased", now.Add(time.Minute).UnixNano()), start.Add(time.Hour), `{"event":"d","index":"main"}`)
+	cacheAt(s3InterfaceMock, fmt.Sprintf("test-prefix-inflight/%v_%%v_expired", now.Add(-time.Minute).UnixNano()), start, "expired")
+	before := s3InterfaceMock.keys()
+
+	i, inFlight, err := inspect(newReplayMock(s3InterfaceMock), 2, 0, now)
+	assert.NoError(t, err)
+	assert.Equal(t, before, s3InterfaceMock.keys(), "nothing should be deleted")
+
+	assert.Equal(t, 3, i.objects)
+	assert.True(t, start.Equal(i.oldest))
+	assert.True(t, start.Add(2*time.Hour).Equal(i.newest))
+	assert.Equal(t, map[time.Time]int{
+		time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC): 2,
+		time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC): 1,
+	}, i.hourObjects)
+	assert.Equal(t, 4, i.events)
+	assert.Len(t, i.samples, 2)
+	assert.Equal(t, map[string]int{"access": 2, "(none)": 1}, i.sourcetypes)
+	assert.Equal(t, map[string]int{"main": 2, "audit": 1}, i.indexes)
+
+	out := &bytes.Buffer{}
+	i.report(out, "test-prefix", 1)
+	assert.Contains(t, out.String(), "Objects under test-prefix/: 3")
+	assert.Contains(t, out.String(), "Oldest: 2020-03-01T10:15:00Z")
+	assert.Contains(t, out.String(), "2020-03-01T12:00Z")
+	assert.Contains(t, out.String(), "       2  main")
+	assert.NotContains(t, out.String(), "       1  audit", "only the top index should be reported")
+	assert.NotContains(t, out.String(), "Expired leases")
+
+	assert.Equal(t, 2, inFlight.objects)
+	assert.Equal(t, 1, inFlight.expired)
+	assert.True(t, start.Equal(inFlight.oldest), "in-flight objects should be dated by the time they were cached")
+	assert.True(t, start.Add(time.Hour).Equal(inFlight.newest))
+	assert.Equal(t, 2, inFlight.events)
+	assert.Equal(t, map[string]int{"main": 1}, inFlight.indexes)
+
+	out.Reset()
+	inFlight.report(out, "test-prefix-inflight", 1)
+	assert.Contains(t, out.String(), "Objects under test-prefix-inflight/: 2")
+	assert.Contains(t, out.String(), "Expired leases: 1")
+}
+
+func Test_Inspect_ReadObjects(t *testing.T) {
+	s3InterfaceMock := newMemoryS3Interface()
+	start := time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)
+	for n := 0; n < 5; n++ {
+		cacheAt(s3InterfaceMock, "test-prefix/%v_event", start.Add(time.Duration(n)*time.Second), "event")
+	}
+
+	i, _, err := inspect(newReplayMock(s3InterfaceMock), 10, 2, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 5, i.objects)
+	assert.Equal(t, 2, i.read)
+	assert.Len(t, i.samples, 2)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// how long to wait before joining the consumer group again after an error
+const kafkaRetryDelay = 5 * time.Second
+
+var kafkaCounter *prometheus.CounterVec
+
+// kafkaInterface is the part of the sarama consumer group used by the consumer, so that
+// it can be replaced in tests
+type kafkaInterface interface {
+	Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error
+	Errors() <-chan error
+	Close() error
+}
+
+// kafkaConsumer consumes events from Kafka topics as a member of a consumer group, so that
+// replicas share the partitions. The offset of a message is only committed once the message,
+// and those before it in the partition, have been delivered or cached.
+type kafkaConsumer struct {
+	sync.Mutex
+	group  kafkaInterface
+	topics []string
+	input  LogInput
+	// time to wait for the messages in flight when partitions are released, and the
+	// deadline of the shutdown once stopping
+	drainTimeout time.Duration
+	stopDeadline time.Time
+	uppLogger    *logger.UPPLogger
+	cancel       context.CancelFunc
+	consumeWg    sync.WaitGroup
+	errorsWg     sync.WaitGroup
+	latestError  error
+}
+
+// kafkaEnvelope is the HEC event wrapping a Kafka message that is not a HEC event already
+type kafkaEnvelope struct {
+	Time   json.Number     `json:"time,omitempty"`
+	Source string          `json:"source"`
+	Event  json.RawMessage `json:"event"`
+}
+
+var NewKafkaConsumer = func(input LogInput, config appConfig) (*kafkaConsumer, error) {
+	kafkaConfig := sarama.NewConfig()
+	kafkaConfig.ClientID = config.appSystemCode
+	// consumer groups need at least 0.10.2
+	kafkaConfig.Version = sarama.V1_0_0_0
+	kafkaConfig.Consumer.Return.Errors = true
+	// a new group starts from the oldest message so that nothing is skipped
+	kafkaConfig.Consumer.Offsets.Initial = sarama.OffsetOldest
+	group, err := sarama.NewConsumerGroup(config.kafkaBrokers, config.kafkaGroup, kafkaConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create Kafka consumer group: %v", err)
+	}
+	return newKafkaConsumer(group, input, config), nil
+}
+
+func newKafkaConsumer(group kafkaInterface, input LogInput, config appConfig) *kafkaConsumer {
+	if kafkaCounter == nil {
+		kafkaCounter = registerCounterVec("kafka_consumed_count", "Number of messages consumed from Kafka by topic", "topic")
+	}
+	return &kafkaConsumer{
+		group:        group,
+		topics:       config.kafkaTopics,
+		input:        input,
+		drainTimeout: config.gracePeriod,
+		uppLogger:    config.UPPLogger,
+	}
+}
+
+func (consumer *kafkaConsumer) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer.cancel = cancel
+
+	consumer.errorsWg.Add(1)
+	go func() {
+		defer consumer.errorsWg.Done()
+		for err := range consumer.group.Errors() {
+			consumer.uppLogger.Errorf("Kafka consumer error: %v\n", err)
+			consumer.setHealth(err)
+		}
+	}()
+	consumer.consumeWg.Add(1)
+	go func() {
+		defer consumer.consumeWg.Done()
+		// a session ends on every rebalance, join the group again until stopped
+		for ctx.Err() == nil {
+			if err := consumer.group.Consume(ctx, consumer.topics, consumer); err != nil {
+				consumer.uppLogger.Errorf("Failed to consume from Kafka: %v\n", err)
+				consumer.setHealth(err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(kafkaRetryDelay):
+				}
+			}
+		}
+	}()
+}
+
+// stop leaves the consumer group once the messages in flight have been settled, or the
+// deadline has passed. Unsettled messages are consumed again by the next owner of their
+// partition.
+func (consumer *kafkaConsumer) stop(deadline time.Time) {
+	consumer.Lock()
+	consumer.stopDeadline = deadline
+	consumer.Unlock()
+	consumer.cancel()
+	consumer.consumeWg.Wait()
+	if err := consumer.group.Close(); err != nil {
+		consumer.uppLogger.Errorf("Failed to close Kafka consumer group: %v\n", err)
+	}
+	consumer.errorsWg.Wait()
+}
+
+func (consumer *kafkaConsumer) Setup(session sarama.ConsumerGroupSession) error {
+	consumer.uppLogger.Infof("Consuming Kafka partitions %v\n", session.Claims())
+	consumer.setHealth(nil)
+	return nil
+}
+
+func (consumer *kafkaConsumer) Cleanup(session sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim submits the messages of a partition, and marks their offsets once they
+// are done, in partition order
+func (consumer *kafkaConsumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	offsets := newOffsetQueue(claim.InitialOffset())
+	for msg := range claim.Messages() {
+		kafkaCounter.WithLabelValues(msg.Topic).Inc()
+		r := offsets.track(msg.Offset + 1)
+		consumer.input.Submit(&message{body: kafkaEvent(msg), done: func() {
+			// the offset to commit is that of the next message to read
+			if next, moved := offsets.done(r); moved {
+				session.MarkOffset(claim.Topic(), claim.Partition(), next, "")
+			}
+		}})
+	}
+	// the offsets marked before the session ends are committed
+	deadline := time.Now().Add(consumer.drainTimeout)
+	consumer.Lock()
+	if !consumer.stopDeadline.IsZero() && consumer.stopDeadline.Before(deadline) {
+		deadline = consumer.stopDeadline
+	}
+	consumer.Unlock()
+	for offsets.pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(sleepTime * time.Millisecond)
+	}
+	return nil
+}
+
+func (consumer *kafkaConsumer) getHealth() error {
+	consumer.Lock()
+	defer consumer.Unlock()
+	return consumer.latestError
+}
+
+func (consumer *kafkaConsumer) setHealth(err error) {
+	consumer.Lock()
+	defer consumer.Unlock()
+	consumer.latestError = err
+}
+
+// kafkaEvent passes HEC events on as they are, and wraps anything else into a HEC event
+// stamped with the time of the Kafka message
+func kafkaEvent(msg *sarama.ConsumerMessage) string {
+	envelope := map[string]json.RawMessage{}
+	if err := json.Unmarshal(msg.Value, &envelope); err == nil {
+		if _, ok := envelope["event"]; ok {
+			return string(msg.Value)
+		}
+	}
+	event := json.RawMessage(msg.Value)
+	if !json.Valid(msg.Value) {
+		event, _ = json.Marshal(string(msg.Value))
+	}
+	wrapped := kafkaEnvelope{Source: "kafka:" + msg.Topic, Event: event}
+	if !msg.Timestamp.IsZero() {
+		wrapped.Time = json.Number(hecEpoch(msg.Timestamp))
+	}
+	buf, _ := json.Marshal(wrapped)
+	return string(buf)
+}
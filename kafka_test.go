@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockKafkaGroup runs a single session over the given partitions, each one a claim
+type mockKafkaGroup struct {
+	claims  []*mockKafkaClaim
+	session *mockKafkaSession
+	errors  chan error
+	// closed once the session has been set up
+	started chan struct{}
+}
+
+type mockKafkaSession struct {
+	sarama.ConsumerGroupSession
+	sync.Mutex
+	marked map[int32]int64
+}
+
+type mockKafkaClaim struct {
+	sarama.ConsumerGroupClaim
+	partition int32
+	messages  chan *sarama.ConsumerMessage
+}
+
+func newMockKafkaGroup(partitions ...[]string) *mockKafkaGroup {
+	group := &mockKafkaGroup{
+		session: &mockKafkaSession{marked: map[int32]int64{}},
+		errors:  make(chan error),
+		started: make(chan struct{}),
+	}
+	for p, values := range partitions {
+		claim := &mockKafkaClaim{partition: int32(p), messages: make(chan *sarama.ConsumerMessage, len(values))}
+		for offset, value := range values {
+			claim.messages <- &sarama.ConsumerMessage{Topic: "logs", Partition: int32(p), Offset: int64(offset), Value: []byte(value)}
+		}
+		group.claims = append(group.claims, claim)
+	}
+	return group
+}
+
+func (group *mockKafkaGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	handler.Setup(group.session)
+	close(group.started)
+	wg := sync.WaitGroup{}
+	for _, claim := range group.claims {
+		wg.Add(1)
+		go func(claim *mockKafkaClaim) {
+			defer wg.Done()
+			handler.ConsumeClaim(group.session, claim)
+		}(claim)
+	}
+	// the partitions are released when the context is cancelled
+	<-ctx.Done()
+	for _, claim := range group.claims {
+		close(claim.messages)
+	}
+	wg.Wait()
+	return handler.Cleanup(group.session)
+}
+
+func (group *mockKafkaGroup) Errors() <-chan error {
+	return group.errors
+}
+
+func (group *mockKafkaGroup) Close() error {
+	close(group.errors)
+	return nil
+}
+
+func (session *mockKafkaSession) Claims() map[string][]int32 {
+	return map[string][]int32{"logs": {0}}
+}
+
+func (session *mockKafkaSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	session.Lock()
+	defer session.Unlock()
+	session.marked[partition] = offset
+}
+
+func (session *mockKafkaSession) getMarked() map[int32]int64 {
+	session.Lock()
+	defer session.Unlock()
+	marked := map[int32]int64{}
+	for p, o := range session.marked {
+		marked[p] = o
+	}
+	return marked
+}
+
+func (claim *mockKafkaClaim) Topic() string {
+	return "logs"
+}
+
+func (claim *mockKafkaClaim) Partition() int32 {
+	return claim.partition
+}
+
+func (claim *mockKafkaClaim) InitialOffset() int64 {
+	return 0
+}
+
+func (claim *mockKafkaClaim) Messages() <-chan *sarama.ConsumerMessage {
+	return claim.messages
+}
+
+// lockedInputMock is a settlingInputMock that can be submitted to concurrently
+type lockedInputMock struct {
+	sync.Mutex
+	settlingInputMock
+}
+
+func (input *lockedInputMock) Submit(m *message) {
+	input.Lock()
+	defer input.Unlock()
+	input.settlingInputMock.Submit(m)
+}
+
+func (input *lockedInputMock) find(body string) *message {
+	input.Lock()
+	defer input.Unlock()
+	for _, m := range input.messages {
+		if m.body == body {
+			return m
+		}
+	}
+	return nil
+}
+
+func (input *lockedInputMock) count() int {
+	input.Lock()
+	defer input.Unlock()
+	return len(input.messages)
+}
+
+func Test_Kafka_CommitsAfterDelivery(t *testing.T) {
+	a := `{"event":"a"}`
+	b := `{"event":"b"}`
+	c := `{"event":"c"}`
+	group := newMockKafkaGroup([]string{a, b}, []string{c})
+	input := &lockedInputMock{}
+	kafkaConfig := config
+	kafkaConfig.kafkaTopics = []string{"logs"}
+	kafkaConfig.gracePeriod = 0
+	consumer := newKafkaConsumer(group, input, kafkaConfig)
+	consumer.start()
+	defer consumer.stop(time.Now())
+
+	assert.True(t, eventually(func() bool { return input.count() == 3 }, time.Second))
+	assert.Empty(t, group.session.getMarked())
+
+	// offsets are committed in partition order
+	input.find(b).done()
+	assert.Empty(t, group.session.getMarked())
+	input.find(a).done()
+	assert.Equal(t, map[int32]int64{0: 2}, group.session.getMarked())
+	input.find(c).done()
+	assert.Equal(t, map[int32]int64{0: 2, 1: 1}, group.session.getMarked())
+}
+
+func Test_Kafka_WaitsForMessagesInFlightOnStop(t *testing.T) {
+	group := newMockKafkaGroup([]string{`{"event":"a"}`})
+	input := &lockedInputMock{}
+	kafkaConfig := config
+	kafkaConfig.kafkaTopics = []string{"logs"}
+	kafkaConfig.gracePeriod = 2 * time.Second
+	consumer := newKafkaConsumer(group, input, kafkaConfig)
+	consumer.start()
+	assert.True(t, eventually(func() bool { return input.count() == 1 }, time.Second))
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		input.find(`{"event":"a"}`).done()
+	}()
+	consumer.stop(time.Now().Add(kafkaConfig.gracePeriod))
+	assert.Equal(t, map[int32]int64{0: 1}, group.session.getMarked())
+}
+
+func Test_Kafka_Health(t *testing.T) {
+	group := newMockKafkaGroup()
+	consumer := newKafkaConsumer(group, &lockedInputMock{}, config)
+	consumer.start()
+	defer consumer.stop(time.Now())
+	<-group.started
+
+	group.errors <- errors.New("broker unavailable")
+	assert.True(t, eventually(func() bool { return consumer.getHealth() != nil }, time.Second))
+}
+
+func Test_KafkaEvent(t *testing.T) {
+	hec := `{"event":"already an event","sourcetype":"app"}`
+	assert.Equal(t, hec, kafkaEvent(&sarama.ConsumerMessage{Topic: "logs", Value: []byte(hec)}))
+
+	timestamp := time.Unix(1500000000, 0)
+	envelope := map[string]interface{}{}
+	json.Unmarshal([]byte(kafkaEvent(&sarama.ConsumerMessage{Topic: "logs", Value: []byte(`{"message":"json"}`), Timestamp: timestamp})), &envelope)
+	assert.Equal(t, map[string]interface{}{"time": 1500000000.0, "source": "kafka:logs", "event": map[string]interface{}{"message": "json"}}, envelope)
+
+	envelope = map[string]interface{}{}
+	json.Unmarshal([]byte(kafkaEvent(&sarama.ConsumerMessage{Topic: "logs", Value: []byte("plain text")})), &envelope)
+	assert.Equal(t, map[string]interface{}{"source": "kafka:logs", "event": "plain text"}, envelope)
+}
+
+func Test_ValidateParamsKafka(t *testing.T) {
+	kafkaConfig := config
+	kafkaConfig.kafkaBrokers = []string{"localhost:9092"}
+	assert.Error(t, validateParams(kafkaConfig))
+
+	kafkaConfig.kafkaTopics = []string{"logs"}
+	assert.NoError(t, validateParams(kafkaConfig))
+}
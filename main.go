@@ -1,11 +1,15 @@
 package main
 
 import (
+	"compress/gzip"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -32,17 +36,72 @@ var (
 )
 
 type appConfig struct {
-	appSystemCode string
-	appName       string
-	port          string
-	fwdURL        string
-	env           string
-	workers       int
-	chanBuffer    int
-	token         string
-	bucket        string
-	awsRegion     string
-	UPPLogger     *logger.UPPLogger
+	appSystemCode   string
+	appName         string
+	port            string
+	fwdURL          string
+	sink            string
+	index           string
+	destinations    []destinationConfig
+	env             string
+	workers         int
+	minWorkers      int
+	maxWorkers      int
+	latencyTarget   time.Duration
+	requestTimeout  time.Duration
+	chanBuffer      int
+	batchSize       int
+	batchBytes      int
+	batchInterval   time.Duration
+	token           string
+	gzip            bool
+	gzipLevel       int
+	gzipMinSize     int
+	ack             bool
+	ackTimeout      time.Duration
+	ackPollInterval time.Duration
+	bucket          string
+	leaseTimeout    time.Duration
+	// events cached together are packed into a single object
+	cacheBatchSize     int
+	cacheBatchBytes    int
+	cacheBatchInterval time.Duration
+	cacheGzip          bool
+	listPageSize       int64
+	claimWorkers       int
+	shards             int
+	maxAttempts        int
+	maxEventAge        time.Duration
+	breakerFailureRate int
+	breakerMinEvents   int
+	breakerWindow      time.Duration
+	breakerOpenTime    time.Duration
+	breakerProbes      int
+	rateLimitEvents    int
+	rateLimitBytes     int
+	rateLimitMaxWait   time.Duration
+	indexRateLimits    []string
+	gracePeriod        time.Duration
+	awsRegion          string
+	sqsQueueURL        string
+	sqsListInterval    time.Duration
+	spoolDir           string
+	spoolMaxBytes      int64
+	spoolOverflow      string
+	ingestTokens       []string
+	syslogUDP          string
+	syslogTCP          string
+	syslogTLS          string
+	syslogTLSCert      string
+	syslogTLSKey       string
+	tailPaths          []string
+	tailStateFile      string
+	tailMultiline      string
+	tailSourcetype     string
+	kafkaBrokers       []string
+	kafkaTopics        []string
+	kafkaGroup         string
+	UPPLogger          *logger.UPPLogger
 }
 
 func main() {
@@ -82,6 +141,24 @@ func initApp() *cli.Cli {
 		Desc:   "The url to forward to",
 		EnvVar: "FORWARD_URL",
 	})
+	sinkName := app.String(cli.StringOpt{
+		Name:   "sink",
+		Value:  defaultSink,
+		Desc:   "Kind of destination to forward to (splunk, elasticsearch, http)",
+		EnvVar: "SINK",
+	})
+	index := app.String(cli.StringOpt{
+		Name:   "index",
+		Value:  "logs",
+		Desc:   "Default index for the elasticsearch sink",
+		EnvVar: "INDEX",
+	})
+	destinationNames := app.String(cli.StringOpt{
+		Name:   "destinations",
+		Value:  "",
+		Desc:   "Comma separated names of the destinations to fan out to, instead of the single url (each read from $DESTINATION_<NAME>_SINK, _URL and _TOKEN)",
+		EnvVar: "DESTINATIONS",
+	})
 	env := app.String(cli.StringOpt{
 		Name:   "env",
 		Value:  "dummy",
@@ -91,33 +168,340 @@ func initApp() *cli.Cli {
 	workers := app.Int(cli.IntOpt{
 		Name:   "workers",
 		Value:  8,
-		Desc:   "Number of concurrent workers",
+		Desc:   "Number of concurrent workers, or initial number of requests sent at once when --max-workers is set",
 		EnvVar: "WORKERS",
 	})
+	minWorkers := app.Int(cli.IntOpt{
+		Name:   "min-workers",
+		Value:  1,
+		Desc:   "Number of requests sent at once that the concurrency limit does not shrink below",
+		EnvVar: "MIN_WORKERS",
+	})
+	maxWorkers := app.Int(cli.IntOpt{
+		Name:   "max-workers",
+		Value:  0,
+		Desc:   "Number of requests sent at once that the concurrency limit does not grow beyond, 0 to keep --workers fixed",
+		EnvVar: "MAX_WORKERS",
+	})
+	workerLatencyTarget := app.Int(cli.IntOpt{
+		Name:   "worker-latency-target",
+		Value:  1000,
+		Desc:   "Time in milliseconds above which requests are considered slow and shrink the concurrency limit",
+		EnvVar: "WORKER_LATENCY_TARGET",
+	})
+	requestTimeout := app.Int(cli.IntOpt{
+		Name:   "request-timeout",
+		Value:  30,
+		Desc:   "Time in seconds to wait for the destination to answer a request, 0 to wait indefinitely",
+		EnvVar: "REQUEST_TIMEOUT",
+	})
 	chanBuffer := app.Int(cli.IntOpt{
 		Name:   "buffer",
 		Value:  256,
 		Desc:   "Channel buffer size",
 		EnvVar: "CHAN_BUFFER",
 	})
+	batchSize := app.Int(cli.IntOpt{
+		Name:   "batch-size",
+		Value:  100,
+		Desc:   "Maximum number of events sent in a single HEC request",
+		EnvVar: "BATCH_SIZE",
+	})
+	batchBytes := app.Int(cli.IntOpt{
+		Name:   "batch-bytes",
+		Value:  1048576,
+		Desc:   "Maximum size in bytes of a single HEC request body",
+		EnvVar: "BATCH_BYTES",
+	})
+	batchInterval := app.Int(cli.IntOpt{
+		Name:   "batch-interval",
+		Value:  500,
+		Desc:   "Maximum time in milliseconds to wait for a batch to fill up",
+		EnvVar: "BATCH_INTERVAL",
+	})
 	token := app.String(cli.StringOpt{
 		Name:   "token",
 		Value:  "",
 		Desc:   "Splunk HEC Authorization token",
 		EnvVar: "TOKEN",
 	})
+	gzipEnabled := app.Bool(cli.BoolOpt{
+		Name:   "gzip",
+		Value:  false,
+		Desc:   "Compress HEC request bodies with gzip",
+		EnvVar: "GZIP",
+	})
+	gzipLevel := app.Int(cli.IntOpt{
+		Name:   "gzip-level",
+		Value:  gzip.DefaultCompression,
+		Desc:   "Gzip compression level, from 1 (best speed) to 9 (best compression), -1 for the default level",
+		EnvVar: "GZIP_LEVEL",
+	})
+	gzipMinSize := app.Int(cli.IntOpt{
+		Name:   "gzip-min-size",
+		Value:  1024,
+		Desc:   "Minimum size in bytes of a HEC request body to be compressed",
+		EnvVar: "GZIP_MIN_SIZE",
+	})
+	ack := app.Bool(cli.BoolOpt{
+		Name:   "ack",
+		Value:  false,
+		Desc:   "Wait for HEC indexer acknowledgement before considering events delivered",
+		EnvVar: "ACK",
+	})
+	ackTimeout := app.Int(cli.IntOpt{
+		Name:   "ack-timeout",
+		Value:  120,
+		Desc:   "Time in seconds to wait for an indexer acknowledgement before re-caching the events",
+		EnvVar: "ACK_TIMEOUT",
+	})
+	ackPollInterval := app.Int(cli.IntOpt{
+		Name:   "ack-poll-interval",
+		Value:  1000,
+		Desc:   "Time in milliseconds between polls of the HEC ack endpoint",
+		EnvVar: "ACK_POLL_INTERVAL",
+	})
 	bucket := app.String(cli.StringOpt{
 		Name:   "bucketName",
 		Value:  "",
 		Desc:   "S3 bucket for caching failed events",
 		EnvVar: "BUCKET_NAME",
 	})
+	leaseTimeout := app.Int(cli.IntOpt{
+		Name:   "lease-timeout",
+		Value:  600,
+		Desc:   "Time in seconds after which messages read from S3 but not delivered become visible again",
+		EnvVar: "LEASE_TIMEOUT",
+	})
+	cacheBatchSize := app.Int(cli.IntOpt{
+		Name:   "cache-batch-size",
+		Value:  500,
+		Desc:   "Maximum number of events packed into a single S3 object, 1 to store each event in its own object",
+		EnvVar: "CACHE_BATCH_SIZE",
+	})
+	cacheBatchBytes := app.Int(cli.IntOpt{
+		Name:   "cache-batch-bytes",
+		Value:  5 * 1024 * 1024,
+		Desc:   "Maximum size in bytes of the events packed into a single S3 object",
+		EnvVar: "CACHE_BATCH_BYTES",
+	})
+	cacheBatchInterval := app.Int(cli.IntOpt{
+		Name:   "cache-batch-interval",
+		Value:  1000,
+		Desc:   "Maximum time in milliseconds to wait for events to pack into a single S3 object",
+		EnvVar: "CACHE_BATCH_INTERVAL",
+	})
+	cacheGzip := app.Bool(cli.BoolOpt{
+		Name:   "cache-gzip",
+		Value:  false,
+		Desc:   "Compress the S3 objects holding several events with gzip",
+		EnvVar: "CACHE_GZIP",
+	})
+	listPageSize := app.Int(cli.IntOpt{
+		Name:   "list-page-size",
+		Value:  100,
+		Desc:   "Number of cached objects listed from S3 at once, at most 1000",
+		EnvVar: "LIST_PAGE_SIZE",
+	})
+	claimWorkers := app.Int(cli.IntOpt{
+		Name:   "claim-workers",
+		Value:  8,
+		Desc:   "Number of cached objects claimed from S3 concurrently",
+		EnvVar: "CLAIM_WORKERS",
+	})
+	shards := app.Int(cli.IntOpt{
+		Name:   "shards",
+		Value:  1,
+		Desc:   "Number of shards the cache is split into, so that each replica claims its own share of them, 1 to disable sharding",
+		EnvVar: "SHARDS",
+	})
+	maxAttempts := app.Int(cli.IntOpt{
+		Name:   "max-attempts",
+		Value:  10,
+		Desc:   "Number of failed attempts after which an event is moved to the quarantine prefix, 0 to retry forever",
+		EnvVar: "MAX_ATTEMPTS",
+	})
+	maxEventAge := app.Int(cli.IntOpt{
+		Name:   "max-event-age",
+		Value:  72,
+		Desc:   "Time in hours after its first failure after which an event is moved to the quarantine prefix, 0 to retry forever",
+		EnvVar: "MAX_EVENT_AGE",
+	})
+	breakerFailureRate := app.Int(cli.IntOpt{
+		Name:   "breaker-failure-rate",
+		Value:  50,
+		Desc:   "Percentage of failed events over the breaker window that opens the circuit to the destination, 0 to disable the circuit breaker",
+		EnvVar: "BREAKER_FAILURE_RATE",
+	})
+	breakerMinEvents := app.Int(cli.IntOpt{
+		Name:   "breaker-min-events",
+		Value:  20,
+		Desc:   "Number of events sent over the breaker window below which the circuit stays closed",
+		EnvVar: "BREAKER_MIN_EVENTS",
+	})
+	breakerWindow := app.Int(cli.IntOpt{
+		Name:   "breaker-window",
+		Value:  30,
+		Desc:   "Time in seconds over which failed events are counted by the circuit breaker",
+		EnvVar: "BREAKER_WINDOW",
+	})
+	breakerOpenTime := app.Int(cli.IntOpt{
+		Name:   "breaker-open-time",
+		Value:  30,
+		Desc:   "Time in seconds the circuit stays open before probe requests are sent to the destination",
+		EnvVar: "BREAKER_OPEN_TIME",
+	})
+	breakerProbes := app.Int(cli.IntOpt{
+		Name:   "breaker-probes",
+		Value:  3,
+		Desc:   "Number of successful probe requests, sent one at a time, that close the circuit again",
+		EnvVar: "BREAKER_PROBES",
+	})
+	rateLimitEvents := app.Int(cli.IntOpt{
+		Name:   "rate-limit-events",
+		Value:  0,
+		Desc:   "Number of events per second sent to the destination at most, 0 for no limit",
+		EnvVar: "RATE_LIMIT_EVENTS",
+	})
+	rateLimitBytes := app.Int(cli.IntOpt{
+		Name:   "rate-limit-bytes",
+		Value:  0,
+		Desc:   "Number of bytes of events per second sent to the destination at most, 0 for no limit",
+		EnvVar: "RATE_LIMIT_BYTES",
+	})
+	indexRateLimits := app.String(cli.StringOpt{
+		Name:   "index-rate-limits",
+		Value:  "",
+		Desc:   "Comma-separated limits of events and bytes per second sent to the destination by index, e.g. main=500:1048576, 0 for no limit",
+		EnvVar: "INDEX_RATE_LIMITS",
+	})
+	rateLimitMaxWait := app.Int(cli.IntOpt{
+		Name:   "rate-limit-max-wait",
+		Value:  10,
+		Desc:   "Time in seconds events wait for the rate limits before being cached again",
+		EnvVar: "RATE_LIMIT_MAX_WAIT",
+	})
+	gracePeriod := app.Int(cli.IntOpt{
+		Name:   "grace-period",
+		Value:  20,
+		Desc:   "Time in seconds to deliver buffered messages on shutdown before caching them again",
+		EnvVar: "GRACE_PERIOD",
+	})
 	awsRegion := app.String(cli.StringOpt{
 		Name:   "awsRegion",
 		Value:  "",
 		Desc:   "AWS region for S3",
 		EnvVar: "AWS_REGION",
 	})
+	sqsQueueURL := app.String(cli.StringOpt{
+		Name:   "sqs-queue-url",
+		Value:  "",
+		Desc:   "SQS queue receiving the S3 notifications of cached objects, the cache is listed when empty",
+		EnvVar: "SQS_QUEUE_URL",
+	})
+	sqsListInterval := app.Int(cli.IntOpt{
+		Name:   "sqs-list-interval",
+		Value:  300,
+		Desc:   "Time in seconds between listings of the cache when notifications are received from SQS",
+		EnvVar: "SQS_LIST_INTERVAL",
+	})
+	spoolDir := app.String(cli.StringOpt{
+		Name:   "spool-dir",
+		Value:  "",
+		Desc:   "Directory of the local spool that failed events are written to before S3, disabled when empty",
+		EnvVar: "SPOOL_DIR",
+	})
+	spoolMaxBytes := app.Int(cli.IntOpt{
+		Name:   "spool-max-bytes",
+		Value:  1024 * 1024 * 1024,
+		Desc:   "Maximum size in bytes of the local spool",
+		EnvVar: "SPOOL_MAX_BYTES",
+	})
+	spoolOverflow := app.String(cli.StringOpt{
+		Name:   "spool-overflow",
+		Value:  overflowS3,
+		Desc:   "What to do with failed events when the local spool is full (s3, drop-oldest, reject)",
+		EnvVar: "SPOOL_OVERFLOW",
+	})
+
+	ingestTokens := app.String(cli.StringOpt{
+		Name:   "ingest-tokens",
+		Value:  "",
+		Desc:   "Comma separated tokens accepted on the HEC ingest endpoints, which are disabled when empty",
+		EnvVar: "INGEST_TOKENS",
+	})
+	syslogUDP := app.String(cli.StringOpt{
+		Name:   "syslog-udp",
+		Value:  "",
+		Desc:   "Address to receive syslog messages on over UDP, e.g. :5514, disabled when empty",
+		EnvVar: "SYSLOG_UDP",
+	})
+	syslogTCP := app.String(cli.StringOpt{
+		Name:   "syslog-tcp",
+		Value:  "",
+		Desc:   "Address to receive syslog messages on over TCP, disabled when empty",
+		EnvVar: "SYSLOG_TCP",
+	})
+	syslogTLS := app.String(cli.StringOpt{
+		Name:   "syslog-tls",
+		Value:  "",
+		Desc:   "Address to receive syslog messages on over TLS, disabled when empty",
+		EnvVar: "SYSLOG_TLS",
+	})
+	syslogTLSCert := app.String(cli.StringOpt{
+		Name:   "syslog-tls-cert",
+		Value:  "",
+		Desc:   "PEM certificate file of the syslog TLS listener",
+		EnvVar: "SYSLOG_TLS_CERT",
+	})
+	syslogTLSKey := app.String(cli.StringOpt{
+		Name:   "syslog-tls-key",
+		Value:  "",
+		Desc:   "PEM private key file of the syslog TLS listener",
+		EnvVar: "SYSLOG_TLS_KEY",
+	})
+	tailPaths := app.String(cli.StringOpt{
+		Name:   "tail-paths",
+		Value:  "",
+		Desc:   "Comma separated globs of local files to tail, disabled when empty",
+		EnvVar: "TAIL_PATHS",
+	})
+	tailStateFile := app.String(cli.StringOpt{
+		Name:   "tail-state-file",
+		Value:  "tail-state.json",
+		Desc:   "File keeping the offsets of the tailed files across restarts",
+		EnvVar: "TAIL_STATE_FILE",
+	})
+	tailMultiline := app.String(cli.StringOpt{
+		Name:   "tail-multiline",
+		Value:  "",
+		Desc:   "Regular expression matching the first line of a record in tailed files, each line is a record when empty",
+		EnvVar: "TAIL_MULTILINE",
+	})
+	tailSourcetype := app.String(cli.StringOpt{
+		Name:   "tail-sourcetype",
+		Value:  "",
+		Desc:   "Sourcetype of the events read from tailed files",
+		EnvVar: "TAIL_SOURCETYPE",
+	})
+	kafkaBrokers := app.String(cli.StringOpt{
+		Name:   "kafka-brokers",
+		Value:  "",
+		Desc:   "Comma separated Kafka brokers to consume events from, disabled when empty",
+		EnvVar: "KAFKA_BROKERS",
+	})
+	kafkaTopics := app.String(cli.StringOpt{
+		Name:   "kafka-topics",
+		Value:  "",
+		Desc:   "Comma separated Kafka topics to consume events from",
+		EnvVar: "KAFKA_TOPICS",
+	})
+	kafkaGroup := app.String(cli.StringOpt{
+		Name:   "kafka-group",
+		Value:  "resilient-splunk-forwarder",
+		Desc:   "Kafka consumer group shared by the replicas",
+		EnvVar: "KAFKA_GROUP",
+	})
 
 	logLevel := app.String(cli.StringOpt{
 		Name:   "logLevel",
@@ -129,39 +513,219 @@ func initApp() *cli.Cli {
 	app.Action = func() {
 
 		config := appConfig{
-			appSystemCode: *appSystemCode,
-			appName:       *appName,
-			port:          *port,
-			fwdURL:        *fwdURL,
-			env:           *env,
-			workers:       *workers,
-			chanBuffer:    *chanBuffer,
-			token:         *token,
-			bucket:        *bucket,
-			awsRegion:     *awsRegion,
-			UPPLogger:     logger.NewUPPLogger(*appSystemCode, *logLevel),
+			appSystemCode:      *appSystemCode,
+			appName:            *appName,
+			port:               *port,
+			fwdURL:             *fwdURL,
+			sink:               *sinkName,
+			index:              *index,
+			env:                *env,
+			workers:            *workers,
+			minWorkers:         *minWorkers,
+			maxWorkers:         *maxWorkers,
+			latencyTarget:      time.Duration(*workerLatencyTarget) * time.Millisecond,
+			requestTimeout:     time.Duration(*requestTimeout) * time.Second,
+			chanBuffer:         *chanBuffer,
+			batchSize:          *batchSize,
+			batchBytes:         *batchBytes,
+			batchInterval:      time.Duration(*batchInterval) * time.Millisecond,
+			token:              *token,
+			gzip:               *gzipEnabled,
+			gzipLevel:          *gzipLevel,
+			gzipMinSize:        *gzipMinSize,
+			ack:                *ack,
+			ackTimeout:         time.Duration(*ackTimeout) * time.Second,
+			ackPollInterval:    time.Duration(*ackPollInterval) * time.Millisecond,
+			bucket:             *bucket,
+			leaseTimeout:       time.Duration(*leaseTimeout) * time.Second,
+			cacheBatchSize:     *cacheBatchSize,
+			cacheBatchBytes:    *cacheBatchBytes,
+			cacheBatchInterval: time.Duration(*cacheBatchInterval) * time.Millisecond,
+			cacheGzip:          *cacheGzip,
+			listPageSize:       int64(*listPageSize),
+			claimWorkers:       *claimWorkers,
+			shards:             *shards,
+			maxAttempts:        *maxAttempts,
+			maxEventAge:        time.Duration(*maxEventAge) * time.Hour,
+			breakerFailureRate: *breakerFailureRate,
+			breakerMinEvents:   *breakerMinEvents,
+			breakerWindow:      time.Duration(*breakerWindow) * time.Second,
+			breakerOpenTime:    time.Duration(*breakerOpenTime) * time.Second,
+			breakerProbes:      *breakerProbes,
+			rateLimitEvents:    *rateLimitEvents,
+			rateLimitBytes:     *rateLimitBytes,
+			rateLimitMaxWait:   time.Duration(*rateLimitMaxWait) * time.Second,
+			indexRateLimits:    splitList(*indexRateLimits),
+			gracePeriod:        time.Duration(*gracePeriod) * time.Second,
+			awsRegion:          *awsRegion,
+			sqsQueueURL:        *sqsQueueURL,
+			sqsListInterval:    time.Duration(*sqsListInterval) * time.Second,
+			spoolDir:           *spoolDir,
+			spoolMaxBytes:      int64(*spoolMaxBytes),
+			spoolOverflow:      *spoolOverflow,
+			ingestTokens:       splitList(*ingestTokens),
+			syslogUDP:          *syslogUDP,
+			syslogTCP:          *syslogTCP,
+			syslogTLS:          *syslogTLS,
+			syslogTLSCert:      *syslogTLSCert,
+			syslogTLSKey:       *syslogTLSKey,
+			tailPaths:          splitList(*tailPaths),
+			tailStateFile:      *tailStateFile,
+			tailMultiline:      *tailMultiline,
+			tailSourcetype:     *tailSourcetype,
+			kafkaBrokers:       splitList(*kafkaBrokers),
+			kafkaTopics:        splitList(*kafkaTopics),
+			kafkaGroup:         *kafkaGroup,
+			UPPLogger:          logger.NewUPPLogger(*appSystemCode, *logLevel),
 		}
 
 		config.UPPLogger.Infof("[Startup] resilient-splunk-forwarder is starting ")
 
 		config.UPPLogger.Infof("System code: %s, App Name: %s, Port: %s", *appSystemCode, *appName, *port)
-		err := validateParams(config)
+		destinations, err := parseDestinations(*destinationNames, os.Getenv)
+		if err != nil {
+			config.UPPLogger.Fatal(err)
+		}
+		config.destinations = destinations
+		err = validateParams(config)
 		if err != nil {
 			config.UPPLogger.Fatal(err)
 		}
 
 		defer config.UPPLogger.Infof("Resilient Splunk forwarder: Stopped\n")
 
-		s3, err := NewS3Service(config.bucket, config.awsRegion, config.env)
+		envLabel = prometheus.Labels{"environment": config.env}
+		var s3 Cache
+		if config.sqsQueueURL == "" {
+			s3, err = NewS3Service(config.env, config)
+		} else {
+			s3, err = NewNotifiedS3Service(config.env, config)
+		}
 		if err != nil {
 			config.UPPLogger.Fatalf(err.Error())
 		}
-		envLabel = prometheus.Labels{"environment": config.env}
+		cache := s3
+		var spool *diskSpool
+		if config.spoolDir != "" {
+			spool, err = newDiskSpool(s3, config)
+			if err != nil {
+				config.UPPLogger.Fatalf(err.Error())
+			}
+			spool.start()
+			cache = spool
+		}
 
-		splunkForwarder := NewSplunkForwarder(config)
-		logProcessor := NewLogProcessor(splunkForwarder, s3, config)
+		var forwarder Forwarder
+		var checks []health.Check
+		// health of the destinations, left out of GTG when the service takes events itself
+		var destinationHealth []health.Check
+		destinationProcessors := []LogProcessor{}
+		if len(config.destinations) == 0 {
+			forwarder, err = NewForwarder(config)
+			if err != nil {
+				config.UPPLogger.Fatalf(err.Error())
+			}
+			if splunk, ok := forwarder.(*splunkClient); ok {
+				defer splunk.stop()
+			}
+			destination, _ := lookupSink(config.sink)
+			// the metrics of the destination are labelled like those of fan-out destinations
+			sinkName := config.sink
+			if sinkName == "" {
+				sinkName = defaultSink
+			}
+			forwarder = guardForwarder(sinkName, forwarder, config)
+			destinationHealth = destinationChecks(destination.name, forwarder)
+			checks = append(checks, destinationHealth...)
+		} else {
+			forwarder, destinationProcessors, destinationHealth, err = newFanout(config)
+			if err != nil {
+				config.UPPLogger.Fatalf(err.Error())
+			}
+			defer forwarder.(*fanoutForwarder).stop()
+			checks = append(checks, destinationHealth...)
+			checks = append(checks, fanoutCacheCheck(forwarder.(*fanoutForwarder)))
+		}
+		logProcessor := NewLogProcessor(forwarder, cache, config)
 
 		logProcessor.Start()
+		for _, p := range destinationProcessors {
+			p.Start()
+		}
+
+		var syslog *syslogServer
+		if config.syslogUDP != "" || config.syslogTCP != "" || config.syslogTLS != "" {
+			syslog, err = newSyslogServer(logProcessor, config)
+			if err != nil {
+				config.UPPLogger.Fatalf(err.Error())
+			}
+			if err = syslog.start(); err != nil {
+				config.UPPLogger.Fatalf("Failed to start syslog listeners: %v", err)
+			}
+		}
+
+		var tail *tailer
+		if len(config.tailPaths) > 0 {
+			tail, err = newTailer(logProcessor, config)
+			if err != nil {
+				config.UPPLogger.Fatalf(err.Error())
+			}
+			tail.start()
+		}
+
+		var kafka *kafkaConsumer
+		if len(config.kafkaBrokers) > 0 {
+			kafka, err = NewKafkaConsumer(logProcessor, config)
+			if err != nil {
+				config.UPPLogger.Fatalf(err.Error())
+			}
+			kafka.start()
+			checks = append(checks, health.Check{
+				BusinessImpact:   "Logs published to Kafka are not forwarded and will probably be indexed with delay",
+				Name:             "Kafka healthcheck",
+				PanicGuide:       "https://runbooks.in.ft.com/resilient-splunk-forwarder",
+				Severity:         1,
+				TechnicalSummary: "Latest attempt to consume from Kafka has returned an error - check journal file",
+				Checker: func() (string, error) {
+					err := kafka.getHealth()
+					if err != nil {
+						return "Kafka is not healthy", err
+					}
+					return "Kafka is healthy", nil
+				},
+			})
+		}
+
+		checks = append(checks, health.Check{
+			BusinessImpact:   "Logs can not be read from S3 and will probably be indexed with delay",
+			Name:             "S3 healthcheck",
+			PanicGuide:       "https://runbooks.in.ft.com/resilient-splunk-forwarder",
+			Severity:         1,
+			TechnicalSummary: "Latest request to S3 has returned an error - check journal file",
+			Checker: func() (string, error) {
+				err := s3.getHealth()
+				if err != nil {
+					return "S3 is not healthy", err
+				}
+				return "S3 is healthy", nil
+			},
+		})
+		if spool != nil {
+			checks = append(checks, health.Check{
+				BusinessImpact:   "Failed logs can not be spooled locally and depend on S3 being available",
+				Name:             "Local spool healthcheck",
+				PanicGuide:       "https://runbooks.in.ft.com/resilient-splunk-forwarder",
+				Severity:         2,
+				TechnicalSummary: "Latest write to the local spool has failed - check the spool volume and the journal file",
+				Checker: func() (string, error) {
+					err := spool.getHealth()
+					if err != nil {
+						return "Local spool is not healthy", err
+					}
+					return "Local spool is healthy", nil
+				},
+			})
+		}
 
 		healthService := newHealthService(
 			&healthConfig{
@@ -169,50 +733,81 @@ func initApp() *cli.Cli {
 				appName:       *appName,
 				port:          *port,
 			},
-			[]health.Check{
-				{
-					BusinessImpact:   "Logs are not reaching Splunk therefore monitoring may be affected",
-					Name:             "Splunk healthcheck",
-					PanicGuide:       "https://runbooks.in.ft.com/resilient-splunk-forwarder",
-					Severity:         1,
-					TechnicalSummary: "Latest request to Splunk HEC has returned an error - check journal file",
-					Checker: func() (string, error) {
-						err := splunkForwarder.getHealth()
-						if err != nil {
-							return "Splunk is not healthy", err
-						}
-						return "Splunk is healthy", nil
-					},
-				},
-				{
-					BusinessImpact:   "Logs can not be read from S3 and will probably be indexed with delay",
-					Name:             "S3 healthcheck",
-					PanicGuide:       "https://runbooks.in.ft.com/resilient-splunk-forwarder",
-					Severity:         1,
-					TechnicalSummary: "Latest request to S3 has returned an error - check journal file",
-					Checker: func() (string, error) {
-						err := s3.getHealth()
-						if err != nil {
-							return "S3 is not healthy", err
-						}
-						return "S3 is healthy", nil
-					},
-				},
-			},
+			checks,
 		)
 
+		var ingest *ingestHandler
+		if len(config.ingestTokens) > 0 {
+			ingest = newIngestHandler(forwarder, cache, config)
+			// ingested events are cached while the destination is down, so the pod keeps taking them
+			healthService.excludeFromGTG(destinationHealth)
+		}
+
 		go func() {
-			serveEndpoints(healthService, *appSystemCode, *appName, *port, config.UPPLogger)
+			serveEndpoints(healthService, ingest, *appSystemCode, *appName, *port, config.UPPLogger)
 		}()
 
 		config.UPPLogger.Infof("Resilient Splunk forwarder (workers %v): Started\n", workers)
 		waitForSignal()
+		// every stage of the shutdown shares the grace period
+		deadline := time.Now().Add(config.gracePeriod)
+		if syslog != nil {
+			syslog.stop()
+		}
+		if tail != nil {
+			tail.stop()
+		}
+		if kafka != nil {
+			// waits for the messages in flight so that their offsets are committed
+			kafka.stop(deadline)
+		}
+		logProcessor.Stop(deadline)
+		if tail != nil {
+			// records left in flight are read again on restart
+			if err := tail.checkpoint(); err != nil {
+				config.UPPLogger.Errorf("Failed to save tail state file: %v", err)
+			}
+		}
+		for _, p := range destinationProcessors {
+			p.Stop(deadline)
+		}
+		if spool != nil {
+			// events left in the spool are flushed on the next start
+			spool.stop(deadline)
+		}
 	}
 
+	// subcommands read the cache with the S3 and HEC options of the service
+	commandConfig := func() appConfig {
+		return appConfig{
+			appSystemCode:   *appSystemCode,
+			env:             *env,
+			workers:         1,
+			batchSize:       *batchSize,
+			gzip:            *gzipEnabled,
+			gzipLevel:       *gzipLevel,
+			gzipMinSize:     *gzipMinSize,
+			ack:             *ack,
+			ackTimeout:      time.Duration(*ackTimeout) * time.Second,
+			ackPollInterval: time.Duration(*ackPollInterval) * time.Millisecond,
+			requestTimeout:  time.Duration(*requestTimeout) * time.Second,
+			bucket:          *bucket,
+			claimWorkers:    *claimWorkers,
+			awsRegion:       *awsRegion,
+			UPPLogger:       logger.NewUPPLogger(*appSystemCode, *logLevel),
+		}
+	}
+	app.Command("replay", "Send the events cached within a time window to a HEC url", func(cmd *cli.Cmd) {
+		replayCommand(cmd, commandConfig)
+	})
+	app.Command("inspect", "Report on the objects cached under a prefix, without deleting anything", func(cmd *cli.Cmd) {
+		inspectCommand(cmd, commandConfig)
+	})
+
 	return app
 }
 
-func serveEndpoints(healthService *healthService, appSystemCode string, appName string, port string, uppLogger *logger.UPPLogger) {
+func serveEndpoints(healthService *healthService, ingest *ingestHandler, appSystemCode string, appName string, port string, uppLogger *logger.UPPLogger) {
 
 	serveMux := http.NewServeMux()
 
@@ -227,6 +822,9 @@ func serveEndpoints(healthService *healthService, appSystemCode string, appName
 	serveMux.HandleFunc(status.GTGPath, status.NewGoodToGoHandler(healthService.GTG))
 	serveMux.HandleFunc(status.BuildInfoPath, status.BuildInfoHandler)
 	serveMux.Handle("/metrics", promhttp.Handler())
+	if ingest != nil {
+		ingest.register(serveMux)
+	}
 
 	server := &http.Server{
 		Addr:    ":" + port,
@@ -260,19 +858,117 @@ func waitForSignal() {
 }
 
 func validateParams(config appConfig) error {
-	if len(config.fwdURL) == 0 { //Check whether -url parameter value was provided
-		return errors.New("forwarder URL must be provided")
+	if len(config.destinations) == 0 {
+		if err := validateDestination(config, config.sink, config.fwdURL, config.token); err != nil {
+			return err
+		}
 	}
-	if len(config.token) == 0 { //Check whether -token parameter value was provided
-		return errors.New("splunk token must be provided")
+	for _, d := range config.destinations {
+		if err := validateDestination(config, d.sink, d.url, d.token); err != nil {
+			return fmt.Errorf("destination %v: %v", d.name, err)
+		}
 	}
 	if len(config.bucket) == 0 { //Check whether -bucket parameter value was provided
 		return errors.New("s3 bucket name must be provided")
 	}
+	if config.listPageSize > maxPageSize {
+		return fmt.Errorf("list page size must be at most %v", maxPageSize)
+	}
+	if config.shards > maxShards {
+		return fmt.Errorf("shards must be at most %v", maxShards)
+	}
+	if config.maxAttempts < 0 || config.maxEventAge < 0 {
+		return errors.New("max attempts and max event age must not be negative")
+	}
+	if config.maxWorkers > 0 && (config.minWorkers < 1 || config.minWorkers > config.workers || config.workers > config.maxWorkers) {
+		return errors.New("workers must be between min workers and max workers, and min workers must be positive")
+	}
+	if config.requestTimeout < 0 {
+		return errors.New("request timeout must not be negative")
+	}
+	if config.rateLimitEvents < 0 || config.rateLimitBytes < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	if _, err := parseIndexRateLimits(config.indexRateLimits); err != nil {
+		return err
+	}
+	if config.breakerFailureRate < 0 || config.breakerFailureRate > 100 {
+		return errors.New("breaker failure rate must be a percentage")
+	}
+	if config.breakerFailureRate > 0 && config.breakerWindow < time.Second {
+		return errors.New("breaker window must be at least a second")
+	}
+	if config.leaseTimeout <= 0 {
+		return errors.New("lease timeout must be positive")
+	}
+	if config.ack {
+		if config.leaseTimeout <= config.ackTimeout {
+			return errors.New("lease timeout must be longer than the ack timeout")
+		}
+		if config.ackPollInterval <= 0 {
+			return errors.New("ack poll interval must be positive")
+		}
+	}
+	if config.sqsQueueURL != "" && config.sqsListInterval <= 0 {
+		return errors.New("sqs list interval must be positive")
+	}
+	if config.spoolDir != "" {
+		if config.spoolMaxBytes <= 0 {
+			return errors.New("spool max bytes must be positive")
+		}
+		switch config.spoolOverflow {
+		case overflowS3, overflowDropOldest, overflowReject:
+		default:
+			return fmt.Errorf("spool overflow policy %v is not valid", config.spoolOverflow)
+		}
+	}
+	if config.syslogTLS != "" && (config.syslogTLSCert == "" || config.syslogTLSKey == "") {
+		return errors.New("syslog TLS certificate and key must be provided")
+	}
+	if len(config.kafkaBrokers) > 0 && len(config.kafkaTopics) == 0 {
+		return errors.New("kafka topics must be provided")
+	}
+	if config.tailMultiline != "" {
+		if _, err := regexp.Compile(config.tailMultiline); err != nil {
+			return fmt.Errorf("tail multiline pattern is not valid: %v", err)
+		}
+	}
+	if config.gzip && config.gzipLevel != gzip.DefaultCompression && (config.gzipLevel < gzip.BestSpeed || config.gzipLevel > gzip.BestCompression) {
+		return fmt.Errorf("gzip level %v is not valid", config.gzipLevel)
+	}
 
 	return nil
 }
 
+func validateDestination(config appConfig, sink string, fwdURL string, token string) error {
+	if len(fwdURL) == 0 { //Check whether -url parameter value was provided
+		return errors.New("forwarder URL must be provided")
+	}
+	if _, err := lookupSink(sink); err != nil {
+		return err
+	}
+	if len(token) == 0 && (sink == "" || sink == defaultSink) { //Check whether -token parameter value was provided
+		return errors.New("splunk token must be provided")
+	}
+	if config.ack {
+		if _, err := ackURL(fwdURL); err != nil {
+			return fmt.Errorf("forwarder URL is not valid: %v", err)
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated option, ignoring blank items
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func registerCounter(name, help string) prometheus.Counter {
 	c := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -305,3 +1001,51 @@ func registerHistogram(name, help string, buckets []float64) prometheus.Observer
 	}
 	return h.With(envLabel)
 }
+
+func registerGauge(name, help string) prometheus.Gauge {
+	g := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      name,
+			Help:      help,
+		},
+		labelNames)
+	prometheus.MustRegister(g)
+	if envLabel == nil {
+		envLabel = prometheus.Labels{"environment": "dummy"}
+	}
+	return g.With(envLabel)
+}
+
+func registerGaugeVec(name, help string, labels ...string) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      name,
+			Help:      help,
+		},
+		append(labels, labelNames...))
+	prometheus.MustRegister(g)
+	if envLabel == nil {
+		envLabel = prometheus.Labels{"environment": "dummy"}
+	}
+	return g.MustCurryWith(envLabel)
+}
+
+func registerCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      name,
+			Help:      help,
+		},
+		append(labels, labelNames...))
+	prometheus.MustRegister(c)
+	if envLabel == nil {
+		envLabel = prometheus.Labels{"environment": "dummy"}
+	}
+	return c.MustCurryWith(envLabel)
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Financial-Times/go-logger/v2"
 
@@ -26,7 +27,9 @@ func TestMain(m *testing.M) {
 			splunk.incErrors()
 			w.WriteHeader(http.StatusServiceUnavailable)
 		} else {
-			splunk.append(body)
+			for _, event := range strings.Split(body, "\n") {
+				splunk.append(event)
+			}
 			w.WriteHeader(http.StatusOK)
 		}
 	}))
@@ -44,6 +47,11 @@ func TestMain(m *testing.M) {
 	config.env = "dummy"
 	config.workers = 8
 	config.chanBuffer = 256
+	config.batchSize = 10
+	config.batchBytes = 4096
+	config.batchInterval = 10 * time.Millisecond
+	config.gracePeriod = time.Second
+	config.leaseTimeout = time.Minute
 	config.token = "secret"
 	config.bucket = "testbucket"
 	config.UPPLogger = logger.NewUPPLogger("PANIC", "app-system-code")
@@ -80,6 +88,16 @@ func Test_failValidateParams(t *testing.T) {
 	}
 }
 
+func Test_failValidateParamsGzipLevel(t *testing.T) {
+	brokenConfig := config
+	brokenConfig.gzip = true
+	brokenConfig.gzipLevel = 12
+
+	err := validateParams(brokenConfig)
+
+	assert.Error(t, err)
+}
+
 func Test_RegisterCounter(t *testing.T) {
 	name := "fooCounter"
 	help := "barDescription"
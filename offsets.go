@@ -0,0 +1,66 @@
+package main
+
+import "sync"
+
+// offsetQueue tracks records of an ordered source, such as a file or a partition, that
+// are being delivered. Records may be done in any order but the committed offset only
+// moves past a record once every record before it is done too.
+type offsetQueue struct {
+	sync.Mutex
+	inFlight  []*offsetRecord
+	committed int64
+}
+
+type offsetRecord struct {
+	// offset to resume from once the record is done
+	next int64
+	done bool
+}
+
+func newOffsetQueue(committed int64) *offsetQueue {
+	return &offsetQueue{committed: committed}
+}
+
+// track adds a record, in source order
+func (q *offsetQueue) track(next int64) *offsetRecord {
+	q.Lock()
+	defer q.Unlock()
+	r := &offsetRecord{next: next}
+	q.inFlight = append(q.inFlight, r)
+	return r
+}
+
+// done marks a record as done and tells whether the committed offset has moved
+func (q *offsetQueue) done(r *offsetRecord) (int64, bool) {
+	q.Lock()
+	defer q.Unlock()
+	r.done = true
+	moved := false
+	for len(q.inFlight) > 0 && q.inFlight[0].done {
+		q.committed = q.inFlight[0].next
+		q.inFlight = q.inFlight[1:]
+		moved = true
+	}
+	return q.committed, moved
+}
+
+func (q *offsetQueue) getCommitted() int64 {
+	q.Lock()
+	defer q.Unlock()
+	return q.committed
+}
+
+func (q *offsetQueue) pending() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.inFlight)
+}
+
+// reset forgets the records in flight, which may still be marked done but no longer
+// move the committed offset
+func (q *offsetQueue) reset(committed int64) {
+	q.Lock()
+	defer q.Unlock()
+	q.inFlight = nil
+	q.committed = committed
+}
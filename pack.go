@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Objects holding several events are newline-delimited, one event per line, and are told
+// apart from single-event objects by the extension of their key
+const (
+	packedSuffix        = ".ndjson"
+	packedGzippedSuffix = ".ndjson.gz"
+)
+
+// packing bounds the number and size of the events packed into a single cache object.
+// Single events are stored as they are, unless they are gzipped, so that replicas
+// that don't unpack objects can still read them.
+type packing struct {
+	size  int
+	bytes int
+	gzip  bool
+}
+
+func newPacking(config appConfig) packing {
+	return packing{size: config.cacheBatchSize, bytes: config.cacheBatchBytes, gzip: config.cacheGzip}
+}
+
+// split divides events into the groups packed together
+func (p packing) split(events []string) [][]string {
+	groups := [][]string{}
+	group := []string{}
+	groupBytes := 0
+	for _, event := range events {
+		if len(group) > 0 && (len(group) >= p.size || (p.bytes > 0 && groupBytes+len(event) > p.bytes)) {
+			groups = append(groups, group)
+			group = []string{}
+			groupBytes = 0
+		}
+		group = append(group, event)
+		groupBytes += len(event) + 1
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// pack encodes events into the body of an object, and returns the suffix of its key
+func (p packing) pack(events []string) ([]byte, string, error) {
+	if len(events) == 1 && !p.gzip {
+		return []byte(events[0]), "", nil
+	}
+	buf := &bytes.Buffer{}
+	var w io.Writer = buf
+	var gz *gzip.Writer
+	suffix := packedSuffix
+	if p.gzip {
+		gz = gzip.NewWriter(buf)
+		w = gz
+		suffix = packedGzippedSuffix
+	}
+	for _, event := range events {
+		if _, err := io.WriteString(w, packLine(event)+"\n"); err != nil {
+			return nil, "", err
+		}
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return nil, "", err
+		}
+	}
+	return buf.Bytes(), suffix, nil
+}
+
+// unpack decodes the events of an object given its key
+func unpack(key string, body []byte) ([]string, error) {
+	if strings.HasSuffix(key, packedGzippedSuffix) {
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		if body, err = ioutil.ReadAll(gz); err != nil {
+			return nil, err
+		}
+	} else if !strings.HasSuffix(key, packedSuffix) {
+		// objects written one event at a time
+		return []string{string(body)}, nil
+	}
+	events := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		event, err := unpackLine(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// packLine keeps an event on a single line. Events that span several lines, or look like
+// a JSON string themselves, are stored as a JSON string.
+func packLine(event string) string {
+	if !strings.ContainsAny(event, "\r\n") && !strings.HasPrefix(event, `"`) {
+		return event
+	}
+	buf, _ := json.Marshal(event)
+	return string(buf)
+}
+
+func unpackLine(line string) (string, error) {
+	if !strings.HasPrefix(line, `"`) {
+		return line, nil
+	}
+	event := ""
+	err := json.Unmarshal([]byte(line), &event)
+	return event, err
+}
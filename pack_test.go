@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Packing_Split(t *testing.T) {
+	p := packing{size: 3, bytes: 10}
+	groups := p.split([]string{"a", "b", "c", "d", "0123456789", "e"})
+	assert.Equal(t, [][]string{{"a", "b", "c"}, {"d"}, {"0123456789"}, {"e"}}, groups)
+
+	assert.Equal(t, [][]string{{"a"}, {"b"}}, packing{}.split([]string{"a", "b"}), "events should be stored one by one by default")
+}
+
+func Test_Packing_RoundTrip(t *testing.T) {
+	events := []string{`{"event":"a"}`, "multi\nline", `"quoted"`, "windows\r\n"}
+	for _, p := range []packing{{size: 10}, {size: 10, gzip: true}} {
+		body, suffix, err := p.pack(events)
+		assert.NoError(t, err)
+		if p.gzip {
+			assert.Equal(t, packedGzippedSuffix, suffix)
+		} else {
+			assert.Equal(t, packedSuffix, suffix)
+			assert.Len(t, strings.Split(strings.TrimSuffix(string(body), "\n"), "\n"), len(events), "each event should be on its own line")
+			assert.True(t, strings.HasPrefix(string(body), `{"event":"a"}`+"\n"))
+		}
+
+		unpacked, err := unpack("test-prefix/1_uuid"+suffix, body)
+		assert.NoError(t, err)
+		assert.Equal(t, events, unpacked)
+	}
+}
+
+func Test_Packing_SingleEvent(t *testing.T) {
+	body, suffix, err := packing{size: 10}.pack([]string{"multi\nline"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", suffix)
+	assert.Equal(t, "multi\nline", string(body), "single events should be readable by previous versions")
+
+	unpacked, err := unpack("test-prefix-inflight/2_1_uuid", body)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"multi\nline"}, unpacked)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errorPolicy is what should happen to an event rejected by the destination
+type errorPolicy int
+
+const (
+	// policyRetry caches the event again so that it is retried later
+	policyRetry errorPolicy = iota
+	// policyDiscard drops the event
+	policyDiscard
+	// policyDeadLetter stores the event in the dead-letter prefix so that it can be inspected and replayed
+	policyDeadLetter
+	// policyStop marks the destination unhealthy and stops forwarding, keeping the event cached
+	policyStop
+)
+
+var hecErrorCounter *prometheus.CounterVec
+
+// hecCodePolicies maps the HEC status codes documented by Splunk to a policy
+var hecCodePolicies = map[int]errorPolicy{
+	1:  policyStop,       // Token disabled
+	2:  policyStop,       // Token is required
+	3:  policyStop,       // Invalid authorization
+	4:  policyStop,       // Invalid token
+	5:  policyDiscard,    // No data
+	6:  policyDeadLetter, // Invalid data format
+	7:  policyDeadLetter, // Incorrect index
+	8:  policyRetry,      // Internal server error
+	9:  policyRetry,      // Server is busy
+	10: policyRetry,      // Data channel is missing
+	11: policyRetry,      // Invalid data channel
+	12: policyDeadLetter, // Event field is required
+	13: policyDeadLetter, // Event field cannot be blank
+	14: policyStop,       // ACK is disabled
+	15: policyDeadLetter, // Error in handling indexed fields
+	16: policyStop,       // Query string authorization is not enabled
+}
+
+// hecError is passed to the forward callback for events rejected by HEC
+type hecError struct {
+	status int
+	code   int
+	text   string
+	policy errorPolicy
+}
+
+func newHecError(status int, resp hecResponse) *hecError {
+	return &hecError{
+		status: status,
+		code:   resp.Code,
+		text:   resp.Text,
+		policy: policyForResponse(status, resp),
+	}
+}
+
+func (e *hecError) Error() string {
+	return fmt.Sprintf("HEC returned status %v, code %v: %v", e.status, e.code, e.text)
+}
+
+func policyForResponse(status int, resp hecResponse) errorPolicy {
+	// a zero code only means success on a 200, otherwise the body had no HEC code
+	if resp.Code != 0 {
+		if policy, ok := hecCodePolicies[resp.Code]; ok {
+			return policy
+		}
+	}
+	switch status {
+	case 400:
+		return policyDiscard
+	case 401, 403:
+		return policyStop
+	}
+	return policyRetry
+}
+
+// sinkError is passed to the forward callback for events rejected by a destination other than HEC
+type sinkError struct {
+	status int
+	text   string
+	policy errorPolicy
+}
+
+func (e *sinkError) Error() string {
+	return fmt.Sprintf("destination returned status %v: %v", e.status, e.text)
+}
+
+// policyForStatus maps the HTTP status of a destination without HEC codes to a policy
+func policyForStatus(status int) errorPolicy {
+	switch status {
+	case 400, 413, 422:
+		return policyDeadLetter
+	case 401, 403:
+		return policyStop
+	}
+	return policyRetry
+}
+
+// hecBatchCodes are the HEC codes rejecting a whole request for what may be a single event
+var hecBatchCodes = map[int]bool{
+	5:  true, // No data
+	6:  true, // Invalid data format
+	12: true, // Event field is required
+	13: true, // Event field cannot be blank
+}
+
+// rejectsBatch tells whether the destination may have rejected a whole batch for one of
+// its events, as too large or badly formatted
+func rejectsBatch(err error) bool {
+	switch e := err.(type) {
+	case *hecError:
+		return e.status == http.StatusRequestEntityTooLarge || hecBatchCodes[e.code]
+	case *sinkError:
+		return e.status == http.StatusRequestEntityTooLarge
+	}
+	return false
+}
+
+// policyOf returns the policy to apply to an event failed with the given error
+func policyOf(err error) errorPolicy {
+	switch e := err.(type) {
+	case *hecError:
+		return e.policy
+	case *sinkError:
+		return e.policy
+	}
+	return policyRetry
+}
+
+func hecCodeLabel(status int, resp hecResponse) string {
+	if resp.Code == 0 && status != 200 {
+		return "none"
+	}
+	return strconv.Itoa(resp.Code)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PolicyForResponse(t *testing.T) {
+	assert.Equal(t, policyStop, policyForResponse(403, hecResponse{Code: 1, Text: "Token disabled"}))
+	assert.Equal(t, policyStop, policyForResponse(403, hecResponse{Code: 4, Text: "Invalid token"}))
+	assert.Equal(t, policyDiscard, policyForResponse(400, hecResponse{Code: 5, Text: "No data"}))
+	assert.Equal(t, policyDeadLetter, policyForResponse(400, hecResponse{Code: 6, Text: "Invalid data format"}))
+	assert.Equal(t, policyDeadLetter, policyForResponse(400, hecResponse{Code: 7, Text: "Incorrect index"}))
+	assert.Equal(t, policyRetry, policyForResponse(500, hecResponse{Code: 8, Text: "Internal server error"}))
+}
+
+func Test_PolicyForResponseWithoutCode(t *testing.T) {
+	assert.Equal(t, policyDiscard, policyForResponse(400, hecResponse{}))
+	assert.Equal(t, policyStop, policyForResponse(401, hecResponse{}))
+	assert.Equal(t, policyRetry, policyForResponse(502, hecResponse{}))
+	assert.Equal(t, policyRetry, policyForResponse(500, hecResponse{Code: 42}))
+}
+
+func Test_PolicyOf(t *testing.T) {
+	assert.Equal(t, policyRetry, policyOf(errors.New("connection refused")))
+	assert.Equal(t, policyDeadLetter, policyOf(newHecError(400, hecResponse{Code: 6})))
+}
+
+func Test_RejectsBatch(t *testing.T) {
+	assert.True(t, rejectsBatch(newHecError(413, hecResponse{})))
+	assert.True(t, rejectsBatch(newHecError(400, hecResponse{Code: 6, Text: "Invalid data format"})))
+	assert.True(t, rejectsBatch(&sinkError{status: 413, text: "Content too large", policy: policyDeadLetter}))
+	assert.False(t, rejectsBatch(newHecError(500, hecResponse{Code: 8, Text: "Internal server error"})))
+	assert.False(t, rejectsBatch(&sinkError{status: 502, policy: policyRetry}))
+	assert.False(t, rejectsBatch(errors.New("connection refused")))
+	assert.False(t, rejectsBatch(errAckTimeout))
+}
+
+func Test_HecCodeLabel(t *testing.T) {
+	assert.Equal(t, "4", hecCodeLabel(403, hecResponse{Code: 4}))
+	assert.Equal(t, "none", hecCodeLabel(502, hecResponse{}))
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Financial-Times/go-logger/v2"
@@ -10,123 +10,268 @@ import (
 )
 
 const (
-	sleepTime  = 100
-	maxBackoff = 9
-	minBackoff = 0
+	sleepTime = 100
+	// DeleteObjects accepts at most 1000 keys
+	maxAckBatch   = 1000
+	ackBatchDelay = time.Second
 )
 
 type LogRetry interface {
-	Enqueue(s string)
+	Enqueue(m *message)
+}
+
+// LogInput takes events received by the service itself rather than read from the cache
+type LogInput interface {
+	Submit(m *message)
 }
 
 type LogProcessor interface {
 	LogRetry
+	LogInput
 	Start()
-	Stop()
-	Dequeue() ([]string, error)
+	// Stop stops reading from the cache and delivers the buffered messages until the
+	// deadline, after which they are cached again
+	Stop(deadline time.Time)
+	Dequeue() ([]*message, error)
+}
+
+// message is a log event on its way to the destination
+type message struct {
+	body string
+	// key of the cache lease the event was claimed with, acknowledged once the event
+	// has been delivered or cached again
+	key string
+	// done is called, if set, once the event has been delivered or cached again
+	done func()
+	// failed attempts to deliver the event, and when the first one was made
+	attempts  int
+	firstSeen time.Time
+	// destinations that have already delivered or cached a fanned out event, which it is
+	// not sent to again when it is retried
+	fannedOut []string
 }
 
 type logProcessor struct {
 	sync.Mutex
-	forwarder  Forwarder
-	cache      Cache
-	stopped    bool
-	inChan     chan string
-	outChan    chan string
-	wg         sync.WaitGroup
-	chanBuffer int
-	workers    int
-	uppLogger  *logger.UPPLogger
+	forwarder    Forwarder
+	cache        Cache
+	stopped      bool
+	halted       bool
+	drainExpired bool
+	inChan       chan *message
+	outChan      chan *message
+	ackChan      chan string
+	// closed on shutdown, releases the senders blocked on a full outChan
+	stopChan chan struct{}
+	// guard sending to outChan, inChan and ackChan against them being closed on shutdown
+	outLock   sync.RWMutex
+	outClosed bool
+	inLock    sync.RWMutex
+	inClosed  bool
+	ackLock   sync.RWMutex
+	ackClosed bool
+	// events of a failed batch retried one at a time, before their attempts are counted
+	isolateChan   chan *message
+	isolateLock   sync.RWMutex
+	isolateClosed bool
+	isolateWg     sync.WaitGroup
+	readerWg      sync.WaitGroup
+	forwardWg     sync.WaitGroup
+	cacheWg       sync.WaitGroup
+	ackWg         sync.WaitGroup
+	inFlight      int64
+	delivered     int64
+	recached      int64
+	// unix time in nanoseconds of the latest delivery
+	lastDelivery  int64
+	chanBuffer    int
+	workers       int
+	batchSize     int
+	batchBytes    int
+	batchInterval time.Duration
+	// forward workers, up to the ceiling of the concurrency limit
+	forwardWorkers int
+	// failed messages are cached in batches, packed into as few objects as possible
+	cacheBatchSize     int
+	cacheBatchBytes    int
+	cacheBatchInterval time.Duration
+	// events are quarantined after failing this many times, or for this long
+	maxAttempts int
+	maxEventAge time.Duration
+	uppLogger   *logger.UPPLogger
 }
 
-var queueLatency prometheus.Observer
+// batcher coalesces messages read from a channel into batches bounded by
+// an event count, a byte size and the time spent waiting for the batch to fill.
+type batcher struct {
+	in       <-chan *message
+	size     int
+	bytes    int
+	interval time.Duration
+	// message read from the channel that did not fit into the previous batch
+	carry *message
+}
+
+var (
+	queueLatency      prometheus.Observer
+	deadLetterCounter prometheus.Counter
+	lostCounter       prometheus.Counter
+)
 
 func NewLogProcessor(forwarder Forwarder, cache Cache, config appConfig) LogProcessor {
 	if queueLatency == nil {
 		queueLatency = registerHistogram("queue_latency", "Post queue latency", []float64{.00001, .000015, .00002, .000025, .00003, .00004, .00005, .00006})
+		deadLetterCounter = registerCounter("dead_lettered_count", "Number of messages stored in the dead-letter prefix")
+		quarantinedCounter = registerCounter("quarantined_count", "Number of messages stored in the quarantine prefix after failing repeatedly")
+		lostCounter = registerCounter("lost_count", "Number of messages received by the service that could neither be delivered nor cached")
+	}
+	batchSize := config.batchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	forwardWorkers := config.workers
+	if config.maxWorkers > forwardWorkers {
+		forwardWorkers = config.maxWorkers
+	}
+	cacheBatchSize := config.cacheBatchSize
+	if cacheBatchSize < 1 {
+		cacheBatchSize = 1
 	}
 	return &logProcessor{
-		forwarder:  forwarder,
-		cache:      cache,
-		wg:         sync.WaitGroup{},
-		chanBuffer: config.chanBuffer,
-		workers:    config.workers,
-		uppLogger:  config.UPPLogger,
+		forwarder:          forwarder,
+		cache:              cache,
+		chanBuffer:         config.chanBuffer,
+		workers:            config.workers,
+		forwardWorkers:     forwardWorkers,
+		batchSize:          batchSize,
+		batchBytes:         config.batchBytes,
+		batchInterval:      config.batchInterval,
+		cacheBatchSize:     cacheBatchSize,
+		cacheBatchBytes:    config.cacheBatchBytes,
+		cacheBatchInterval: config.cacheBatchInterval,
+		maxAttempts:        config.maxAttempts,
+		maxEventAge:        config.maxEventAge,
+		uppLogger:          config.UPPLogger,
 	}
 }
 
 func (logProcessor *logProcessor) Start() {
-	mutex := sync.Mutex{}
-	level := 0
-	levelUp := false
+	logProcessor.stopChan = make(chan struct{})
+	logProcessor.outChan = make(chan *message, logProcessor.chanBuffer)
+	logProcessor.ackChan = make(chan string, logProcessor.chanBuffer)
 
-	logProcessor.outChan = make(chan string, logProcessor.chanBuffer)
+	// with a concurrency limit, workers beyond the limit wait for their turn
+	for i := 0; i < logProcessor.forwardWorkers; i++ {
+		logProcessor.forwardWg.Add(1)
+		go func() {
+			defer logProcessor.forwardWg.Done()
+			b := &batcher{
+				in:       logProcessor.outChan,
+				size:     logProcessor.batchSize,
+				bytes:    logProcessor.batchBytes,
+				interval: logProcessor.batchInterval,
+			}
+			for batch := b.next(); len(batch) > 0; batch = b.next() {
+				if logProcessor.isDrainExpired() {
+					// out of time to deliver on shutdown, cache the rest again
+					for _, m := range batch {
+						logProcessor.Enqueue(m)
+					}
+					continue
+				}
+				atomic.AddInt64(&logProcessor.inFlight, int64(len(batch)))
+				split := len(batch) > 1
+				logProcessor.forwarder.forward(batch, func(m *message, err error) {
+					if logProcessor.settle(m, err, split) {
+						atomic.AddInt64(&logProcessor.inFlight, -1)
+					}
+				})
+			}
+		}()
+	}
 
+	logProcessor.isolateChan = make(chan *message, logProcessor.chanBuffer)
 	for i := 0; i < logProcessor.workers; i++ {
-		logProcessor.wg.Add(1)
+		logProcessor.isolateWg.Add(1)
 		go func() {
-			defer logProcessor.wg.Done()
-			for msg := range logProcessor.outChan {
-				logProcessor.forwarder.forward(msg, func(s string, err error) {
-					if err != nil {
-						// cache again and retry later
-						logProcessor.Enqueue(s)
-
-						mutex.Lock()
-						if level < maxBackoff {
-							levelUp = true
-						}
-						mutex.Unlock()
-					}
+			defer logProcessor.isolateWg.Done()
+			// the events are still in flight since their batch failed
+			for m := range logProcessor.isolateChan {
+				if logProcessor.isDrainExpired() {
+					logProcessor.Enqueue(m)
+					atomic.AddInt64(&logProcessor.inFlight, -1)
+					continue
+				}
+				logProcessor.forwarder.forward([]*message{m}, func(m *message, err error) {
+					logProcessor.settle(m, err, false)
+					atomic.AddInt64(&logProcessor.inFlight, -1)
 				})
 			}
 		}()
 	}
 
-	logProcessor.inChan = make(chan string, logProcessor.chanBuffer)
+	logProcessor.inChan = make(chan *message, logProcessor.chanBuffer)
 	for i := 0; i < logProcessor.workers; i++ {
-		logProcessor.wg.Add(1)
+		logProcessor.cacheWg.Add(1)
 		go func() {
-			defer logProcessor.wg.Done()
-			for msg := range logProcessor.inChan {
-				err := logProcessor.cache.Put(msg)
+			defer logProcessor.cacheWg.Done()
+			b := &batcher{
+				in:       logProcessor.inChan,
+				size:     logProcessor.cacheBatchSize,
+				bytes:    logProcessor.cacheBatchBytes,
+				interval: logProcessor.cacheBatchInterval,
+			}
+			for batch := b.next(); len(batch) > 0; batch = b.next() {
+				err := logProcessor.cache.Requeue(batch...)
 				if err != nil {
+					// the leases are kept and the messages are claimed again once they expire
 					logProcessor.uppLogger.Infof("Unexpected error when caching messages: %v\n", err)
+					logProcessor.lost(batch, err)
+					continue
+				}
+				atomic.AddInt64(&logProcessor.recached, int64(len(batch)))
+				for _, m := range batch {
+					logProcessor.ack(m)
 				}
 			}
 		}()
 	}
 
+	logProcessor.ackWg.Add(1)
 	go func() {
-		logProcessor.wg.Add(1)
-		defer logProcessor.wg.Done()
+		defer logProcessor.ackWg.Done()
+		logProcessor.ackLoop()
+	}()
+
+	logProcessor.readerWg.Add(1)
+	go func() {
+		defer logProcessor.readerWg.Done()
 		for !logProcessor.isStopped() {
+			if logProcessor.isHalted() || !logProcessor.isReady() {
+				time.Sleep(sleepTime * time.Millisecond)
+				continue
+			}
 			entries, err := logProcessor.Dequeue()
 			if err != nil {
 				logProcessor.uppLogger.Infof("Failure retrieving logs from S3 %v\n", err)
 			} else if len(entries) > 0 {
 				logProcessor.uppLogger.Infof("Read %v messages from S3\n", len(entries))
 			}
-			for _, entry := range entries {
-				mutex.Lock()
-				if levelUp {
-					if level < maxBackoff {
-						level++
+			for i, entry := range entries {
+				if !logProcessor.isReady() {
+					// the destination is failing or throttling, keep the rest cached until it recovers
+					for _, m := range entries[i:] {
+						logProcessor.Enqueue(m)
 					}
-					levelUp = false
-				} else if level > minBackoff {
-					level--
-				}
-				mutex.Unlock()
-				if level > 0 {
-					sleepDuration := time.Duration((0.2*math.Pow(2, float64(level))-0.2)*1000) * time.Millisecond
-
-					logProcessor.uppLogger.Infof("Sleeping for %v\n", sleepDuration)
-					time.Sleep(sleepDuration)
+					break
 				}
 				logProcessor.uppLogger.Infof("Sending document to channel")
 				prometheusTimer := prometheus.NewTimer(queueLatency)
-				logProcessor.outChan <- entry
+				if !logProcessor.send(entry) {
+					// stopping, the rest is claimed again once the leases expire
+					logProcessor.uppLogger.Infof("Left %v claimed messages to lease expiry on shutdown\n", len(entries)-i)
+					break
+				}
 				prometheusTimer.ObserveDuration()
 			}
 
@@ -138,25 +283,365 @@ func (logProcessor *logProcessor) Start() {
 	}()
 }
 
-func (logProcessor *logProcessor) Stop() {
+// Stop stops reading from the cache and drains the buffered and in-flight messages.
+// Messages that can not be delivered within the grace period are cached again, and
+// messages still waiting for the destination are claimed again when their lease expires.
+func (logProcessor *logProcessor) Stop(deadline time.Time) {
 	logProcessor.Lock()
 	logProcessor.stopped = true
 	logProcessor.Unlock()
+	// batches held back by a throttling destination are cached again rather than waited on
+	notifyStopping(logProcessor.forwarder)
 	logProcessor.uppLogger.Infof("Waiting buffered channel consumer to finish processing messages\n")
-	logProcessor.wg.Wait()
+	delivered := atomic.LoadInt64(&logProcessor.delivered)
+	recached := atomic.LoadInt64(&logProcessor.recached)
+
+	close(logProcessor.stopChan)
+	// a reader still waiting on the cache hands nothing over once outChan is closed
+	waitUntil(&logProcessor.readerWg, deadline)
+	logProcessor.outLock.Lock()
+	logProcessor.outClosed = true
 	close(logProcessor.outChan)
+	logProcessor.outLock.Unlock()
+	if !waitUntil(&logProcessor.forwardWg, deadline) {
+		// workers still waiting on the destination are not waited on, the batches
+		// still buffered are cached again
+		logProcessor.Lock()
+		logProcessor.drainExpired = true
+		logProcessor.Unlock()
+		for m := range logProcessor.outChan {
+			logProcessor.Enqueue(m)
+		}
+	}
+	for atomic.LoadInt64(&logProcessor.inFlight) > 0 && time.Now().Before(deadline) {
+		time.Sleep(sleepTime * time.Millisecond)
+	}
+	inFlight := atomic.LoadInt64(&logProcessor.inFlight)
+
+	// events still waiting to be retried on their own are cached again
+	logProcessor.Lock()
+	logProcessor.drainExpired = true
+	logProcessor.Unlock()
+	logProcessor.isolateLock.Lock()
+	logProcessor.isolateClosed = true
+	close(logProcessor.isolateChan)
+	logProcessor.isolateLock.Unlock()
+	waitUntil(&logProcessor.isolateWg, deadline)
+
+	logProcessor.inLock.Lock()
+	logProcessor.inClosed = true
 	close(logProcessor.inChan)
+	logProcessor.inLock.Unlock()
+	logProcessor.cacheWg.Wait()
+
+	logProcessor.ackLock.Lock()
+	logProcessor.ackClosed = true
+	close(logProcessor.ackChan)
+	logProcessor.ackLock.Unlock()
+	logProcessor.ackWg.Wait()
+	// the other replicas take over the shards of this one
+	if member, ok := logProcessor.cache.(Member); ok {
+		member.leave()
+	}
+
+	logProcessor.uppLogger.Infof("Drained messages on shutdown: %v delivered, %v cached again, %v left to lease expiry\n",
+		atomic.LoadInt64(&logProcessor.delivered)-delivered, atomic.LoadInt64(&logProcessor.recached)-recached, inFlight)
+}
+
+// settle acknowledges, caches again or quarantines an event according to the outcome of
+// its delivery, and tells whether the event is done with. When its batch may have been
+// rejected as a whole for a single bad event, i.e. as too large or badly formatted while
+// the destination takes other events, an event is retried on its own first, staying in
+// flight, so that its neighbours are not dead-lettered or quarantined along with it.
+func (logProcessor *logProcessor) settle(m *message, err error, split bool) bool {
+	now := time.Now()
+	if err == nil {
+		atomic.AddInt64(&logProcessor.delivered, 1)
+		atomic.StoreInt64(&logProcessor.lastDelivery, now.UnixNano())
+		logProcessor.ack(m)
+		return true
+	}
+	if split && rejectsBatch(err) && logProcessor.deliversLately(now) && logProcessor.isolate(m) {
+		return false
+	}
+	switch policyOf(err) {
+	case policyDiscard:
+		// already accounted for by the forwarder
+		logProcessor.ack(m)
+	case policyDeadLetter:
+		logProcessor.deadLetter(m, err)
+	case policyStop:
+		// keep the event cached until forwarding can resume
+		logProcessor.Enqueue(m)
+		logProcessor.halt(err)
+	default:
+		// events failed by an open circuit, or held back by the rate limits or a
+		// throttling destination, have not reached the destination
+		if err != errCircuitOpen && err != errRateLimited && err != errThrottled && logProcessor.failed(m, now) {
+			// don't let the event hold back the others
+			logProcessor.quarantine(m, err)
+			return true
+		}
+		// cache again and retry later
+		logProcessor.Enqueue(m)
+	}
+	return true
+}
+
+// isolate queues an event to be retried on its own, and tells whether it has been. Once
+// the queue is full, or the processor is out of time on shutdown, the event is not.
+func (logProcessor *logProcessor) isolate(m *message) bool {
+	logProcessor.isolateLock.RLock()
+	defer logProcessor.isolateLock.RUnlock()
+	if logProcessor.isolateClosed || logProcessor.isDrainExpired() {
+		return false
+	}
+	select {
+	case logProcessor.isolateChan <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+// Enqueue caches a message again. Once the processor is stopped the message is left
+// to its lease expiry.
+func (logProcessor *logProcessor) Enqueue(m *message) {
+	logProcessor.inLock.RLock()
+	defer logProcessor.inLock.RUnlock()
+	if !logProcessor.inClosed {
+		logProcessor.inChan <- m
+	}
+}
+
+// Submit sends an event to the workers, alongside the events read from the cache. Once the
+// processor is stopped the event is cached straight away, as it has no lease to fall back on.
+func (logProcessor *logProcessor) Submit(m *message) {
+	logProcessor.outLock.RLock()
+	defer logProcessor.outLock.RUnlock()
+	if !logProcessor.outClosed {
+		select {
+		case logProcessor.outChan <- m:
+			return
+		case <-logProcessor.stopChan:
+		}
+	}
+	if err := logProcessor.cache.Put(m.body); err != nil {
+		logProcessor.uppLogger.Errorf("Unexpected error when caching message received on shutdown: %v\n", err)
+		logProcessor.lost([]*message{m}, err)
+		return
+	}
+	if m.done != nil {
+		m.done()
+	}
 }
 
-func (logProcessor *logProcessor) Enqueue(s string) {
-	logProcessor.inChan <- s
+// lost accounts for the messages that failed to be cached and have nothing to fall back
+// on: they were received by the service rather than claimed with a lease, and their input
+// can not replay them as it is not waiting on them to be done
+func (logProcessor *logProcessor) lost(msgs []*message, err error) {
+	lost := 0
+	for _, m := range msgs {
+		if m.key == "" && m.done == nil {
+			lost++
+		}
+	}
+	if lost > 0 {
+		logProcessor.uppLogger.Errorf("Lost %v messages that could neither be delivered nor cached: %v\n", lost, err)
+		lostCounter.Add(float64(lost))
+	}
+}
+
+// send hands a message claimed from the cache over to the workers, and tells whether it
+// has been. Once the processor is stopping the message is left to its lease expiry.
+func (logProcessor *logProcessor) send(m *message) bool {
+	logProcessor.outLock.RLock()
+	defer logProcessor.outLock.RUnlock()
+	if logProcessor.outClosed || logProcessor.isStopped() {
+		return false
+	}
+	select {
+	case logProcessor.outChan <- m:
+		return true
+	case <-logProcessor.stopChan:
+		return false
+	}
+}
+
+func (logProcessor *logProcessor) Dequeue() ([]*message, error) {
+	return logProcessor.cache.Claim()
 }
 
-func (logProcessor *logProcessor) Dequeue() ([]string, error) {
-	return logProcessor.cache.ListAndDelete()
+// ack releases the cache lease of a message that has been delivered or cached again
+func (logProcessor *logProcessor) ack(m *message) {
+	if m.done != nil {
+		m.done()
+	}
+	if m.key == "" {
+		return
+	}
+	logProcessor.ackLock.RLock()
+	defer logProcessor.ackLock.RUnlock()
+	if !logProcessor.ackClosed {
+		logProcessor.ackChan <- m.key
+	}
 }
+
+// ackLoop acknowledges leases in bulk, as soon as a full batch of keys is available
+// or after a short delay
+func (logProcessor *logProcessor) ackLoop() {
+	keys := []string{}
+	ticker := time.NewTicker(ackBatchDelay)
+	defer ticker.Stop()
+	flush := func() {
+		if len(keys) == 0 {
+			return
+		}
+		if err := logProcessor.cache.Ack(keys...); err != nil {
+			// the messages will be delivered again once their leases expire
+			logProcessor.uppLogger.Infof("Unexpected error when acknowledging messages: %v\n", err)
+		}
+		keys = []string{}
+	}
+	for {
+		select {
+		case key, ok := <-logProcessor.ackChan:
+			if !ok {
+				flush()
+				return
+			}
+			keys = append(keys, key)
+			if len(keys) >= maxAckBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
 func (logProcessor *logProcessor) isStopped() bool {
 	logProcessor.Lock()
 	defer logProcessor.Unlock()
 	return logProcessor.stopped
 }
+
+// deadLetter sets aside an event rejected by the destination, or caches it again
+// if it can not be dead-lettered so that it is not lost
+func (logProcessor *logProcessor) deadLetter(m *message, reason error) {
+	logProcessor.uppLogger.Infof("Dead-lettering event rejected by the destination: %v\n", reason)
+	if err := logProcessor.cache.DeadLetter(m.body, reason); err != nil {
+		logProcessor.uppLogger.Infof("Unexpected error when dead-lettering message: %v\n", err)
+		logProcessor.Enqueue(m)
+		return
+	}
+	deadLetterCounter.Inc()
+	logProcessor.ack(m)
+}
+
+// halt stops reading from the cache after the destination has rejected events in a way
+// that retrying can not fix, e.g. a revoked token. It lasts until the service is restarted.
+func (logProcessor *logProcessor) halt(err error) {
+	logProcessor.Lock()
+	defer logProcessor.Unlock()
+	if !logProcessor.halted {
+		logProcessor.halted = true
+		logProcessor.uppLogger.Errorf("Forwarding stopped, events will stay cached until the service is restarted: %v\n", err)
+	}
+}
+
+func (logProcessor *logProcessor) isHalted() bool {
+	logProcessor.Lock()
+	defer logProcessor.Unlock()
+	return logProcessor.halted
+}
+
+// isReady tells whether the destination takes events, otherwise the events stay cached
+// rather than being claimed only to be cached again
+func (logProcessor *logProcessor) isReady() bool {
+	return takesEvents(logProcessor.forwarder)
+}
+
+// takesEvents tells whether the circuit breaker of a destination, if any, lets events
+// through and the destination has not asked to pause
+func takesEvents(forwarder Forwarder) bool {
+	if breaker, ok := forwarder.(Breaker); ok && !breaker.ready() {
+		return false
+	}
+	return !time.Now().Before(pausedUntilOf(forwarder))
+}
+
+func (logProcessor *logProcessor) isDrainExpired() bool {
+	logProcessor.Lock()
+	defer logProcessor.Unlock()
+	return logProcessor.drainExpired
+}
+
+// waitUntil waits for the wait group until the deadline and tells whether it is done
+func waitUntil(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
+
+// next blocks until a message is available and then keeps reading until the batch
+// is full or the batch interval has elapsed. It returns an empty batch once the
+// channel has been closed and drained.
+func (b *batcher) next() []*message {
+	var batch []*message
+	batchBytes := 0
+	if b.carry != nil {
+		batch = append(batch, b.carry)
+		batchBytes = len(b.carry.body)
+		b.carry = nil
+	} else {
+		msg, ok := <-b.in
+		if !ok {
+			return nil
+		}
+		batch = append(batch, msg)
+		batchBytes = len(msg.body)
+	}
+
+	timer := time.NewTimer(b.interval)
+	defer timer.Stop()
+	for len(batch) < b.size && !b.full(batchBytes) {
+		var msg *message
+		var ok bool
+		if b.interval > 0 {
+			select {
+			case msg, ok = <-b.in:
+			case <-timer.C:
+				return batch
+			}
+		} else {
+			select {
+			case msg, ok = <-b.in:
+			default:
+				return batch
+			}
+		}
+		if !ok {
+			return batch
+		}
+		if b.bytes > 0 && batchBytes+len(msg.body) > b.bytes {
+			b.carry = msg
+			return batch
+		}
+		batch = append(batch, msg)
+		batchBytes += len(msg.body)
+	}
+	return batch
+}
+
+func (b *batcher) full(batchBytes int) bool {
+	return b.bytes > 0 && batchBytes >= b.bytes
+}
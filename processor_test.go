@@ -1,10 +1,21 @@
 package main
 
 import (
-	"github.com/pkg/errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
 )
 
 type splunkClientMock struct {
@@ -14,11 +25,13 @@ type splunkClientMock struct {
 	latestError error
 }
 
-func (splunk *splunkClientMock) forward(s string, callback func(string, error)) {
-	if s == `{event:"127.0.0.1 - - [21/Apr/2015:12:15:34 +0000] \"GET /eom-file/all/e09b49d6-e1fa-11e4-bb7f-00144feab7de HTTP/1.1\" 200 53706 919 919"}` {
-		callback("test", nil)
-	} else if s == `{event:"simulated_retry"}` {
-		callback("test", errors.New("test-error"))
+func (splunk *splunkClientMock) forward(batch []*message, callback func(*message, error)) {
+	for _, m := range batch {
+		if m.body == `{event:"127.0.0.1 - - [21/Apr/2015:12:15:34 +0000] \"GET /eom-file/all/e09b49d6-e1fa-11e4-bb7f-00144feab7de HTTP/1.1\" 200 53706 919 919"}` {
+			callback(m, nil)
+		} else if m.body == `{event:"simulated_retry"}` {
+			callback(m, errors.New("test-error"))
+		}
 	}
 }
 
@@ -41,6 +54,467 @@ func Test_Processor(t *testing.T) {
 	time.Sleep(3 * time.Second)
 
 	go func() {
-		logProcessor.Stop()
+		logProcessor.Stop(time.Now().Add(config.gracePeriod))
 	}()
 }
+
+// eventually polls the condition until it holds or the timeout expires
+func eventually(condition func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+type rejectingForwarderMock struct {
+	Forwarder
+	err error
+}
+
+func (forwarder *rejectingForwarderMock) forward(batch []*message, callback func(*message, error)) {
+	for _, m := range batch {
+		callback(m, forwarder.err)
+	}
+}
+
+func Test_Processor_Halt(t *testing.T) {
+	s3 := &s3ServiceMock{}
+	forwarder := &rejectingForwarderMock{err: newHecError(403, hecResponse{Code: 4, Text: "Invalid token"})}
+	processor := NewLogProcessor(forwarder, s3, config).(*logProcessor)
+	processor.Start()
+
+	s3.Put(`{event:"revoked"}`)
+
+	assert.True(t, eventually(func() bool {
+		return processor.isHalted()
+	}, 3*time.Second))
+	assert.True(t, eventually(func() bool {
+		s3.RLock()
+		defer s3.RUnlock()
+		return len(s3.cache) == 1
+	}, 3*time.Second), "event should stay cached")
+
+	time.Sleep(300 * time.Millisecond)
+	s3.RLock()
+	defer s3.RUnlock()
+	assert.Len(t, s3.cache, 1, "halted processor should not read the cache")
+}
+
+func Test_Processor_DeadLetter(t *testing.T) {
+	s3 := &s3ServiceMock{}
+	forwarder := &rejectingForwarderMock{err: newHecError(400, hecResponse{Code: 7, Text: "Incorrect index"})}
+	processor := NewLogProcessor(forwarder, s3, config)
+	processor.Start()
+
+	s3.Put(`{event:"wrong index"}`)
+
+	assert.True(t, eventually(func() bool {
+		s3.RLock()
+		defer s3.RUnlock()
+		return len(s3.deadLetters) == 1 && len(s3.cache) == 0
+	}, 3*time.Second))
+}
+
+func Test_Processor_AcknowledgesLeases(t *testing.T) {
+	s3 := &s3ServiceMock{}
+	processor := NewLogProcessor(&splunkClientMock{}, s3, config)
+	processor.Start()
+
+	for i := 0; i < 10; i++ {
+		s3.Put(`{event:"127.0.0.1 - - [21/Apr/2015:12:15:34 +0000] \"GET /eom-file/all/e09b49d6-e1fa-11e4-bb7f-00144feab7de HTTP/1.1\" 200 53706 919 919"}`)
+	}
+	s3.Put(`{event:"simulated_error"}`)
+
+	// the failed event is acknowledged once it has been cached again
+	assert.True(t, eventually(func() bool {
+		return s3.getAcked() == 11
+	}, 5*time.Second))
+}
+
+func Test_Processor_Submit(t *testing.T) {
+	cache := newLeasingCacheMock(0)
+	forwarder := &slowForwarderMock{}
+	processor := NewLogProcessor(forwarder, cache, config)
+	processor.Start()
+
+	done := int32(0)
+	processor.Submit(&message{body: "received", done: func() { atomic.AddInt32(&done, 1) }})
+	assert.True(t, eventually(func() bool {
+		return atomic.LoadInt32(&done) == 1
+	}, 2*time.Second))
+	assert.Equal(t, []string{"received"}, forwarder.delivered)
+
+	processor.Stop(time.Now().Add(config.gracePeriod))
+	// events received after stopping go to the cache
+	processor.Submit(&message{body: "late"})
+	cache.Lock()
+	defer cache.Unlock()
+	assert.Equal(t, []string{"late"}, cache.pending)
+}
+
+func Test_Processor_CountsLostEvents(t *testing.T) {
+	forwarder := &rejectingForwarderMock{err: errors.New("connection refused")}
+	processor := NewLogProcessor(forwarder, &failingCacheMock{}, config)
+	processor.Start()
+	lost := testutil.ToFloat64(lostCounter)
+
+	// a leased or replayable event is claimed or read again later
+	processor.Submit(&message{body: "leased", key: "lease-1"})
+	processor.Submit(&message{body: "replayable", done: func() {}})
+	// a received event is not
+	processor.Submit(&message{body: "received"})
+
+	assert.True(t, eventually(func() bool {
+		return testutil.ToFloat64(lostCounter) == lost+1
+	}, 2*time.Second), "the event with nothing to fall back on should be counted lost")
+	processor.Stop(time.Now().Add(config.gracePeriod))
+	assert.Equal(t, lost+1, testutil.ToFloat64(lostCounter))
+}
+
+// leasingCacheMock hands out leases like the S3 cache does, so that tests can tell
+// whether a message is still cached, leased or gone
+type leasingCacheMock struct {
+	sync.Mutex
+	pending []string
+	leased  map[string]string
+	nextKey int
+	// events claimed at once, 20 by default
+	claimSize int
+}
+
+func (cache *leasingCacheMock) Claim() ([]*message, error) {
+	cache.Lock()
+	defer cache.Unlock()
+	n := len(cache.pending)
+	claimSize := cache.claimSize
+	if claimSize == 0 {
+		claimSize = 20
+	}
+	if n > claimSize {
+		n = claimSize
+	}
+	msgs := []*message{}
+	for _, body := range cache.pending[:n] {
+		cache.nextKey++
+		key := fmt.Sprintf("lease-%v", cache.nextKey)
+		cache.leased[key] = body
+		msgs = append(msgs, &message{body: body, key: key})
+	}
+	cache.pending = cache.pending[n:]
+	return msgs, nil
+}
+
+func (cache *leasingCacheMock) Ack(keys ...string) error {
+	cache.Lock()
+	defer cache.Unlock()
+	for _, key := range keys {
+		delete(cache.leased, key)
+	}
+	return nil
+}
+
+func (cache *leasingCacheMock) Put(objs ...string) error {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.pending = append(cache.pending, objs...)
+	return nil
+}
+
+func (cache *leasingCacheMock) Requeue(msgs ...*message) error {
+	for _, m := range msgs {
+		cache.Put(m.body)
+	}
+	return nil
+}
+
+func (cache *leasingCacheMock) DeadLetter(obj string, reason error) error {
+	return nil
+}
+
+func (cache *leasingCacheMock) getHealth() error {
+	return nil
+}
+
+// slowForwarderMock takes its time to deliver, and never answers when hanging,
+// like a destination that does not acknowledge events
+type slowForwarderMock struct {
+	Forwarder
+	sync.Mutex
+	delay     time.Duration
+	hang      bool
+	delivered []string
+}
+
+func (forwarder *slowForwarderMock) forward(batch []*message, callback func(*message, error)) {
+	time.Sleep(forwarder.delay)
+	if forwarder.hang {
+		return
+	}
+	for _, m := range batch {
+		forwarder.Lock()
+		forwarder.delivered = append(forwarder.delivered, m.body)
+		forwarder.Unlock()
+		callback(m, nil)
+	}
+}
+
+func assertNoMessageLost(t *testing.T, count int, cache *leasingCacheMock, forwarder *slowForwarderMock) {
+	cache.Lock()
+	defer cache.Unlock()
+	forwarder.Lock()
+	defer forwarder.Unlock()
+	found := map[string]bool{}
+	for _, body := range cache.pending {
+		found[body] = true
+	}
+	for _, body := range cache.leased {
+		found[body] = true
+	}
+	for _, body := range forwarder.delivered {
+		found[body] = true
+	}
+	for i := 0; i < count; i++ {
+		assert.True(t, found[fmt.Sprintf("event-%v", i)], "event-%v was lost", i)
+	}
+}
+
+func newLeasingCacheMock(count int) *leasingCacheMock {
+	cache := &leasingCacheMock{leased: map[string]string{}}
+	for i := 0; i < count; i++ {
+		cache.pending = append(cache.pending, fmt.Sprintf("event-%v", i))
+	}
+	return cache
+}
+
+func Test_Processor_StopMidFlight(t *testing.T) {
+	cache := newLeasingCacheMock(200)
+	forwarder := &slowForwarderMock{delay: 50 * time.Millisecond}
+	stopConfig := config
+	stopConfig.workers = 4
+	stopConfig.batchSize = 5
+	stopConfig.gracePeriod = 200 * time.Millisecond
+	processor := NewLogProcessor(forwarder, cache, stopConfig)
+	processor.Start()
+
+	time.Sleep(100 * time.Millisecond)
+	processor.Stop(time.Now().Add(stopConfig.gracePeriod))
+
+	assertNoMessageLost(t, 200, cache, forwarder)
+	// only the rest of the claim being handed over to the workers is left to its lease expiry
+	assert.True(t, len(cache.leased) <= 20, "buffered messages should have been delivered or cached again")
+	assert.NotEmpty(t, forwarder.delivered)
+	assert.NotEmpty(t, cache.pending)
+}
+
+func Test_Processor_StopWithUnacknowledgedMessages(t *testing.T) {
+	cache := newLeasingCacheMock(50)
+	forwarder := &slowForwarderMock{hang: true}
+	stopConfig := config
+	stopConfig.gracePeriod = 200 * time.Millisecond
+	processor := NewLogProcessor(forwarder, cache, stopConfig)
+	processor.Start()
+
+	time.Sleep(100 * time.Millisecond)
+	processor.Stop(time.Now().Add(stopConfig.gracePeriod))
+
+	assertNoMessageLost(t, 50, cache, forwarder)
+	assert.NotEmpty(t, cache.leased, "messages waiting for the destination are left to their lease expiry")
+}
+
+func Test_Processor_StopWithinDeadlineAfterLargeClaim(t *testing.T) {
+	cache := newLeasingCacheMock(20000)
+	cache.claimSize = 20000
+	forwarder := &slowForwarderMock{delay: 50 * time.Millisecond}
+	stopConfig := config
+	stopConfig.workers = 2
+	stopConfig.batchSize = 10
+	processor := NewLogProcessor(forwarder, cache, stopConfig)
+	processor.Start()
+
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	processor.Stop(start.Add(200 * time.Millisecond))
+
+	assert.True(t, time.Since(start) < time.Second, "stopping took %v", time.Since(start))
+	assertNoMessageLost(t, 20000, cache, forwarder)
+	cache.Lock()
+	defer cache.Unlock()
+	assert.NotEmpty(t, cache.leased, "claimed messages not handed over are left to their lease expiry")
+}
+
+// dirCacheMock keeps events as files under pending/ and leased/, and dirForwarderMock
+// delivers them as files under delivered/, so that what a killed process leaves behind
+// can be read
+type dirCacheMock struct {
+	dir string
+}
+
+func (cache *dirCacheMock) Claim() ([]*message, error) {
+	files, err := ioutil.ReadDir(filepath.Join(cache.dir, "pending"))
+	if err != nil {
+		return nil, err
+	}
+	msgs := []*message{}
+	for _, f := range files {
+		if len(msgs) == 20 {
+			break
+		}
+		if err := os.Rename(filepath.Join(cache.dir, "pending", f.Name()), filepath.Join(cache.dir, "leased", f.Name())); err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, &message{body: f.Name(), key: f.Name()})
+	}
+	return msgs, nil
+}
+
+func (cache *dirCacheMock) Ack(keys ...string) error {
+	for _, key := range keys {
+		if err := os.Remove(filepath.Join(cache.dir, "leased", key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cache *dirCacheMock) Put(objs ...string) error {
+	for _, body := range objs {
+		if err := ioutil.WriteFile(filepath.Join(cache.dir, "pending", body), nil, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cache *dirCacheMock) Requeue(msgs ...*message) error {
+	return cache.Put(bodies(msgs)...)
+}
+
+func (cache *dirCacheMock) DeadLetter(obj string, reason error) error {
+	return nil
+}
+
+func (cache *dirCacheMock) getHealth() error {
+	return nil
+}
+
+type dirForwarderMock struct {
+	Forwarder
+	dir string
+}
+
+func (forwarder *dirForwarderMock) forward(batch []*message, callback func(*message, error)) {
+	time.Sleep(50 * time.Millisecond)
+	for _, m := range batch {
+		callback(m, ioutil.WriteFile(filepath.Join(forwarder.dir, "delivered", m.body), nil, 0644))
+	}
+}
+
+func fileNames(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	return names
+}
+
+// Test_Processor_DrainHelper runs a processor in a process of its own for
+// Test_Processor_KilledMidFlight, until the process is signalled
+func Test_Processor_DrainHelper(t *testing.T) {
+	dir := os.Getenv("DRAIN_TEST_DIR")
+	if dir == "" {
+		t.Skip("only run by Test_Processor_KilledMidFlight")
+	}
+	drainConfig := config
+	drainConfig.workers = 4
+	drainConfig.batchSize = 5
+	processor := NewLogProcessor(&dirForwarderMock{dir: dir}, &dirCacheMock{dir: dir}, drainConfig)
+	processor.Start()
+	waitForSignal()
+	processor.Stop(time.Now().Add(200 * time.Millisecond))
+}
+
+func Test_Processor_KilledMidFlight(t *testing.T) {
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL} {
+		dir, err := ioutil.TempDir("", "drain")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+		for _, sub := range []string{"pending", "leased", "delivered"} {
+			assert.NoError(t, os.Mkdir(filepath.Join(dir, sub), 0755))
+		}
+		cache := &dirCacheMock{dir: dir}
+		for i := 0; i < 200; i++ {
+			assert.NoError(t, cache.Put(fmt.Sprintf("event-%v", i)))
+		}
+
+		cmd := exec.Command(os.Args[0], "-test.run=^Test_Processor_DrainHelper$")
+		cmd.Env = append(os.Environ(), "DRAIN_TEST_DIR="+dir)
+		assert.NoError(t, cmd.Start())
+		assert.True(t, eventually(func() bool {
+			return len(fileNames(t, filepath.Join(dir, "delivered"))) > 0
+		}, 5*time.Second))
+		assert.NoError(t, cmd.Process.Signal(sig))
+		err = cmd.Wait()
+		if sig == syscall.SIGTERM {
+			assert.NoError(t, err, "the process should exit by itself once drained")
+		}
+
+		// events left leased by a killed process are claimed again once their lease expires
+		found := map[string]bool{}
+		for _, sub := range []string{"pending", "leased", "delivered"} {
+			for _, name := range fileNames(t, filepath.Join(dir, sub)) {
+				found[name] = true
+			}
+		}
+		for i := 0; i < 200; i++ {
+			assert.True(t, found[fmt.Sprintf("event-%v", i)], "event-%v was lost on %v", i, sig)
+		}
+		if sig == syscall.SIGTERM {
+			// only the rest of the claim being handed over to the workers is left to its lease expiry
+			assert.True(t, len(fileNames(t, filepath.Join(dir, "leased"))) <= 20, "buffered messages should have been delivered or cached again before exiting")
+		}
+	}
+}
+
+func Test_Batcher_Size(t *testing.T) {
+	in := make(chan *message, 10)
+	for _, m := range messages("1", "2", "3", "4", "5") {
+		in <- m
+	}
+	close(in)
+	b := &batcher{in: in, size: 2, interval: time.Second}
+
+	assert.Len(t, b.next(), 2)
+	assert.Len(t, b.next(), 2)
+	assert.Len(t, b.next(), 1)
+	assert.Empty(t, b.next())
+}
+
+func Test_Batcher_Bytes(t *testing.T) {
+	in := make(chan *message, 10)
+	for _, m := range messages("aaaa", "bbbb", "cccccccc") {
+		in <- m
+	}
+	close(in)
+	b := &batcher{in: in, size: 10, bytes: 10, interval: time.Second}
+
+	assert.Equal(t, "aaaa\nbbbb", joinBodies(b.next()))
+	assert.Equal(t, "cccccccc", joinBodies(b.next()))
+	assert.Empty(t, b.next())
+}
+
+func Test_Batcher_Interval(t *testing.T) {
+	in := make(chan *message, 10)
+	in <- &message{body: "event"}
+	b := &batcher{in: in, size: 10, interval: 10 * time.Millisecond}
+
+	start := time.Now()
+	assert.Equal(t, "event", joinBodies(b.next()))
+	assert.True(t, time.Since(start) >= 10*time.Millisecond)
+	close(in)
+}
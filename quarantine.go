@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	quarantineSuffix = "-quarantine"
+	// object metadata carrying the failed attempts of the events of an object
+	attemptsMetadata  = "attempts"
+	firstSeenMetadata = "first-seen"
+	// events only count as failing on their own while the destination takes other events
+	poisonWindow = time.Minute
+)
+
+var quarantinedCounter prometheus.Counter
+
+// quarantineError sets aside an event that keeps failing while other events get through,
+// e.g. one too large for the destination
+type quarantineError struct {
+	attempts  int
+	firstSeen time.Time
+	cause     error
+}
+
+func (e *quarantineError) Error() string {
+	return fmt.Sprintf("failed %v times since %v: %v", e.attempts, e.firstSeen.UTC().Format(time.RFC3339), e.cause)
+}
+
+// failed counts a failed attempt to deliver an event, and tells whether the event should
+// be quarantined. Attempts made while the destination takes no event at all, e.g. during
+// an outage, are not counted so that an outage does not quarantine the whole cache.
+func (logProcessor *logProcessor) failed(m *message, now time.Time) bool {
+	if !logProcessor.deliversLately(now) {
+		return false
+	}
+	m.attempts++
+	if m.firstSeen.IsZero() {
+		m.firstSeen = now
+	}
+	return (logProcessor.maxAttempts > 0 && m.attempts >= logProcessor.maxAttempts) ||
+		(logProcessor.maxEventAge > 0 && now.Sub(m.firstSeen) >= logProcessor.maxEventAge)
+}
+
+// deliversLately tells whether the destination has taken events within the poison window
+func (logProcessor *logProcessor) deliversLately(now time.Time) bool {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&logProcessor.lastDelivery))) <= poisonWindow
+}
+
+// quarantine stores an event that keeps failing under the quarantine prefix, or caches it
+// again if it can not be quarantined so that it is not lost
+func (logProcessor *logProcessor) quarantine(m *message, cause error) {
+	reason := &quarantineError{attempts: m.attempts, firstSeen: m.firstSeen, cause: cause}
+	logProcessor.uppLogger.Errorf("Quarantining event that %v\n", reason)
+	if err := logProcessor.cache.DeadLetter(m.body, reason); err != nil {
+		logProcessor.uppLogger.Infof("Unexpected error when quarantining message: %v\n", err)
+		logProcessor.Enqueue(m)
+		return
+	}
+	quarantinedCounter.Inc()
+	logProcessor.ack(m)
+}
+
+// attemptsOf returns the object metadata recording the failed attempts of events
+func attemptsOf(attempts int, firstSeen time.Time) map[string]*string {
+	metadata := map[string]*string{attemptsMetadata: aws.String(strconv.Itoa(attempts))}
+	// events that have not failed yet, or only been held back, have no first failure
+	if !firstSeen.IsZero() {
+		metadata[firstSeenMetadata] = aws.String(firstSeen.UTC().Format(time.RFC3339Nano))
+	}
+	return metadata
+}
+
+// parseAttempts reads the failed attempts from object metadata. Objects cached before
+// attempts were counted have none.
+func parseAttempts(metadata map[string]*string) (int, time.Time) {
+	attempts, firstSeen := 0, time.Time{}
+	// S3 returns metadata keys in canonical header form
+	for key, value := range metadata {
+		switch {
+		case strings.EqualFold(key, attemptsMetadata):
+			attempts, _ = strconv.Atoi(aws.StringValue(value))
+		case strings.EqualFold(key, firstSeenMetadata):
+			firstSeen, _ = time.Parse(time.RFC3339Nano, aws.StringValue(value))
+		}
+	}
+	return attempts, firstSeen
+}
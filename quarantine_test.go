@@ -0,0 +1,216 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// requeueingCacheMock keeps the failed attempts of the messages it caches
+type requeueingCacheMock struct {
+	s3ServiceMock
+	lock        sync.Mutex
+	requeued    []*message
+	quarantined []error
+}
+
+func (cache *requeueingCacheMock) Claim() ([]*message, error) {
+	msgs, _ := cache.s3ServiceMock.Claim()
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	msgs = append(msgs, cache.requeued...)
+	cache.requeued = nil
+	return msgs, nil
+}
+
+func (cache *requeueingCacheMock) Requeue(msgs ...*message) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for _, m := range msgs {
+		cache.requeued = append(cache.requeued, &message{body: m.body, attempts: m.attempts, firstSeen: m.firstSeen})
+	}
+	return nil
+}
+
+func (cache *requeueingCacheMock) DeadLetter(obj string, reason error) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.quarantined = append(cache.quarantined, reason)
+	return nil
+}
+
+func (cache *requeueingCacheMock) getQuarantined() []error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return append([]error{}, cache.quarantined...)
+}
+
+// poisonForwarderMock fails to deliver the events marked as poison, and delivers the others
+type poisonForwarderMock struct {
+	Forwarder
+	attempts int64
+}
+
+func (forwarder *poisonForwarderMock) forward(batch []*message, callback func(*message, error)) {
+	for _, m := range batch {
+		if strings.Contains(m.body, "poison") {
+			atomic.AddInt64(&forwarder.attempts, 1)
+			callback(m, newHecError(500, hecResponse{Code: 8, Text: "Internal server error"}))
+		} else {
+			callback(m, nil)
+		}
+	}
+}
+
+func Test_Quarantine_AfterMaxAttempts(t *testing.T) {
+	cache := &requeueingCacheMock{}
+	forwarder := &poisonForwarderMock{}
+	quarantineConfig := config
+	quarantineConfig.maxAttempts = 3
+	processor := NewLogProcessor(forwarder, cache, quarantineConfig)
+	processor.Start()
+	defer processor.Stop(time.Now())
+
+	cache.Put(`{event:"ok"}`, `{event:"poison"}`)
+
+	assert.True(t, eventually(func() bool {
+		return len(cache.getQuarantined()) == 1
+	}, 5*time.Second))
+	reason, ok := cache.getQuarantined()[0].(*quarantineError)
+	assert.True(t, ok)
+	assert.Equal(t, 3, reason.attempts)
+	assert.Equal(t, int64(3), atomic.LoadInt64(&forwarder.attempts), "a batch failing for another reason than its events should not be split")
+}
+
+// batchRejectingForwarderMock rejects every batch holding a poison event as a whole
+type batchRejectingForwarderMock struct {
+	Forwarder
+	lock      sync.Mutex
+	delivered []string
+}
+
+func (forwarder *batchRejectingForwarderMock) forward(batch []*message, callback func(*message, error)) {
+	for _, m := range batch {
+		if strings.Contains(m.body, "poison") {
+			for _, m := range batch {
+				callback(m, &sinkError{status: 413, text: "Content too large", policy: policyRetry})
+			}
+			return
+		}
+	}
+	forwarder.lock.Lock()
+	for _, m := range batch {
+		forwarder.delivered = append(forwarder.delivered, m.body)
+	}
+	forwarder.lock.Unlock()
+	for _, m := range batch {
+		callback(m, nil)
+	}
+}
+
+func (forwarder *batchRejectingForwarderMock) getDelivered() []string {
+	forwarder.lock.Lock()
+	defer forwarder.lock.Unlock()
+	return append([]string{}, forwarder.delivered...)
+}
+
+func Test_Quarantine_OnlyTheEventFailingItsBatch(t *testing.T) {
+	cache := &requeueingCacheMock{}
+	forwarder := &batchRejectingForwarderMock{}
+	quarantineConfig := config
+	quarantineConfig.maxAttempts = 2
+	processor := NewLogProcessor(forwarder, cache, quarantineConfig).(*logProcessor)
+	// as if the destination had taken other events lately
+	processor.lastDelivery = time.Now().UnixNano()
+	processor.Start()
+	defer processor.Stop(time.Now())
+
+	cache.Put(`{event:"a"}`, `{event:"poison"}`, `{event:"b"}`)
+
+	assert.True(t, eventually(func() bool {
+		return len(cache.getQuarantined()) == 1
+	}, 5*time.Second))
+	assert.ElementsMatch(t, []string{`{event:"a"}`, `{event:"b"}`}, forwarder.getDelivered())
+	reason, ok := cache.getQuarantined()[0].(*quarantineError)
+	assert.True(t, ok)
+	assert.Equal(t, 2, reason.attempts)
+}
+
+func Test_Quarantine_NotDuringOutage(t *testing.T) {
+	processor := &logProcessor{maxAttempts: 1}
+	m := &message{body: "a"}
+
+	assert.False(t, processor.failed(m, time.Now()), "nothing has been delivered lately")
+	assert.Equal(t, 0, m.attempts)
+
+	processor.lastDelivery = time.Now().UnixNano()
+	assert.True(t, processor.failed(m, time.Now()))
+	assert.Equal(t, 1, m.attempts)
+}
+
+func Test_Quarantine_AfterMaxAge(t *testing.T) {
+	now := time.Now()
+	processor := &logProcessor{maxEventAge: time.Hour, lastDelivery: now.UnixNano()}
+
+	assert.False(t, processor.failed(&message{body: "a", attempts: 50}, now))
+	assert.True(t, processor.failed(&message{body: "a", firstSeen: now.Add(-2 * time.Hour)}, now))
+}
+
+func Test_Quarantine_S3KeepsAttempts(t *testing.T) {
+	s3InterfaceMock := newMemoryS3Interface()
+	s3service := &s3Service{
+		bucketName:   "test-bucket",
+		prefix:       "test-prefix",
+		svc:          s3InterfaceMock,
+		leaseTimeout: time.Minute,
+		packing:      packing{size: 10},
+	}
+	firstSeen := time.Now().Add(-time.Hour).Round(time.Millisecond)
+
+	assert.NoError(t, s3service.Requeue(
+		&message{body: "a", attempts: 2, firstSeen: firstSeen},
+		&message{body: "b", attempts: 5, firstSeen: firstSeen},
+		&message{body: "c", attempts: 2, firstSeen: firstSeen.Add(time.Minute)},
+	))
+	assert.Len(t, s3InterfaceMock.keys(), 2, "events should be packed by attempts")
+	// events that have not been tried, or only held back, have not failed yet
+	assert.NoError(t, s3service.Put("d"))
+	assert.NoError(t, s3service.Requeue(&message{body: "e"}))
+
+	result, err := s3service.Claim()
+	assert.NoError(t, err)
+	attempts := map[string]int{}
+	for _, m := range result {
+		attempts[m.body] = m.attempts
+		if m.body == "d" || m.body == "e" {
+			assert.True(t, m.firstSeen.IsZero(), m.body)
+		} else {
+			assert.True(t, firstSeen.Equal(m.firstSeen), m.body)
+		}
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 5, "c": 2, "d": 0, "e": 0}, attempts)
+
+	cause := errors.New("test-error")
+	assert.NoError(t, s3service.DeadLetter("b", &quarantineError{attempts: 5, firstSeen: firstSeen, cause: cause}))
+	quarantined := []string{}
+	for _, key := range s3InterfaceMock.keys() {
+		if strings.HasPrefix(key, "test-prefix"+quarantineSuffix+"/") {
+			quarantined = append(quarantined, key)
+		}
+	}
+	assert.Len(t, quarantined, 1)
+	n, seen := parseAttempts(s3InterfaceMock.metadata[quarantined[0]])
+	assert.Equal(t, 5, n)
+	assert.True(t, firstSeen.Equal(seen))
+}
+
+func Test_ValidateParamsQuarantine(t *testing.T) {
+	quarantineConfig := config
+	quarantineConfig.maxAttempts = -1
+	assert.Error(t, validateParams(quarantineConfig))
+}
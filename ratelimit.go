@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errRateLimited = errors.New("rate limit exceeded")
+
+var (
+	rateLimitedSecondsCounter *prometheus.CounterVec
+	rateLimitSpilledCounter   *prometheus.CounterVec
+)
+
+// rateLimit is a number of events and bytes per second, zero meaning unlimited
+type rateLimit struct {
+	events int
+	bytes  int
+}
+
+// parseIndexRateLimits reads the limits of --index-rate-limits, given as
+// <index>=<events per second>:<bytes per second>
+func parseIndexRateLimits(limits []string) (map[string]rateLimit, error) {
+	parsed := map[string]rateLimit{}
+	for _, limit := range limits {
+		parts := strings.SplitN(limit, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("index rate limit %q must be <index>=<events per second>:<bytes per second>", limit)
+		}
+		rates := strings.SplitN(parts[1], ":", 2)
+		if len(rates) != 2 {
+			return nil, fmt.Errorf("index rate limit %q must be <index>=<events per second>:<bytes per second>", limit)
+		}
+		events, err := strconv.Atoi(rates[0])
+		if err != nil || events < 0 {
+			return nil, fmt.Errorf("index rate limit %q must have a number of events", limit)
+		}
+		bytes, err := strconv.Atoi(rates[1])
+		if err != nil || bytes < 0 {
+			return nil, fmt.Errorf("index rate limit %q must have a number of bytes", limit)
+		}
+		parsed[parts[0]] = rateLimit{events: events, bytes: bytes}
+	}
+	return parsed, nil
+}
+
+// tokenBucket holds up to a second worth of tokens. Tokens may be taken beyond those
+// available, the debt being paid off before any more can be taken.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	if rate == 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// delay returns how long taking n tokens would have to wait. A full bucket lets any number
+// of tokens through, so that events larger than a second worth of tokens are not held
+// back forever.
+func (b *tokenBucket) delay(n int, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	if b.tokens >= b.rate {
+		return 0
+	}
+	if missing := float64(n) - b.tokens; missing > 0 {
+		return time.Duration(missing / b.rate * float64(time.Second))
+	}
+	return 0
+}
+
+func (b *tokenBucket) take(n int, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.refill(now)
+	b.tokens -= float64(n)
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+		b.last = now
+	}
+}
+
+// rateBuckets limits both events and bytes
+type rateBuckets struct {
+	events *tokenBucket
+	bytes  *tokenBucket
+}
+
+func newRateBuckets(limit rateLimit, now time.Time) rateBuckets {
+	return rateBuckets{events: newTokenBucket(limit.events, now), bytes: newTokenBucket(limit.bytes, now)}
+}
+
+func (b rateBuckets) delay(events int, bytes int, now time.Time) time.Duration {
+	d := b.events.delay(events, now)
+	if bytesDelay := b.bytes.delay(bytes, now); bytesDelay > d {
+		d = bytesDelay
+	}
+	return d
+}
+
+func (b rateBuckets) take(events int, bytes int, now time.Time) {
+	b.events.take(events, now)
+	b.bytes.take(bytes, now)
+}
+
+// rateLimiter holds batches back until they fit within the limits of the destination,
+// overall and for the index of their events. Events that would wait longer than maxWait
+// are spilled to the cache instead, and no more events are read from the cache until
+// the spilled ones would fit.
+type rateLimiter struct {
+	sync.Mutex
+	name    string
+	now     func() time.Time
+	sleep   func(time.Duration)
+	maxWait time.Duration
+	global  rateBuckets
+	indexes map[string]rateBuckets
+	// until when spilled events would still wait longer than maxWait
+	spilledUntil time.Time
+}
+
+func newRateLimiter(name string, config appConfig, indexLimits map[string]rateLimit, now func() time.Time, sleep func(time.Duration)) *rateLimiter {
+	if rateLimitedSecondsCounter == nil {
+		rateLimitedSecondsCounter = registerCounterVec("rate_limited_seconds", "Time in seconds batches have waited for the rate limits by destination", "destination")
+		rateLimitSpilledCounter = registerCounterVec("rate_limit_spilled_count", "Number of messages cached again rather than waiting for the rate limits by destination", "destination")
+	}
+	start := now()
+	indexes := map[string]rateBuckets{}
+	for index, limit := range indexLimits {
+		indexes[index] = newRateBuckets(limit, start)
+	}
+	return &rateLimiter{
+		name:    name,
+		now:     now,
+		sleep:   sleep,
+		maxWait: config.rateLimitMaxWait,
+		global:  newRateBuckets(rateLimit{events: config.rateLimitEvents, bytes: config.rateLimitBytes}, start),
+		indexes: indexes,
+	}
+}
+
+// take waits until a batch fits within the limits, and returns the events that can be
+// sent and those to spill
+func (l *rateLimiter) take(batch []*message) ([]*message, []*message) {
+	l.Lock()
+	now := l.now()
+	allowed, spilled := []*message{}, []*message{}
+	groups := l.byIndex(batch)
+	for index, group := range groups {
+		if d := l.indexes[index].delay(len(group), bodyBytes(group), now); d > l.maxWait {
+			l.spill(now.Add(d - l.maxWait))
+			spilled = append(spilled, group...)
+			delete(groups, index)
+			continue
+		}
+		allowed = append(allowed, group...)
+	}
+	if d := l.global.delay(len(allowed), bodyBytes(allowed), now); d > l.maxWait {
+		l.spill(now.Add(d - l.maxWait))
+		l.Unlock()
+		return nil, batch
+	}
+	wait := l.global.delay(len(allowed), bodyBytes(allowed), now)
+	l.global.take(len(allowed), bodyBytes(allowed), now)
+	for index, group := range groups {
+		if d := l.indexes[index].delay(len(group), bodyBytes(group), now); d > wait {
+			wait = d
+		}
+		l.indexes[index].take(len(group), bodyBytes(group), now)
+	}
+	l.Unlock()
+
+	if wait > 0 {
+		rateLimitedSecondsCounter.WithLabelValues(l.name).Add(wait.Seconds())
+		l.sleep(wait)
+	}
+	return allowed, spilled
+}
+
+// spill records until when spilled events would wait too long, the lock being held
+func (l *rateLimiter) spill(until time.Time) {
+	if until.After(l.spilledUntil) {
+		l.spilledUntil = until
+	}
+}
+
+// pausedUntil tells until when events would be spilled again
+func (l *rateLimiter) pausedUntil() time.Time {
+	l.Lock()
+	defer l.Unlock()
+	return l.spilledUntil
+}
+
+// byIndex groups the events of a batch by the index of their HEC envelope, when indexes
+// are limited. Events without an index are only limited overall.
+func (l *rateLimiter) byIndex(batch []*message) map[string][]*message {
+	groups := map[string][]*message{}
+	if len(l.indexes) == 0 {
+		groups[""] = batch
+		return groups
+	}
+	for _, m := range batch {
+		envelope := struct {
+			Index string `json:"index"`
+		}{}
+		json.Unmarshal([]byte(m.body), &envelope)
+		groups[envelope.Index] = append(groups[envelope.Index], m)
+	}
+	return groups
+}
+
+func bodyBytes(batch []*message) int {
+	n := 0
+	for _, m := range batch {
+		n += len(m.body)
+	}
+	return n
+}
+
+// rateLimitedForwarder sends to a forwarder within the rate limits of its destination
+type rateLimitedForwarder struct {
+	Forwarder
+	limiter *rateLimiter
+}
+
+// withRateLimit holds batches back to the rate limits of a destination, unless no limit is set
+func withRateLimit(name string, forwarder Forwarder, config appConfig) Forwarder {
+	indexLimits, _ := parseIndexRateLimits(config.indexRateLimits)
+	if config.rateLimitEvents == 0 && config.rateLimitBytes == 0 && len(indexLimits) == 0 {
+		return forwarder
+	}
+	return &rateLimitedForwarder{Forwarder: forwarder, limiter: newRateLimiter(name, config, indexLimits, time.Now, time.Sleep)}
+}
+
+func (f *rateLimitedForwarder) stopping() {
+	notifyStopping(f.Forwarder)
+}
+
+// pausedUntil tells until when the destination is paused, or events would be spilled,
+// so that events are not claimed from the cache only to be cached again
+func (f *rateLimitedForwarder) pausedUntil() time.Time {
+	until := f.limiter.pausedUntil()
+	if paused := pausedUntilOf(f.Forwarder); paused.After(until) {
+		return paused
+	}
+	return until
+}
+
+func (f *rateLimitedForwarder) forward(batch []*message, callback func(*message, error)) {
+	allowed, spilled := f.limiter.take(batch)
+	if len(spilled) > 0 {
+		rateLimitSpilledCounter.WithLabelValues(f.limiter.name).Add(float64(len(spilled)))
+		for _, m := range spilled {
+			callback(m, errRateLimited)
+		}
+	}
+	if len(allowed) > 0 {
+		f.Forwarder.forward(allowed, callback)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newRateLimiterMock(t *testing.T, events int, bytes int, indexLimits string, clock *fakeClock, slept *[]time.Duration) *rateLimiter {
+	rateConfig := config
+	rateConfig.rateLimitEvents = events
+	rateConfig.rateLimitBytes = bytes
+	rateConfig.rateLimitMaxWait = time.Second
+	limits, err := parseIndexRateLimits(splitList(indexLimits))
+	assert.NoError(t, err)
+	return newRateLimiter("test", rateConfig, limits, clock.now, func(d time.Duration) {
+		*slept = append(*slept, d)
+		clock.t = clock.t.Add(d)
+	})
+}
+
+func bodies(msgs []*message) []string {
+	result := []string{}
+	for _, m := range msgs {
+		result = append(result, m.body)
+	}
+	return result
+}
+
+func Test_RateLimit_Events(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	slept := []time.Duration{}
+	l := newRateLimiterMock(t, 10, 0, "", clock, &slept)
+
+	allowed, spilled := l.take(messages("1", "2", "3", "4", "5", "6", "7", "8", "9", "10"))
+	assert.Len(t, allowed, 10)
+	assert.Empty(t, spilled)
+	assert.Empty(t, slept, "a second worth of events should go straight away")
+
+	allowed, spilled = l.take(messages("11", "12", "13", "14", "15"))
+	assert.Len(t, allowed, 5)
+	assert.Empty(t, spilled)
+	assert.Equal(t, []time.Duration{500 * time.Millisecond}, slept)
+
+	// more than the longest wait
+	allowed, spilled = l.take(messages("16", "17", "18", "19", "20", "21", "22", "23", "24", "25", "26", "27", "28", "29", "30", "31"))
+	assert.Empty(t, allowed)
+	assert.Len(t, spilled, 16)
+	assert.Len(t, slept, 1)
+	assert.Equal(t, clock.t.Add(600*time.Millisecond), l.pausedUntil(), "until the spilled events would wait no longer than the longest wait")
+}
+
+func Test_RateLimit_Bytes(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	slept := []time.Duration{}
+	l := newRateLimiterMock(t, 0, 100, "", clock, &slept)
+
+	// events larger than a second worth of bytes are not held back forever
+	allowed, _ := l.take(messages(string(make([]byte, 150))))
+	assert.Len(t, allowed, 1)
+
+	allowed, spilled := l.take(messages(string(make([]byte, 60))))
+	assert.Empty(t, allowed)
+	assert.Len(t, spilled, 1)
+
+	clock.t = clock.t.Add(time.Second)
+	allowed, _ = l.take(messages(string(make([]byte, 60))))
+	assert.Len(t, allowed, 1)
+	assert.Equal(t, []time.Duration{100 * time.Millisecond}, slept)
+}
+
+func Test_RateLimit_Index(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	slept := []time.Duration{}
+	l := newRateLimiterMock(t, 0, 0, "audit=1:0", clock, &slept)
+	audit := `{"event":"a","index":"audit"}`
+	other := `{"event":"m","index":"main"}`
+
+	allowed, spilled := l.take(messages(audit, other))
+	assert.Len(t, allowed, 2)
+	assert.Empty(t, spilled)
+
+	allowed, spilled = l.take(messages(audit, audit, other, "plain"))
+	assert.ElementsMatch(t, []string{other, "plain"}, bodies(allowed))
+	assert.Equal(t, []string{audit, audit}, bodies(spilled))
+}
+
+func Test_RateLimit_SpillsToTheCache(t *testing.T) {
+	rateConfig := config
+	rateConfig.rateLimitEvents = 1
+	forwarder := withRateLimit("test", &rejectingForwarderMock{}, rateConfig)
+
+	results := collectResults(forwarder, messages("a", "b", "c"))
+	assert.NoError(t, results["a"])
+	results = collectResults(forwarder, messages("d"))
+	assert.Equal(t, errRateLimited, results["d"])
+	assert.False(t, takesEvents(forwarder), "events should stay cached until the spilled ones would fit")
+}
+
+func Test_ParseIndexRateLimits(t *testing.T) {
+	limits, err := parseIndexRateLimits([]string{"main=500:1048576", "audit=0:1024"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]rateLimit{"main": {events: 500, bytes: 1048576}, "audit": {bytes: 1024}}, limits)
+
+	for _, invalid := range []string{"main", "=1:1", "main=1", "main=x:1", "main=1:-1"} {
+		_, err := parseIndexRateLimits([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+
+	rateConfig := config
+	rateConfig.indexRateLimits = []string{"main=1"}
+	assert.Error(t, validateParams(rateConfig))
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+)
+
+// replayOptions selects the cached objects to replay and what to do with them
+type replayOptions struct {
+	// objects cached from, inclusive, until, exclusive
+	from       time.Time
+	to         time.Time
+	index      string
+	batchSize  int
+	dryRun     bool
+	keepSource bool
+}
+
+// replayStats counts the objects replayed, or that would be replayed on a dry run, and
+// the bytes of their events, uncompressed
+type replayStats struct {
+	objects int
+	events  int
+	bytes   int64
+}
+
+// replayCommand sends the events cached under a prefix within a time window to a HEC URL,
+// e.g. to send them again to another index after an incident. The S3 options are those
+// of the service.
+func replayCommand(cmd *cli.Cmd, baseConfig func() appConfig) {
+	prefix := cmd.String(cli.StringOpt{
+		Name:  "prefix",
+		Value: "",
+		Desc:  "Prefix of the objects to replay, e.g. <env>-dlq or <env>-quarantine, defaults to --env",
+	})
+	from := cmd.String(cli.StringOpt{
+		Name:  "from",
+		Value: "",
+		Desc:  "Time (RFC3339) of the oldest objects to replay, from the oldest when empty",
+	})
+	to := cmd.String(cli.StringOpt{
+		Name:  "to",
+		Value: "",
+		Desc:  "Time (RFC3339) up to which objects are replayed, until now when empty",
+	})
+	fwdURL := cmd.String(cli.StringOpt{
+		Name:  "url",
+		Value: "",
+		Desc:  "The HEC url to send the events to",
+	})
+	token := cmd.String(cli.StringOpt{
+		Name:   "token",
+		Value:  "",
+		Desc:   "HEC Authorization token",
+		EnvVar: "REPLAY_TOKEN",
+	})
+	index := cmd.String(cli.StringOpt{
+		Name:  "index",
+		Value: "",
+		Desc:  "Index to send the events to, instead of the index of their HEC envelope, unchanged when empty",
+	})
+	rateLimitEvents := cmd.Int(cli.IntOpt{
+		Name:  "rate-limit-events",
+		Value: 0,
+		Desc:  "Number of events per second sent at most, 0 for no limit",
+	})
+	rateLimitBytes := cmd.Int(cli.IntOpt{
+		Name:  "rate-limit-bytes",
+		Value: 0,
+		Desc:  "Number of bytes of events per second sent at most, 0 for no limit",
+	})
+	dryRun := cmd.Bool(cli.BoolOpt{
+		Name:  "dry-run",
+		Value: false,
+		Desc:  "List the objects that would be replayed without sending or deleting anything",
+	})
+	keepSource := cmd.Bool(cli.BoolOpt{
+		Name:  "keep-source",
+		Value: false,
+		Desc:  "Keep the replayed objects instead of deleting them once their events have been delivered",
+	})
+
+	cmd.Action = func() {
+		config := baseConfig()
+		config.fwdURL = *fwdURL
+		config.token = *token
+		config.rateLimitEvents = *rateLimitEvents
+		config.rateLimitBytes = *rateLimitBytes
+		// replaying is not in a hurry, batches wait for the rate limits rather than failing
+		config.rateLimitMaxWait = time.Hour
+		if *prefix == "" {
+			*prefix = config.env
+		}
+		opts, err := parseReplayOptions(*from, *to, time.Now())
+		if err != nil {
+			config.UPPLogger.Fatal(err)
+		}
+		opts.index = *index
+		opts.batchSize = config.batchSize
+		opts.dryRun = *dryRun
+		opts.keepSource = *keepSource
+		if config.fwdURL == "" && !opts.dryRun {
+			config.UPPLogger.Fatal(errors.New("--url is required unless --dry-run is set"))
+		}
+		if config.rateLimitEvents < 0 || config.rateLimitBytes < 0 {
+			config.UPPLogger.Fatal(errors.New("rate limits must not be negative"))
+		}
+
+		s, err := newS3Service(*prefix, config)
+		if err != nil {
+			config.UPPLogger.Fatal(err)
+		}
+		var forwarder Forwarder
+		if !opts.dryRun {
+			splunk := NewSplunkForwarder(config).(*splunkClient)
+			defer splunk.stop()
+			forwarder = withRateLimit("replay", splunk, config)
+		}
+		config.UPPLogger.Infof("Replaying objects under %v/ cached from %v until %v", *prefix, opts.from, opts.to)
+		stats, err := replay(s, forwarder, opts)
+		if opts.dryRun {
+			config.UPPLogger.Infof("Would replay %v events (%v bytes) from %v objects", stats.events, stats.bytes, stats.objects)
+		} else {
+			config.UPPLogger.Infof("Replayed %v events (%v bytes) from %v objects", stats.events, stats.bytes, stats.objects)
+		}
+		if err != nil {
+			config.UPPLogger.Fatal(err)
+		}
+	}
+}
+
+func parseReplayOptions(from string, to string, now time.Time) (replayOptions, error) {
+	opts := replayOptions{to: now}
+	var err error
+	if from != "" {
+		if opts.from, err = time.Parse(time.RFC3339, from); err != nil {
+			return opts, fmt.Errorf("--from must be an RFC3339 time: %v", err)
+		}
+	}
+	if to != "" {
+		if opts.to, err = time.Parse(time.RFC3339, to); err != nil {
+			return opts, fmt.Errorf("--to must be an RFC3339 time: %v", err)
+		}
+	}
+	if !opts.from.Before(opts.to) {
+		return opts, errors.New("--from must be before --to")
+	}
+	return opts, nil
+}
+
+// replay sends the events of the objects cached within the time window, deleting each
+// object once its events have been delivered unless the source is kept. It stops at the
+// first object whose events could not all be delivered, leaving it in place, so that the
+// replay can be run again once the destination has been fixed.
+func replay(s *s3Service, forwarder Forwarder, opts replayOptions) (replayStats, error) {
+	stats := replayStats{}
+	err := s.scan(func(key string, _ int64, cached time.Time) error {
+		if cached.Before(opts.from) || !cached.Before(opts.to) {
+			return nil
+		}
+		msgs, err := s.get(key)
+		if err != nil {
+			if isNoSuchKey(err) {
+				// claimed by a replica in the meantime
+				return nil
+			}
+			return fmt.Errorf("failed to read %v: %v", key, err)
+		}
+		if opts.dryRun {
+			s.uppLogger.Infof("Would replay %v events from %v", len(msgs), key)
+		} else {
+			if opts.index != "" {
+				for _, m := range msgs {
+					m.body = withIndex(m.body, opts.index)
+				}
+			}
+			if err := forwardAll(forwarder, msgs, opts.batchSize); err != nil {
+				return fmt.Errorf("replay stopped at %v: %v", key, err)
+			}
+			if !opts.keepSource {
+				if err := s.Ack(key); err != nil {
+					return fmt.Errorf("failed to delete %v: %v", key, err)
+				}
+			}
+		}
+		stats.objects++
+		stats.events += len(msgs)
+		for _, m := range msgs {
+			stats.bytes += int64(len(m.body))
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// forwardAll sends events in batches and waits until they have all been delivered,
+// returning the error of the last event that has not been
+func forwardAll(forwarder Forwarder, msgs []*message, batchSize int) error {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	wg := sync.WaitGroup{}
+	mutex := sync.Mutex{}
+	var failure error
+	for start := 0; start < len(msgs); start += batchSize {
+		end := start + batchSize
+		if end > len(msgs) {
+			end = len(msgs)
+		}
+		wg.Add(end - start)
+		forwarder.forward(msgs[start:end], func(m *message, err error) {
+			if err != nil {
+				mutex.Lock()
+				failure = err
+				mutex.Unlock()
+			}
+			wg.Done()
+		})
+	}
+	wg.Wait()
+	return failure
+}
+
+// withIndex sets the index of a HEC event. Events that are not HEC events are sent as
+// they are.
+func withIndex(body string, index string) string {
+	envelope := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(body), &envelope); err != nil {
+		return body
+	}
+	if _, ok := envelope["event"]; !ok {
+		return body
+	}
+	envelope["index"], _ = json.Marshal(index)
+	buf, err := json.Marshal(envelope)
+	if err != nil {
+		return body
+	}
+	return string(buf)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingForwarderMock records the events it is sent, and fails those it is told to
+type recordingForwarderMock struct {
+	Forwarder
+	lock   sync.Mutex
+	bodies []string
+	fail   map[string]bool
+}
+
+func (forwarder *recordingForwarderMock) forward(batch []*message, callback func(*message, error)) {
+	for _, m := range batch {
+		if forwarder.fail[m.body] {
+			callback(m, errors.New("connection refused"))
+			continue
+		}
+		forwarder.lock.Lock()
+		forwarder.bodies = append(forwarder.bodies, m.body)
+		forwarder.lock.Unlock()
+		callback(m, nil)
+	}
+}
+
+func newReplayMock(s3InterfaceMock *memoryS3Interface) *s3Service {
+	return &s3Service{
+		bucketName: "test-bucket",
+		prefix:     "test-prefix",
+		svc:        s3InterfaceMock,
+		uppLogger:  config.UPPLogger,
+	}
+}
+
+func cacheAt(s3InterfaceMock *memoryS3Interface, key string, t time.Time, body string) string {
+	key = fmt.Sprintf(key, t.UnixNano())
+	s3InterfaceMock.objects[key] = []byte(body)
+	return key
+}
+
+func Test_Replay_TimeWindow(t *testing.T) {
+	s3InterfaceMock := newMemoryS3Interface()
+	start := time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)
+	cacheAt(s3InterfaceMock, "test-prefix/03/%v_before", start.Add(-time.Second), "before")
+	first := cacheAt(s3InterfaceMock, "test-prefix/03/%v_first", start, "first")
+	packed := cacheAt(s3InterfaceMock, "test-prefix/0a/%v_packed"+packedSuffix, start.Add(time.Minute), "a\nb\n")
+	legacy := cacheAt(s3InterfaceMock, "test-prefix/%v_legacy", start.Add(2*time.Minute), "legacy")
+	cacheAt(s3InterfaceMock, "test-prefix/0a/%v_after", start.Add(time.Hour), "after")
+	cacheAt(s3InterfaceMock, "test-prefix-dlq/%v_rejected", start, "rejected")
+	s3InterfaceMock.objects["test-prefix/03/not-a-time"] = []byte("skipped")
+
+	forwarder := &recordingForwarderMock{}
+	opts := replayOptions{from: start, to: start.Add(time.Hour), batchSize: 10}
+	stats, err := replay(newReplayMock(s3InterfaceMock), forwarder, opts)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"first", "a", "b", "legacy"}, forwarder.bodies)
+	assert.Equal(t, replayStats{objects: 3, events: 4, bytes: 13}, stats)
+
+	keys := s3InterfaceMock.keys()
+	for _, key := range []string{first, packed, legacy} {
+		assert.NotContains(t, keys, key, "replayed objects should be deleted")
+	}
+	assert.Len(t, keys, 4)
+}
+
+func Test_Replay_DryRunAndKeepSource(t *testing.T) {
+	s3InterfaceMock := newMemoryS3Interface()
+	start := time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)
+	cacheAt(s3InterfaceMock, "test-prefix/%v_first", start, `{"event":"first","index":"main"}`)
+	cacheAt(s3InterfaceMock, "test-prefix/%v_second", start.Add(time.Second), "second")
+	opts := replayOptions{from: start, to: start.Add(time.Hour), batchSize: 10, dryRun: true}
+
+	stats, err := replay(newReplayMock(s3InterfaceMock), nil, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.events)
+	assert.Equal(t, int64(len(`{"event":"first","index":"main"}`+"second")), stats.bytes)
+	assert.Len(t, s3InterfaceMock.keys(), 2)
+
+	forwarder := &recordingForwarderMock{}
+	opts.dryRun = false
+	opts.keepSource = true
+	opts.index = "replayed"
+	_, err = replay(newReplayMock(s3InterfaceMock), forwarder, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`{"event":"first","index":"replayed"}`, "second"}, forwarder.bodies)
+	assert.Len(t, s3InterfaceMock.keys(), 2)
+}
+
+func Test_Replay_CountsUncompressedBytes(t *testing.T) {
+	s3InterfaceMock := newMemoryS3Interface()
+	start := time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)
+	events := strings.Repeat(`{"event":"repeated"}`+"\n", 100)
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Write([]byte(events))
+	w.Close()
+	cacheAt(s3InterfaceMock, "test-prefix/%v_packed"+packedGzippedSuffix, start, buf.String())
+
+	forwarder := &recordingForwarderMock{}
+	opts := replayOptions{from: start, to: start.Add(time.Hour), batchSize: 10}
+	stats, err := replay(newReplayMock(s3InterfaceMock), forwarder, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, stats.events)
+	assert.Equal(t, int64(100*len(`{"event":"repeated"}`)), stats.bytes, "bytes sent should not be those of the compressed object")
+}
+
+func Test_Replay_StopsAtFailure(t *testing.T) {
+	s3InterfaceMock := newMemoryS3Interface()
+	start := time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)
+	cacheAt(s3InterfaceMock, "test-prefix/%v_first", start, "first")
+	failing := cacheAt(s3InterfaceMock, "test-prefix/%v_failing", start.Add(time.Second), "failing")
+	last := cacheAt(s3InterfaceMock, "test-prefix/%v_last", start.Add(2*time.Second), "last")
+
+	forwarder := &recordingForwarderMock{fail: map[string]bool{"failing": true}}
+	opts := replayOptions{from: start, to: start.Add(time.Hour), batchSize: 10}
+	stats, err := replay(newReplayMock(s3InterfaceMock), forwarder, opts)
+	assert.Error(t, err)
+	assert.Equal(t, 1, stats.objects)
+	assert.Equal(t, []string{failing, last}, s3InterfaceMock.keys())
+}
+
+func Test_ParseReplayOptions(t *testing.T) {
+	now := time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)
+	opts, err := parseReplayOptions("2020-03-01T08:00:00Z", "", now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(-2*time.Hour), opts.from)
+	assert.Equal(t, now, opts.to)
+
+	_, err = parseReplayOptions("yesterday", "", now)
+	assert.Error(t, err)
+	_, err = parseReplayOptions("2020-03-01T12:00:00Z", "2020-03-01T11:00:00Z", now)
+	assert.Error(t, err)
+}
+
+func Test_WithIndex(t *testing.T) {
+	assert.Equal(t, `{"event":"e","index":"other"}`, withIndex(`{"event":"e"}`, "other"))
+	assert.Equal(t, "plain", withIndex("plain", "other"))
+	assert.Equal(t, `{"message":"not hec"}`, withIndex(`{"message":"not hec"}`, "other"))
+}
@@ -1,26 +1,58 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/Financial-Times/go-logger/v2"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/pborman/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-const maxKeys = int64(100)
+const (
+	// default number of keys listed at once
+	maxKeys = int64(100)
+	// default number of objects claimed concurrently
+	claimWorkers     = 8
+	deadLetterSuffix = "-dlq"
+	inFlightSuffix   = "-inflight"
+	// a page of a listing holds at most 1000 keys
+	maxPageSize = 1000
+	// DeleteObjects accepts at most 1000 keys
+	maxDeleteKeys = 1000
+	// how often leases are checked for expiry
+	leaseReapInterval = 30 * time.Second
+)
+
+var listPagesHistogram prometheus.Observer
 
 type Cache interface {
 	Healthy
-	ListAndDelete() ([]string, error)
-	Put(obj string) error
+	// Claim leases a set of cached messages. They stay hidden from other readers until
+	// they are acknowledged or their lease expires. Messages may be returned alongside
+	// an error when only part of them could be read.
+	Claim() ([]*message, error)
+	// Ack removes delivered messages from the cache, given their lease keys
+	Ack(keys ...string) error
+	// Put stores events to be retried after failing once, and only returns once they are stored
+	Put(objs ...string) error
+	// Requeue stores messages that have failed again, keeping count of their failed attempts
+	Requeue(msgs ...*message) error
+	// DeadLetter stores an event rejected by the destination apart from the events to retry
+	DeadLetter(obj string, reason error) error
 }
 
 type s3Interface interface {
@@ -28,17 +60,83 @@ type s3Interface interface {
 	DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error)
 	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
 	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error)
 }
 
 type s3Service struct {
-	bucketName  string
-	prefix      string
-	svc         s3Interface
-	latestError error
+	bucketName   string
+	prefix       string
+	svc          s3Interface
+	leaseTimeout time.Duration
+	lastReap     time.Time
+	packing      packing
+	pageSize     int64
+	workers      int
+	// position of the listing in progress: the prefix being listed, the token of its
+	// next page, and the pages listed so far
+	listIndex    int
+	listPrefix   string
+	continuation *string
+	pages        int
+	// the cache is split into shards, and each replica only claims the shards it owns
+	shards   int
+	memberID string
+	// the heartbeat runs on its own once the first claim has started it
+	shardLock       sync.RWMutex
+	owned           map[int]bool
+	heartbeatOnce   sync.Once
+	heartbeatTicker *time.Ticker
+	heartbeatDone   chan struct{}
+	heartbeatWg     sync.WaitGroup
+	heartbeatError  error
+	uppLogger       *logger.UPPLogger
+	// number of events left to acknowledge by lease key, for objects holding several events
+	pendingLock sync.Mutex
+	pending     map[string]int
+	// when set, the keys to claim are learnt from S3 event notifications and the
+	// prefix is only listed every listInterval
+	queue        sqsInterface
+	queueURL     string
+	listInterval time.Duration
+	lastList     time.Time
+	latestError  error
+}
+
+var NewS3Service = func(prefix string, config appConfig) (Cache, error) {
+	s, err := newS3Service(prefix, config)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newS3Service(prefix string, config appConfig) (*s3Service, error) {
+	if listPagesHistogram == nil {
+		listPagesHistogram = registerHistogram("list_pages_per_cycle", "Number of pages listed to go through the cached objects once", []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000})
+	}
+	workers := config.claimWorkers
+	if workers < 1 {
+		workers = claimWorkers
+	}
+	sess, err := newAWSSession(config.awsRegion, workers)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Service{
+		bucketName:   config.bucket,
+		prefix:       prefix,
+		svc:          s3.New(sess),
+		leaseTimeout: config.leaseTimeout,
+		packing:      newPacking(config),
+		pageSize:     config.listPageSize,
+		workers:      workers,
+		shards:       config.shards,
+		memberID:     newMemberID(),
+		uppLogger:    config.UPPLogger,
+	}, nil
 }
 
-var NewS3Service = func(bucketName string, awsRegion string, prefix string) (Cache, error) {
-	wrks := 8
+func newAWSSession(awsRegion string, wrks int) (*session.Session, error) {
 	spareWorkers := 1
 
 	hc := &http.Client{
@@ -64,91 +162,550 @@ var NewS3Service = func(bucketName string, awsRegion string, prefix string) (Cac
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create AWS session: %v", err)
 	}
-	svc := s3.New(sess)
-	return &s3Service{bucketName: bucketName, prefix: prefix, svc: svc}, nil
+	return sess, nil
 }
 
-func (s *s3Service) ListAndDelete() ([]string, error) {
-	out, err := s.svc.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket:  aws.String(s.bucketName),
-		Prefix:  aws.String(s.prefix),
-		MaxKeys: aws.Int64(maxKeys),
-	})
-	if err != nil {
-		return nil, err
+// Claim moves cached objects, and objects whose lease has expired, under the in-flight
+// prefix with a new lease expiry encoded in their key.
+func (s *s3Service) Claim() ([]*message, error) {
+	var keys []string
+	var err error
+	if s.isSharded() {
+		s.heartbeatOnce.Do(s.startHeartbeat)
 	}
-	s.latestError = err
-	ids := []*s3.ObjectIdentifier{}
-	vals := []string{}
+	// a listing that has started goes on until its last page
+	if s.queue != nil && !s.isListing() && time.Since(s.lastList) < s.listInterval {
+		var receipts []*string
+		keys, receipts, err = s.notifiedKeys()
+		if err != nil {
+			return nil, err
+		}
+		// objects that can not be claimed now are found by the next listing
+		defer s.deleteNotifications(receipts)
+	} else {
+		keys, err = s.list()
+		if err != nil {
+			return nil, err
+		}
+		if !s.isListing() {
+			s.lastList = time.Now()
+		}
+	}
+
+	if time.Since(s.lastReap) > leaseReapInterval {
+		expired, err := s.expiredLeases(time.Now())
+		if err != nil {
+			return nil, err
+		}
+		s.lastReap = time.Now()
+		keys = append(keys, expired...)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	expiry := time.Now().Add(s.leaseTimeout)
+	// lease key of each object copied, by key
+	claimed := map[string]string{}
+	msgs := []*message{}
+	leases := map[string]int{}
 	mutex := sync.Mutex{}
 	wg := sync.WaitGroup{}
 	getErr := error(nil)
-	for _, obj := range out.Contents {
-		ids = append(ids, &s3.ObjectIdentifier{Key: obj.Key})
+	keyChan := make(chan string)
+	workers := s.workers
+	if workers < 1 {
+		workers = claimWorkers
+	}
+	for i := 0; i < workers && i < len(keys); i++ {
 		wg.Add(1)
-		go func(o s3.Object) {
+		go func() {
 			defer wg.Done()
-			val, err := s.Get(*o.Key)
-			if err != nil {
-				// don't capture latest error in case another instance has deleted them first
+			for key := range keyChan {
+				leaseKey := s.leaseKey(key, expiry)
+				_, err := s.svc.CopyObject(&s3.CopyObjectInput{
+					Bucket:     aws.String(s.bucketName),
+					CopySource: aws.String(s.bucketName + "/" + url.PathEscape(key)),
+					Key:        aws.String(leaseKey),
+				})
+				if isNoSuchKey(err) {
+					// another instance has claimed it first
+					continue
+				}
+				if err != nil {
+					// don't capture latest error in case another instance has claimed it first
+					mutex.Lock()
+					getErr = err
+					mutex.Unlock()
+					continue
+				}
 				mutex.Lock()
-				getErr = err
+				claimed[key] = leaseKey
 				mutex.Unlock()
-				return
-			}
 
-			mutex.Lock()
-			vals = append(vals, val)
-			mutex.Unlock()
-		}(*obj)
+				events, err := s.get(leaseKey)
+				if err != nil {
+					// the lease expires and the object is claimed again later
+					mutex.Lock()
+					getErr = err
+					mutex.Unlock()
+					continue
+				}
+
+				mutex.Lock()
+				leases[leaseKey] = len(events)
+				for _, m := range events {
+					m.key = leaseKey
+					msgs = append(msgs, m)
+				}
+				mutex.Unlock()
+			}
+		}()
 	}
+	for _, key := range keys {
+		keyChan <- key
+	}
+	close(keyChan)
 	wg.Wait()
-	if getErr != nil {
-		return nil, getErr
+
+	if len(claimed) > 0 {
+		keys := []string{}
+		for key := range claimed {
+			keys = append(keys, key)
+		}
+		deleted, err := s.deleteKeys(keys)
+		if err != nil {
+			// don't capture latest error in case another instance has deleted them first.
+			// Release the leases of the objects left in place so that they are not
+			// delivered twice.
+			released := map[string]bool{}
+			leaseKeys := []string{}
+			for _, key := range keys[deleted:] {
+				released[claimed[key]] = true
+				leaseKeys = append(leaseKeys, claimed[key])
+				delete(leases, claimed[key])
+			}
+			s.Ack(leaseKeys...)
+			kept := []*message{}
+			for _, m := range msgs {
+				if !released[m.key] {
+					kept = append(kept, m)
+				}
+			}
+			msgs = kept
+			getErr = err
+		} else {
+			s.latestError = nil
+		}
+	}
+	empty := s.track(leases)
+	if len(empty) > 0 {
+		s.Ack(empty...)
+	}
+	return msgs, getErr
+}
+
+// track counts the events left to acknowledge for the objects holding several events,
+// and returns the leases of empty objects. Counts of expired leases are forgotten, as
+// their objects are claimed again.
+func (s *s3Service) track(leases map[string]int) []string {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	if s.pending == nil {
+		s.pending = map[string]int{}
+	}
+	now := time.Now()
+	for leaseKey := range s.pending {
+		if expiry, _, ok := parseLeaseKey(leaseKey); ok && expiry.Before(now) {
+			delete(s.pending, leaseKey)
+		}
+	}
+	empty := []string{}
+	for leaseKey, events := range leases {
+		if events == 0 {
+			empty = append(empty, leaseKey)
+		} else if events > 1 {
+			s.pending[leaseKey] = events
+		}
+	}
+	return empty
+}
+
+// settled returns the lease keys whose events have all been acknowledged
+func (s *s3Service) settled(keys []string) []string {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	settled := []string{}
+	for _, key := range keys {
+		if events, ok := s.pending[key]; ok {
+			if events > 1 {
+				s.pending[key] = events - 1
+				continue
+			}
+			delete(s.pending, key)
+		}
+		settled = append(settled, key)
+	}
+	return settled
+}
+
+// list lists a page of the cached objects owned by this replica. Each call lists the page
+// following the previous one, so that objects that can not be claimed don't hold back the
+// rest of the backlog, and starts again from the first page once the last one has been listed.
+func (s *s3Service) list() ([]string, error) {
+	prefixes := s.listPrefixes()
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+	if s.listIndex >= len(prefixes) || prefixes[s.listIndex].prefix != s.listPrefix {
+		// the shards owned have changed
+		if s.listIndex >= len(prefixes) {
+			s.listIndex = 0
+		}
+		s.listPrefix = prefixes[s.listIndex].prefix
+		s.continuation = nil
+	}
+	out, err := s.svc.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:            aws.String(s.bucketName),
+		Prefix:            aws.String(s.listPrefix),
+		Delimiter:         prefixes[s.listIndex].delimiter,
+		MaxKeys:           aws.Int64(s.getPageSize()),
+		ContinuationToken: s.continuation,
+	})
+	if err != nil {
+		// the token may have expired
+		s.continuation = nil
+		return nil, err
+	}
+	s.latestError = err
+	s.pages++
+	if aws.BoolValue(out.IsTruncated) && out.NextContinuationToken != nil {
+		s.continuation = out.NextContinuationToken
+	} else {
+		s.continuation = nil
+		s.listIndex++
+		if s.listIndex >= len(prefixes) {
+			if listPagesHistogram != nil {
+				listPagesHistogram.Observe(float64(s.pages))
+			}
+			s.listIndex = 0
+			s.pages = 0
+		}
+		s.listPrefix = prefixes[s.listIndex].prefix
+	}
+	keys := []string{}
+	for _, obj := range out.Contents {
+		keys = append(keys, *obj.Key)
 	}
+	return keys, nil
+}
+
+// scan lists every object under the prefix, shards included, with the time it was cached
+// at. Objects whose key does not start with a time are skipped.
+func (s *s3Service) scan(fn func(key string, size int64, cached time.Time) error) error {
+	return s.listAll(s.prefix+"/", func(key string, size int64) error {
+		cached, _, ok := splitKey(key)
+		if !ok {
+			return nil
+		}
+		return fn(key, size, cached)
+	})
+}
+
+// scanInFlight lists every in-flight object with the time it was cached at and the expiry
+// of its lease
+func (s *s3Service) scanInFlight(fn func(key string, size int64, cached time.Time, expiry time.Time) error) error {
+	return s.listAll(s.prefix+inFlightSuffix+"/", func(key string, size int64) error {
+		expiry, original, ok := parseLeaseKey(key)
+		if !ok {
+			return nil
+		}
+		cached, _, ok := splitKey(original)
+		if !ok {
+			return nil
+		}
+		return fn(key, size, cached, expiry)
+	})
+}
 
-	if *out.KeyCount > 0 {
-		_, err = s.svc.DeleteObjects(&s3.DeleteObjectsInput{
+// listAll lists every object under a prefix, page after page
+func (s *s3Service) listAll(prefix string, fn func(key string, size int64) error) error {
+	var continuation *string
+	for {
+		out, err := s.svc.ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:            aws.String(s.bucketName),
+			Prefix:            aws.String(prefix),
+			MaxKeys:           aws.Int64(maxPageSize),
+			ContinuationToken: continuation,
+		})
+		s.latestError = err
+		if err != nil {
+			return err
+		}
+		for _, obj := range out.Contents {
+			if err := fn(*obj.Key, aws.Int64Value(obj.Size)); err != nil {
+				return err
+			}
+		}
+		if !aws.BoolValue(out.IsTruncated) || out.NextContinuationToken == nil {
+			return nil
+		}
+		continuation = out.NextContinuationToken
+	}
+}
+
+// isListing tells whether a listing of the cache has started and not reached its end
+func (s *s3Service) isListing() bool {
+	return s.continuation != nil || s.listIndex > 0
+}
+
+func (s *s3Service) getPageSize() int64 {
+	if s.pageSize > 0 {
+		return s.pageSize
+	}
+	return maxKeys
+}
+
+// Ack deletes the in-flight objects of delivered messages. An object holding several
+// events is only deleted once each of them has been acknowledged.
+func (s *s3Service) Ack(keys ...string) error {
+	_, err := s.deleteKeys(s.settled(keys))
+	s.latestError = err
+	return err
+}
+
+// deleteKeys deletes objects as many at a time as DeleteObjects accepts, and returns the
+// number of keys deleted before an error
+func (s *s3Service) deleteKeys(keys []string) (int, error) {
+	deleted := 0
+	for deleted < len(keys) {
+		n := len(keys) - deleted
+		if n > maxDeleteKeys {
+			n = maxDeleteKeys
+		}
+		ids := []*s3.ObjectIdentifier{}
+		for _, key := range keys[deleted : deleted+n] {
+			ids = append(ids, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		_, err := s.svc.DeleteObjects(&s3.DeleteObjectsInput{
 			Bucket: aws.String(s.bucketName),
 			Delete: &s3.Delete{
 				Objects: ids,
 			},
 		})
 		if err != nil {
-			// don't capture latest error in case another instance has deleted them first
-			return nil, err
+			return deleted, err
 		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// expiredLeases lists the in-flight objects whose lease has expired. Keys start with
+// the lease expiry, so they are listed oldest lease first.
+func (s *s3Service) expiredLeases(now time.Time) ([]string, error) {
+	out, err := s.svc.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucketName),
+		Prefix:  aws.String(s.prefix + inFlightSuffix + "/"),
+		MaxKeys: aws.Int64(s.getPageSize()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, obj := range out.Contents {
+		expiry, _, ok := parseLeaseKey(*obj.Key)
+		if !ok {
+			continue
+		}
+		if expiry.After(now) {
+			break
+		}
+		// the other replicas reap the leases of their own shards
+		if !s.ownsLease(*obj.Key) {
+			continue
+		}
+		keys = append(keys, *obj.Key)
+	}
+	return keys, nil
+}
+
+// leaseKey is <prefix>-inflight/<expiry>_<name> where name is the original object name
+func (s *s3Service) leaseKey(key string, expiry time.Time) string {
+	name := path.Base(key)
+	if _, original, ok := parseLeaseKey(key); ok {
+		name = original
+	}
+	return fmt.Sprintf("%v%v/%v_%v", s.prefix, inFlightSuffix, expiry.UnixNano(), name)
+}
+
+func parseLeaseKey(key string) (time.Time, string, bool) {
+	if !strings.Contains(key, inFlightSuffix+"/") {
+		return time.Time{}, "", false
+	}
+	return splitKey(key)
+}
+
+// splitKey splits the base name of a key, <nanotime>_<name>, into its time and name
+func splitKey(key string) (time.Time, string, bool) {
+	parts := strings.SplitN(path.Base(key), "_", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", false
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return time.Unix(0, nanos), parts[1], true
+}
+
+// Put packs events into as few objects as the packing allows
+func (s *s3Service) Put(objs ...string) error {
+	return s.put(objs, 0, time.Time{}, nil)
+}
+
+// requeueGroup is the metadata shared by the messages packed together when cached again
+type requeueGroup struct {
+	attempts  int
+	fannedOut string
+}
+
+// Requeue packs messages with the messages that have failed as many times, and have been
+// taken by the same fan-out destinations, so that both can be recorded in the metadata of
+// their object. Packed messages share the earliest first failure.
+func (s *s3Service) Requeue(msgs ...*message) error {
+	keys := []requeueGroup{}
+	groups := map[requeueGroup][]*message{}
+	for _, m := range msgs {
+		key := requeueGroup{attempts: m.attempts, fannedOut: strings.Join(m.fannedOut, ",")}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], m)
+	}
+	for _, key := range keys {
+		events := []string{}
+		firstSeen := time.Time{}
+		for _, m := range groups[key] {
+			events = append(events, m.body)
+			if !m.firstSeen.IsZero() && (firstSeen.IsZero() || m.firstSeen.Before(firstSeen)) {
+				firstSeen = m.firstSeen
+			}
+		}
+		if err := s.put(events, key.attempts, firstSeen, groups[key][0].fannedOut); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3Service) put(objs []string, attempts int, firstSeen time.Time, fannedOut []string) error {
+	for _, events := range s.packing.split(objs) {
+		body, suffix, err := s.packing.pack(events)
+		if err != nil {
+			return err
+		}
+		key := s.objectKey(time.Now(), uuid.New(), suffix)
+		metadata := attemptsOf(attempts, firstSeen)
+		if len(fannedOut) > 0 {
+			metadata[fannedOutMetadata] = aws.String(strings.Join(fannedOut, ","))
+		}
+		_, err = s.svc.PutObject(&s3.PutObjectInput{
+			Bucket:   aws.String(s.bucketName),
+			Body:     bytes.NewReader(body),
+			Key:      aws.String(key),
+			Metadata: metadata,
+		})
 		s.latestError = err
-		return vals, nil
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectKey is <prefix>/<shard>/<nanotime>_<uuid>, or <prefix>/<nanotime>_<uuid> when the
+// cache is not sharded. Objects are spread over the shards by their uuid.
+func (s *s3Service) objectKey(t time.Time, id string, suffix string) string {
+	if !s.isSharded() {
+		return fmt.Sprintf("%v/%v_%v%v", s.prefix, t.UnixNano(), id, suffix)
 	}
-	return nil, nil
+	return fmt.Sprintf("%v/%02x/%v_%v%v", s.prefix, s.shardOfID(id), t.UnixNano(), id, suffix)
 }
 
-func (s *s3Service) Put(obj string) error {
-	uuid := fmt.Sprintf("%v/%v_%v", s.prefix, time.Now().UnixNano(), uuid.New())
+func (s *s3Service) DeadLetter(obj string, reason error) error {
+	metadata := map[string]*string{
+		"dead-lettered-at": aws.String(time.Now().UTC().Format(time.RFC3339)),
+		"error":            aws.String(reason.Error()),
+	}
+	suffix := deadLetterSuffix
+	if q, ok := reason.(*quarantineError); ok {
+		suffix = quarantineSuffix
+		for key, value := range attemptsOf(q.attempts, q.firstSeen) {
+			metadata[key] = value
+		}
+		reason = q.cause
+	}
+	switch e := reason.(type) {
+	case *hecError:
+		metadata["status"] = aws.String(strconv.Itoa(e.status))
+		metadata["code"] = aws.String(strconv.Itoa(e.code))
+		metadata["text"] = aws.String(e.text)
+	case *sinkError:
+		metadata["status"] = aws.String(strconv.Itoa(e.status))
+		metadata["text"] = aws.String(e.text)
+	}
+	key := fmt.Sprintf("%v%v/%v_%v", s.prefix, suffix, time.Now().UnixNano(), uuid.New())
 	_, err := s.svc.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(s.bucketName),
-		Body:   strings.NewReader(obj),
-		Key:    aws.String(uuid),
+		Bucket:   aws.String(s.bucketName),
+		Body:     strings.NewReader(obj),
+		Key:      aws.String(key),
+		Metadata: metadata,
 	})
 	s.latestError = err
 	return err
 }
 
-func (s *s3Service) Get(key string) (string, error) {
+// get reads the events of an object, whether it holds one event or several, with the
+// attempts recorded for them
+func (s *s3Service) get(key string) ([]*message, error) {
 	val, err := s.svc.GetObject(&s3.GetObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	defer val.Body.Close()
 	buf, err := ioutil.ReadAll(val.Body)
-	return string(buf), err
+	if err != nil {
+		return nil, err
+	}
+	events, err := unpack(key, buf)
+	if err != nil {
+		return nil, err
+	}
+	attempts, firstSeen := parseAttempts(val.Metadata)
+	fannedOut := parseFannedOut(val.Metadata)
+	msgs := []*message{}
+	for _, event := range events {
+		msgs = append(msgs, &message{body: event, attempts: attempts, firstSeen: firstSeen, fannedOut: fannedOut})
+	}
+	return msgs, nil
+}
+
+func isNoSuchKey(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == s3.ErrCodeNoSuchKey
 }
 
 func (s *s3Service) getHealth() error {
+	s.shardLock.RLock()
+	err := s.heartbeatError
+	s.shardLock.RUnlock()
+	if err != nil {
+		return err
+	}
 	return s.latestError
 }
@@ -3,26 +3,55 @@ package main
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
-	"io/ioutil"
-	"testing"
 )
 
 type mockS3Interface struct {
 	mock.Mock
+	lock         sync.Mutex
+	listPrefixes []string
+	copied       []string
+	deleted      []string
+	lastPut      *s3.PutObjectInput
 }
 
+var expiredLease = fmt.Sprintf("test-prefix-inflight/%v_1_expired", time.Now().Add(-time.Minute).UnixNano())
+var activeLease = fmt.Sprintf("test-prefix-inflight/%v_2_active", time.Now().Add(time.Hour).UnixNano())
+
 var sampleErr = errors.New("sample error")
 var successResponse = "Ohai Mark"
 
 func (m *mockS3Interface) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	m.lock.Lock()
+	m.listPrefixes = append(m.listPrefixes, *input.Prefix)
+	m.lock.Unlock()
 	if *input.Bucket == "simulated-error" {
 		return nil, sampleErr
 	}
 
-	if *input.Bucket == "empty-response" {
+	if *input.Bucket == "expired-leases" && strings.Contains(*input.Prefix, inFlightSuffix) {
+		int64Val := int64(2)
+		return &s3.ListObjectsV2Output{
+			KeyCount: &int64Val,
+			Contents: []*s3.Object{{Key: &expiredLease}, {Key: &activeLease}},
+		}, nil
+	}
+
+	if *input.Bucket == "empty-response" || *input.Bucket == "expired-leases" {
 		int64Val := int64(0)
 		obj := &s3.ListObjectsV2Output{
 			KeyCount: &int64Val,
@@ -62,6 +91,11 @@ func (m *mockS3Interface) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListO
 }
 
 func (m *mockS3Interface) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	m.lock.Lock()
+	for _, id := range input.Delete.Objects {
+		m.deleted = append(m.deleted, *id.Key)
+	}
+	m.lock.Unlock()
 	if *input.Bucket == "simulated-delete-error" {
 		return nil, sampleErr
 	}
@@ -69,11 +103,12 @@ func (m *mockS3Interface) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.Delet
 	return nil, nil
 }
 func (m *mockS3Interface) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	m.lastPut = input
 	return nil, nil
 }
 
 func (m *mockS3Interface) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
-	if *input.Key == "simulated-error-response" {
+	if strings.HasSuffix(*input.Key, "simulated-error-response") {
 		return nil, sampleErr
 	}
 
@@ -84,10 +119,17 @@ func (m *mockS3Interface) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutp
 	return output, nil
 }
 
+func (m *mockS3Interface) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	m.lock.Lock()
+	m.copied = append(m.copied, *input.Key)
+	m.lock.Unlock()
+	return &s3.CopyObjectOutput{}, nil
+}
+
 var _ s3Interface = (*mockS3Interface)(nil)
 
 func Test_S3_failServiceCreation(t *testing.T) {
-	s3service, errServiceCreation := NewS3Service("", "no-region", "")
+	s3service, errServiceCreation := NewS3Service("", appConfig{awsRegion: "no-region", leaseTimeout: time.Minute})
 
 	assert.Equal(t, nil, errServiceCreation)
 	assert.NotEqual(t, nil, s3service)
@@ -96,18 +138,25 @@ func Test_S3_failServiceCreation(t *testing.T) {
 func Test_S3_success(t *testing.T) {
 	s3InterfaceMock := &mockS3Interface{}
 	s3service := &s3Service{
-		bucketName:  "test-bucket",
-		prefix:      "test-prefix",
-		latestError: nil,
-		svc:         s3InterfaceMock,
+		bucketName:   "test-bucket",
+		prefix:       "test-prefix",
+		latestError:  nil,
+		svc:          s3InterfaceMock,
+		leaseTimeout: time.Minute,
 	}
 
 	s3service.Put(`{event:"127.0.0.1 - - [21/Apr/2015:12:15:34 +0000] \"GET /eom-file/all/e09b49d6-e1fa-11e4-bb7f-00144feab7de HTTP/1.1\" 200 53706 919 919"}`)
 
-	result, errListAndDelete := s3service.ListAndDelete()
+	result, errListAndDelete := s3service.Claim()
 
 	assert.Nil(t, s3service.getHealth())
-	assert.Contains(t, result, successResponse)
+	assert.Contains(t, s3InterfaceMock.listPrefixes, "test-prefix/")
+	assert.NotContains(t, s3InterfaceMock.listPrefixes, "test-prefix", "dead-lettered objects should not be listed")
+	assert.Len(t, result, 1)
+	assert.Equal(t, successResponse, result[0].body)
+	assert.True(t, strings.HasPrefix(result[0].key, "test-prefix-inflight/"))
+	assert.Equal(t, []string{result[0].key}, s3InterfaceMock.copied)
+	assert.Equal(t, []string{"test-key"}, s3InterfaceMock.deleted)
 	assert.Nil(t, errListAndDelete)
 	assert.NotEqual(t, nil, s3service)
 }
@@ -115,15 +164,16 @@ func Test_S3_success(t *testing.T) {
 func Test_S3_error_delete(t *testing.T) {
 	s3InterfaceMock := &mockS3Interface{}
 	s3service := &s3Service{
-		bucketName:  "simulated-delete-error",
-		prefix:      "test-prefix",
-		latestError: nil,
-		svc:         s3InterfaceMock,
+		bucketName:   "simulated-delete-error",
+		prefix:       "test-prefix",
+		latestError:  nil,
+		svc:          s3InterfaceMock,
+		leaseTimeout: time.Minute,
 	}
 
 	s3service.Put(`{event:"127.0.0.1 - - [21/Apr/2015:12:15:34 +0000] \"GET /eom-file/all/e09b49d6-e1fa-11e4-bb7f-00144feab7de HTTP/1.1\" 200 53706 919 919"}`)
 
-	result, errListAndDelete := s3service.ListAndDelete()
+	result, errListAndDelete := s3service.Claim()
 
 	assert.Empty(t, result)
 	assert.Equal(t, sampleErr, errListAndDelete)
@@ -136,17 +186,18 @@ func Test_S3_error_get(t *testing.T) {
 		Return(nil, sampleErr).
 		Once()
 	s3service := &s3Service{
-		bucketName:  "simulated-error-response",
-		prefix:      "test-prefix",
-		latestError: nil,
-		svc:         s3InterfaceMock,
+		bucketName:   "simulated-error-response",
+		prefix:       "test-prefix",
+		latestError:  nil,
+		svc:          s3InterfaceMock,
+		leaseTimeout: time.Minute,
 	}
 
 	//s3, _ := NewS3Service("test-bucket", "test-region", "test-prefix")
 
 	s3service.Put(`{event:"127.0.0.1 - - [21/Apr/2015:12:15:34 +0000] \"GET /eom-file/all/e09b49d6-e1fa-11e4-bb7f-00144feab7de HTTP/1.1\" 200 53706 919 919"}`)
 
-	result, errListAndDelete := s3service.ListAndDelete()
+	result, errListAndDelete := s3service.Claim()
 
 	assert.Empty(t, result)
 	assert.Equal(t, sampleErr, errListAndDelete)
@@ -159,15 +210,356 @@ func Test_S3_empty(t *testing.T) {
 		Return(nil, sampleErr).
 		Once()
 	s3service := &s3Service{
-		bucketName:  "empty-response",
-		prefix:      "test-prefix",
-		latestError: nil,
-		svc:         s3InterfaceMock,
+		bucketName:   "empty-response",
+		prefix:       "test-prefix",
+		latestError:  nil,
+		svc:          s3InterfaceMock,
+		leaseTimeout: time.Minute,
 	}
 
-	result, errListAndDelete := s3service.ListAndDelete()
+	result, errListAndDelete := s3service.Claim()
 
 	assert.Empty(t, result)
 	assert.Nil(t, errListAndDelete)
 	assert.NotEqual(t, nil, s3service)
 }
+
+func Test_S3_deadLetter(t *testing.T) {
+	s3InterfaceMock := &mockS3Interface{}
+	s3service := &s3Service{
+		bucketName:   "test-bucket",
+		prefix:       "test-prefix",
+		latestError:  nil,
+		svc:          s3InterfaceMock,
+		leaseTimeout: time.Minute,
+	}
+
+	err := s3service.DeadLetter(`{"event":"malformed"}`, newHecError(400, hecResponse{Code: 6, Text: "Invalid data format"}))
+
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(*s3InterfaceMock.lastPut.Key, "test-prefix-dlq/"))
+	assert.Equal(t, "400", *s3InterfaceMock.lastPut.Metadata["status"])
+	assert.Equal(t, "6", *s3InterfaceMock.lastPut.Metadata["code"])
+	assert.Equal(t, "Invalid data format", *s3InterfaceMock.lastPut.Metadata["text"])
+	assert.NotEmpty(t, *s3InterfaceMock.lastPut.Metadata["dead-lettered-at"])
+}
+
+func Test_S3_expiredLeases(t *testing.T) {
+	s3InterfaceMock := &mockS3Interface{}
+	s3service := &s3Service{
+		bucketName:   "expired-leases",
+		prefix:       "test-prefix",
+		svc:          s3InterfaceMock,
+		leaseTimeout: time.Minute,
+	}
+
+	result, err := s3service.Claim()
+
+	assert.NoError(t, err)
+	assert.Len(t, result, 1)
+	assert.True(t, strings.HasSuffix(result[0].key, "_1_expired"))
+	assert.NotEqual(t, expiredLease, result[0].key, "lease should be renewed")
+	assert.Equal(t, []string{expiredLease}, s3InterfaceMock.deleted)
+
+	result, err = s3service.Claim()
+
+	assert.NoError(t, err)
+	assert.Empty(t, result, "leases should not be checked on every claim")
+}
+
+func Test_S3_ack(t *testing.T) {
+	s3InterfaceMock := &mockS3Interface{}
+	s3service := &s3Service{
+		bucketName: "test-bucket",
+		prefix:     "test-prefix",
+		svc:        s3InterfaceMock,
+	}
+	keys := []string{}
+	for i := 0; i < 1500; i++ {
+		keys = append(keys, fmt.Sprintf("test-prefix-inflight/%v", i))
+	}
+
+	err := s3service.Ack(keys...)
+
+	assert.NoError(t, err)
+	assert.Equal(t, keys, s3InterfaceMock.deleted)
+}
+
+func Test_S3_claimFullPageWithExpiredLeases(t *testing.T) {
+	s3InterfaceMock := newMemoryS3Interface()
+	s3service := &s3Service{
+		bucketName:   "test-bucket",
+		prefix:       "test-prefix",
+		svc:          s3InterfaceMock,
+		leaseTimeout: time.Minute,
+		pageSize:     maxPageSize,
+	}
+	for i := 0; i < maxPageSize; i++ {
+		s3InterfaceMock.objects[fmt.Sprintf("test-prefix/%v_%v", 1000+i, i)] = []byte("cached")
+	}
+	expired := time.Now().Add(-time.Minute).UnixNano()
+	for i := 0; i < 5; i++ {
+		s3InterfaceMock.objects[fmt.Sprintf("test-prefix-inflight/%v_%v_expired", expired, i)] = []byte("expired")
+	}
+
+	result, err := s3service.Claim()
+	assert.NoError(t, err)
+	assert.Len(t, result, maxPageSize+5)
+	for _, key := range s3InterfaceMock.keys() {
+		assert.True(t, strings.HasPrefix(key, "test-prefix-inflight/"), "claimed objects should all be moved")
+	}
+	assert.Len(t, s3InterfaceMock.keys(), maxPageSize+5)
+}
+
+func Test_S3_leaseKey(t *testing.T) {
+	s3service := &s3Service{prefix: "test-prefix"}
+	expiry := time.Unix(0, 42)
+
+	key := s3service.leaseKey("test-prefix/123_abc", expiry)
+	assert.Equal(t, "test-prefix-inflight/42_123_abc", key)
+
+	renewed := s3service.leaseKey(key, time.Unix(0, 43))
+	assert.Equal(t, "test-prefix-inflight/43_123_abc", renewed)
+
+	parsedExpiry, name, ok := parseLeaseKey(renewed)
+	assert.True(t, ok)
+	assert.Equal(t, int64(43), parsedExpiry.UnixNano())
+	assert.Equal(t, "123_abc", name)
+}
+
+// memoryS3Interface keeps objects in memory, so that what is written can be read back
+type memoryS3Interface struct {
+	lock     sync.Mutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+	metadata map[string]map[string]*string
+	// objects that can not be copied
+	uncopyable map[string]bool
+	// most copies running at once
+	copying    int
+	maxCopying int
+}
+
+func newMemoryS3Interface() *memoryS3Interface {
+	return &memoryS3Interface{objects: map[string][]byte{}, modified: map[string]time.Time{}, metadata: map[string]map[string]*string{}}
+}
+
+func (m *memoryS3Interface) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	keys := []string{}
+	for key := range m.objects {
+		if !strings.HasPrefix(key, *input.Prefix) {
+			continue
+		}
+		// keys under a common prefix are not listed
+		if input.Delimiter != nil && strings.Contains(strings.TrimPrefix(key, *input.Prefix), *input.Delimiter) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	for _, key := range keys {
+		// the token is the last key of the previous page
+		if input.ContinuationToken != nil && key <= *input.ContinuationToken {
+			continue
+		}
+		if input.MaxKeys != nil && int64(len(out.Contents)) >= *input.MaxKeys {
+			out.IsTruncated = aws.Bool(true)
+			out.NextContinuationToken = out.Contents[len(out.Contents)-1].Key
+			break
+		}
+		modified := m.modified[key]
+		out.Contents = append(out.Contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(int64(len(m.objects[key]))), LastModified: &modified})
+	}
+	out.KeyCount = aws.Int64(int64(len(out.Contents)))
+	return out, nil
+}
+
+func (m *memoryS3Interface) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	if len(input.Delete.Objects) > maxDeleteKeys {
+		return nil, errors.New("MalformedXML: the request may contain at most 1000 keys")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, id := range input.Delete.Objects {
+		delete(m.objects, *id.Key)
+		delete(m.metadata, *id.Key)
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func (m *memoryS3Interface) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	buf, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.objects[*input.Key] = buf
+	m.modified[*input.Key] = time.Now()
+	// S3 returns metadata keys in canonical header form
+	metadata := map[string]*string{}
+	for key, value := range input.Metadata {
+		metadata[http.CanonicalHeaderKey(key)] = value
+	}
+	m.metadata[*input.Key] = metadata
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *memoryS3Interface) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	buf, ok := m.objects[*input.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(buf)), Metadata: m.metadata[*input.Key]}, nil
+}
+
+func (m *memoryS3Interface) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	source, _ := url.PathUnescape(*input.CopySource)
+	source = strings.TrimPrefix(source, *input.Bucket+"/")
+	m.lock.Lock()
+	m.copying++
+	if m.copying > m.maxCopying {
+		m.maxCopying = m.copying
+	}
+	m.lock.Unlock()
+	time.Sleep(time.Millisecond)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.copying--
+	if m.uncopyable[source] {
+		return nil, sampleErr
+	}
+	buf, ok := m.objects[source]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	m.objects[*input.Key] = buf
+	m.modified[*input.Key] = time.Now()
+	m.metadata[*input.Key] = m.metadata[source]
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (m *memoryS3Interface) keys() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	keys := []string{}
+	for key := range m.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var _ s3Interface = (*memoryS3Interface)(nil)
+
+func Test_S3_packedObjects(t *testing.T) {
+	s3InterfaceMock := newMemoryS3Interface()
+	s3service := &s3Service{
+		bucketName:   "test-bucket",
+		prefix:       "test-prefix",
+		svc:          s3InterfaceMock,
+		leaseTimeout: time.Minute,
+		packing:      packing{size: 2, gzip: true},
+	}
+
+	assert.NoError(t, s3service.Put("a", "b", "c"))
+	keys := s3InterfaceMock.keys()
+	assert.Len(t, keys, 2, "events should be packed two by two")
+	for _, key := range keys {
+		assert.True(t, strings.HasSuffix(key, packedGzippedSuffix))
+	}
+	// written one event at a time by a previous version
+	s3InterfaceMock.objects["test-prefix/1_legacy"] = []byte("legacy")
+
+	result, err := s3service.Claim()
+	assert.NoError(t, err)
+	bodies := []string{}
+	leases := map[string][]string{}
+	for _, m := range result {
+		bodies = append(bodies, m.body)
+		leases[m.key] = append(leases[m.key], m.body)
+	}
+	assert.ElementsMatch(t, []string{"a", "b", "c", "legacy"}, bodies)
+	assert.Len(t, leases, 3)
+
+	// an object holding several events is deleted once they have all been acknowledged
+	for key, events := range leases {
+		if len(events) == 2 {
+			assert.NoError(t, s3service.Ack(key))
+			assert.Contains(t, s3InterfaceMock.keys(), key)
+			assert.NoError(t, s3service.Ack(key))
+			assert.NotContains(t, s3InterfaceMock.keys(), key)
+		}
+	}
+}
+
+func Test_S3_paging(t *testing.T) {
+	s3InterfaceMock := newMemoryS3Interface()
+	for i := 1; i <= 5; i++ {
+		s3InterfaceMock.objects[fmt.Sprintf("test-prefix/%v_uuid", i)] = []byte(fmt.Sprintf("event %v", i))
+	}
+	s3InterfaceMock.uncopyable = map[string]bool{"test-prefix/1_uuid": true}
+	s3service := &s3Service{
+		bucketName:   "test-bucket",
+		prefix:       "test-prefix",
+		svc:          s3InterfaceMock,
+		leaseTimeout: time.Minute,
+		pageSize:     2,
+		workers:      1,
+		lastReap:     time.Now(),
+	}
+
+	bodies := func(msgs []*message) []string {
+		result := []string{}
+		for _, m := range msgs {
+			result = append(result, m.body)
+		}
+		return result
+	}
+	result, err := s3service.Claim()
+	assert.Equal(t, sampleErr, err)
+	assert.Equal(t, []string{"event 2"}, bodies(result))
+
+	// an object that can not be claimed does not hold back the next pages
+	result, err = s3service.Claim()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"event 3", "event 4"}, bodies(result))
+	result, err = s3service.Claim()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"event 5"}, bodies(result))
+	assert.Nil(t, s3service.continuation, "the listing should start again after the last page")
+
+	s3InterfaceMock.uncopyable = nil
+	result, err = s3service.Claim()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"event 1"}, bodies(result))
+	assert.Equal(t, 1, s3InterfaceMock.maxCopying, "claims should be bounded by the workers")
+}
+
+func Test_S3_claimWorkers(t *testing.T) {
+	s3InterfaceMock := newMemoryS3Interface()
+	for i := 0; i < 50; i++ {
+		s3InterfaceMock.objects[fmt.Sprintf("test-prefix/%02d_uuid", i)] = []byte("event")
+	}
+	s3service := &s3Service{
+		bucketName:   "test-bucket",
+		prefix:       "test-prefix",
+		svc:          s3InterfaceMock,
+		leaseTimeout: time.Minute,
+		pageSize:     50,
+		workers:      4,
+		lastReap:     time.Now(),
+	}
+
+	result, err := s3service.Claim()
+
+	assert.NoError(t, err)
+	assert.Len(t, result, 50)
+	assert.True(t, s3InterfaceMock.maxCopying <= 4, "at most 4 objects should be claimed at once, got %v", s3InterfaceMock.maxCopying)
+	assert.True(t, s3InterfaceMock.maxCopying > 1, "objects should be claimed concurrently")
+}
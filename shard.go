@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pborman/uuid"
+)
+
+const (
+	membersSuffix  = "-members"
+	staleMemberAge = time.Hour
+	// shards are named with two hex digits
+	maxShards = 256
+	// length of the uuid objects are named with
+	uuidLength = 36
+)
+
+var (
+	// replicas renew their membership this often, and are considered gone once they
+	// have not renewed it for memberTTL
+	memberHeartbeatInterval = 10 * time.Second
+	memberTTL               = 3 * memberHeartbeatInterval
+)
+
+// listPrefix is a part of the cache listed on its own
+type listPrefix struct {
+	prefix    string
+	delimiter *string
+}
+
+// Member is implemented by caches shared with other replicas, which leave once the
+// processor claiming from them has stopped
+type Member interface {
+	leave()
+}
+
+// newMemberID names a replica after its host, which is the pod name on Kubernetes, and
+// tells apart processes started one after the other on the same host
+func newMemberID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%v-%v", host, uuid.New()[:8])
+}
+
+// shardOf returns the shard a cached object has been put into. Objects put before the
+// cache was sharded belong to the first shard.
+func (s *s3Service) shardOf(key string) int {
+	parts := strings.SplitN(strings.TrimPrefix(key, s.prefix+"/"), "/", 2)
+	if len(parts) < 2 {
+		return 0
+	}
+	shard, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil {
+		return 0
+	}
+	return int(shard)
+}
+
+// shardOfID returns the shard an object is put into, from its uuid
+func (s *s3Service) shardOfID(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(s.shards))
+}
+
+// leaseShard returns the shard of the object a lease has been taken on, from the uuid its
+// name carries after its time. Objects named otherwise belong to the first shard.
+func (s *s3Service) leaseShard(leaseKey string) int {
+	_, name, ok := parseLeaseKey(leaseKey)
+	if !ok {
+		return 0
+	}
+	_, id, ok := splitKey(name)
+	if !ok || len(id) < uuidLength {
+		return 0
+	}
+	return s.shardOfID(id[:uuidLength])
+}
+
+func (s *s3Service) isSharded() bool {
+	return s.shards > 1
+}
+
+// owns tells whether this replica claims the objects of the shard of a key
+func (s *s3Service) owns(key string) bool {
+	if !s.isSharded() {
+		return true
+	}
+	s.shardLock.RLock()
+	defer s.shardLock.RUnlock()
+	return s.owned[s.shardOf(key)]
+}
+
+// ownsLease tells whether this replica reaps an expired lease, for the shard of its object
+func (s *s3Service) ownsLease(leaseKey string) bool {
+	if !s.isSharded() {
+		return true
+	}
+	shard := s.leaseShard(leaseKey)
+	s.shardLock.RLock()
+	defer s.shardLock.RUnlock()
+	return s.owned[shard]
+}
+
+// listPrefixes returns the parts of the cache owned by this replica, in listing order
+func (s *s3Service) listPrefixes() []listPrefix {
+	if !s.isSharded() {
+		return []listPrefix{{prefix: s.prefix + "/"}}
+	}
+	s.shardLock.RLock()
+	defer s.shardLock.RUnlock()
+	prefixes := []listPrefix{}
+	for shard := 0; shard < s.shards; shard++ {
+		if !s.owned[shard] {
+			continue
+		}
+		if shard == 0 {
+			// objects put before the cache was sharded, without listing the shards
+			prefixes = append(prefixes, listPrefix{prefix: s.prefix + "/", delimiter: aws.String("/")})
+		}
+		prefixes = append(prefixes, listPrefix{prefix: fmt.Sprintf("%v/%02x/", s.prefix, shard)})
+	}
+	return prefixes
+}
+
+// startHeartbeat renews the membership of this replica on its own ticker rather than on
+// claims, so that it does not lapse while the processor is halted or its circuit is open
+func (s *s3Service) startHeartbeat() {
+	s.renew()
+	s.heartbeatTicker = time.NewTicker(memberHeartbeatInterval)
+	s.heartbeatDone = make(chan struct{})
+	s.heartbeatWg.Add(1)
+	go func() {
+		defer s.heartbeatWg.Done()
+		for {
+			select {
+			case <-s.heartbeatTicker.C:
+				s.renew()
+			case <-s.heartbeatDone:
+				return
+			}
+		}
+	}()
+}
+
+// renew runs a heartbeat, carrying on with the shards owned so far when it fails
+func (s *s3Service) renew() {
+	err := s.heartbeat(time.Now())
+	s.shardLock.Lock()
+	s.heartbeatError = err
+	s.shardLock.Unlock()
+}
+
+// leave stops the heartbeat and deletes the membership of this replica, so that the other
+// replicas take over its shards without waiting for it to expire
+func (s *s3Service) leave() {
+	// no heartbeat starts once the replica has left
+	s.heartbeatOnce.Do(func() {})
+	if s.heartbeatDone == nil {
+		return
+	}
+	s.heartbeatTicker.Stop()
+	close(s.heartbeatDone)
+	s.heartbeatWg.Wait()
+	_, err := s.svc.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(s.bucketName),
+		Delete: &s3.Delete{Objects: []*s3.ObjectIdentifier{{Key: aws.String(s.prefix + membersSuffix + "/" + s.memberID)}}},
+	})
+	if err != nil && s.uppLogger != nil {
+		s.uppLogger.Infof("Failed to leave the replicas of %v, its shards move once its membership expires: %v\n", s.prefix, err)
+	}
+}
+
+// heartbeat renews the membership of this replica and works out the shards it owns from
+// the replicas that have renewed their membership recently. Every replica assigns the
+// shards the same way, by rendezvous hashing, so that they agree on the owner of each
+// shard without talking to each other, and few shards move when replicas come and go.
+func (s *s3Service) heartbeat(now time.Time) error {
+	membersPrefix := s.prefix + membersSuffix + "/"
+	_, err := s.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Body:   strings.NewReader(""),
+		Key:    aws.String(membersPrefix + s.memberID),
+	})
+	if err != nil {
+		return err
+	}
+	members := []string{s.memberID}
+	// replicas that went away without a trace
+	stale := []*s3.ObjectIdentifier{}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(membersPrefix),
+	}
+	for {
+		out, err := s.svc.ListObjectsV2(input)
+		if err != nil {
+			return err
+		}
+		for _, obj := range out.Contents {
+			member := strings.TrimPrefix(*obj.Key, membersPrefix)
+			if member == s.memberID || obj.LastModified == nil {
+				continue
+			}
+			if age := now.Sub(*obj.LastModified); age < memberTTL {
+				members = append(members, member)
+			} else if age > staleMemberAge && len(stale) < maxDeleteKeys {
+				stale = append(stale, &s3.ObjectIdentifier{Key: obj.Key})
+			}
+		}
+		if !aws.BoolValue(out.IsTruncated) || out.NextContinuationToken == nil {
+			break
+		}
+		input.ContinuationToken = out.NextContinuationToken
+	}
+	sort.Strings(members)
+	if len(stale) > 0 {
+		// any replica may clean up, failing to do so does no harm
+		s.svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucketName),
+			Delete: &s3.Delete{Objects: stale},
+		})
+	}
+
+	owned := map[int]bool{}
+	for shard := 0; shard < s.shards; shard++ {
+		if shardOwner(members, shard) == s.memberID {
+			owned[shard] = true
+		}
+	}
+	s.shardLock.Lock()
+	changed := !sameShards(owned, s.owned)
+	s.owned = owned
+	s.shardLock.Unlock()
+	if changed && s.uppLogger != nil {
+		s.uppLogger.Infof("Claiming %v of the %v shards of %v shared by %v replicas\n", len(owned), s.shards, s.prefix, len(members))
+	}
+	return nil
+}
+
+// shardOwner picks the member with the highest hash of the member and the shard
+func shardOwner(members []string, shard int) string {
+	owner := ""
+	highest := uint64(0)
+	for _, member := range members {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%v/%v", member, shard)))
+		if weight := binary.BigEndian.Uint64(sum[:]); owner == "" || weight > highest {
+			owner = member
+			highest = weight
+		}
+	}
+	return owner
+}
+
+func sameShards(a map[int]bool, b map[int]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for shard := range a {
+		if !b[shard] {
+			return false
+		}
+	}
+	return true
+}
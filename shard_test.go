@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newShardedMock(svc s3Interface, memberID string) *s3Service {
+	return &s3Service{
+		bucketName:   "test-bucket",
+		prefix:       "test-prefix",
+		svc:          svc,
+		leaseTimeout: time.Minute,
+		shards:       8,
+		memberID:     memberID,
+		lastReap:     time.Now(),
+	}
+}
+
+func Test_Shard_Owner(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	owners := map[int]string{}
+	for shard := 0; shard < 64; shard++ {
+		owners[shard] = shardOwner(members, shard)
+		assert.Contains(t, members, owners[shard])
+	}
+
+	// only the shards of the replica that goes away move
+	for shard := 0; shard < 64; shard++ {
+		owner := shardOwner([]string{"a", "b"}, shard)
+		if owners[shard] != "c" {
+			assert.Equal(t, owners[shard], owner)
+		}
+	}
+}
+
+func Test_Shard_ReplicasClaimTheirOwnShards(t *testing.T) {
+	s3InterfaceMock := newMemoryS3Interface()
+	a := newShardedMock(s3InterfaceMock, "replica-a")
+	b := newShardedMock(s3InterfaceMock, "replica-b")
+	assert.NoError(t, a.heartbeat(time.Now()))
+	assert.NoError(t, b.heartbeat(time.Now()))
+	assert.NoError(t, a.heartbeat(time.Now()))
+
+	assert.NotEmpty(t, a.owned)
+	assert.NotEmpty(t, b.owned)
+	for shard := 0; shard < 8; shard++ {
+		assert.True(t, a.owned[shard] != b.owned[shard], "shard %v should be owned by a single replica", shard)
+	}
+
+	events := []string{}
+	for i := 0; i < 40; i++ {
+		events = append(events, fmt.Sprintf("event %v", i))
+		assert.NoError(t, a.Put(events[i]))
+	}
+	// put before the cache was sharded
+	s3InterfaceMock.objects["test-prefix/1_legacy"] = []byte("legacy")
+	events = append(events, "legacy")
+	for _, key := range s3InterfaceMock.keys() {
+		if strings.HasPrefix(key, "test-prefix/") && key != "test-prefix/1_legacy" {
+			assert.Regexp(t, `^test-prefix/0[0-7]/\d+_`, key)
+		}
+	}
+
+	shardOfEvent := map[string]int{}
+	for key, body := range s3InterfaceMock.objects {
+		shardOfEvent[string(body)] = a.shardOf(key)
+	}
+
+	claimed := []string{}
+	for _, replica := range []*s3Service{a, b} {
+		// claims go round the shards owned
+		for i := 0; i < 20; i++ {
+			msgs, err := replica.Claim()
+			assert.NoError(t, err)
+			for _, m := range msgs {
+				claimed = append(claimed, m.body)
+				assert.True(t, replica.owned[shardOfEvent[m.body]], "%v should be claimed by the owner of its shard", m.body)
+			}
+		}
+	}
+	assert.ElementsMatch(t, events, claimed, "each event should be claimed once")
+}
+
+func Test_Shard_ReplicasReapTheirOwnLeases(t *testing.T) {
+	s3InterfaceMock := newMemoryS3Interface()
+	a := newShardedMock(s3InterfaceMock, "replica-a")
+	b := newShardedMock(s3InterfaceMock, "replica-b")
+	assert.NoError(t, a.heartbeat(time.Now()))
+	assert.NoError(t, b.heartbeat(time.Now()))
+	assert.NoError(t, a.heartbeat(time.Now()))
+
+	for i := 0; i < 40; i++ {
+		assert.NoError(t, a.Put(fmt.Sprintf("event %v", i)))
+	}
+	// leases left to expire by a replica that is gone
+	shardOfLease := map[string]int{}
+	for _, key := range s3InterfaceMock.keys() {
+		if !strings.HasPrefix(key, "test-prefix/") {
+			continue
+		}
+		leaseKey := a.leaseKey(key, time.Now().Add(-time.Minute))
+		s3InterfaceMock.objects[leaseKey] = s3InterfaceMock.objects[key]
+		delete(s3InterfaceMock.objects, key)
+		shardOfLease[leaseKey] = a.shardOf(key)
+	}
+
+	reaped := []string{}
+	for _, replica := range []*s3Service{a, b} {
+		expired, err := replica.expiredLeases(time.Now())
+		assert.NoError(t, err)
+		for _, leaseKey := range expired {
+			assert.True(t, replica.owned[shardOfLease[leaseKey]], "%v should be reaped by the owner of its shard", leaseKey)
+		}
+		reaped = append(reaped, expired...)
+	}
+	assert.Len(t, reaped, 40, "each lease should be reaped once")
+	assert.Len(t, shardOfLease, 40)
+}
+
+func Test_Shard_Rebalance(t *testing.T) {
+	s3InterfaceMock := newMemoryS3Interface()
+	a := newShardedMock(s3InterfaceMock, "replica-a")
+	b := newShardedMock(s3InterfaceMock, "replica-b")
+	assert.NoError(t, b.heartbeat(time.Now()))
+	assert.NoError(t, a.heartbeat(time.Now()))
+	assert.True(t, len(a.owned) < 8)
+
+	// b has stopped renewing its membership
+	assert.NoError(t, a.heartbeat(time.Now().Add(memberTTL)))
+	assert.Len(t, a.owned, 8)
+
+	// and is forgotten after a while
+	assert.NoError(t, a.heartbeat(time.Now().Add(2*staleMemberAge)))
+	assert.NotContains(t, s3InterfaceMock.keys(), "test-prefix-members/replica-b")
+}
+
+func Test_Shard_HeartbeatWithoutClaims(t *testing.T) {
+	defer func(interval time.Duration) { memberHeartbeatInterval = interval }(memberHeartbeatInterval)
+	memberHeartbeatInterval = 20 * time.Millisecond
+	s3InterfaceMock := newMemoryS3Interface()
+	a := newShardedMock(s3InterfaceMock, "replica-a")
+	member := "test-prefix-members/replica-a"
+	modified := func() time.Time {
+		s3InterfaceMock.lock.Lock()
+		defer s3InterfaceMock.lock.Unlock()
+		return s3InterfaceMock.modified[member]
+	}
+
+	_, err := a.Claim()
+	assert.NoError(t, err)
+	joined := modified()
+	assert.False(t, joined.IsZero())
+	// e.g. while the processor is halted or its circuit is open
+	assert.True(t, eventually(func() bool { return modified().After(joined) }, time.Second),
+		"the membership should be renewed without claims")
+
+	a.leave()
+	assert.NotContains(t, s3InterfaceMock.keys(), member, "the membership should be deleted on leaving")
+	time.Sleep(3 * memberHeartbeatInterval)
+	assert.NotContains(t, s3InterfaceMock.keys(), member, "the membership should not be renewed after leaving")
+}
+
+func Test_Shard_Unsharded(t *testing.T) {
+	s3service := &s3Service{prefix: "test-prefix"}
+	assert.Equal(t, []listPrefix{{prefix: "test-prefix/"}}, s3service.listPrefixes())
+	assert.True(t, s3service.owns("test-prefix/03/1_uuid"))
+	assert.Equal(t, "test-prefix/1_uuid", s3service.objectKey(time.Unix(0, 1), "uuid", ""))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultSink = "splunk"
+
+// sink describes a kind of destination the forwarder can deliver to
+type sink struct {
+	// name of the destination as shown in the healthchecks
+	name string
+	new  func(config appConfig) Forwarder
+}
+
+var sinks = map[string]sink{
+	"splunk":        {name: "Splunk", new: NewSplunkForwarder},
+	"elasticsearch": {name: "Elasticsearch", new: NewElasticsearchForwarder},
+	"http":          {name: "HTTP destination", new: NewHTTPForwarder},
+}
+
+// NewForwarder creates the forwarder for the sink selected by the configuration
+func NewForwarder(config appConfig) (Forwarder, error) {
+	s, err := lookupSink(config.sink)
+	if err != nil {
+		return nil, err
+	}
+	return s.new(config), nil
+}
+
+// guardForwarder wraps the forwarder of a destination with its concurrency limit, its rate
+// limits and its circuit breaker, so that events held back by the rate limits don't count
+// as failures of the destination
+func guardForwarder(name string, forwarder Forwarder, config appConfig) Forwarder {
+	forwarder = withConcurrencyLimit(name, forwarder, config)
+	forwarder = withRateLimit(name, forwarder, config)
+	return withBreaker(name, forwarder, config)
+}
+
+func lookupSink(name string) (sink, error) {
+	if name == "" {
+		name = defaultSink
+	}
+	s, ok := sinks[name]
+	if !ok {
+		return sink{}, fmt.Errorf("unknown sink %q, expected one of %v", name, sinkNames())
+	}
+	return s, nil
+}
+
+func sinkNames() string {
+	names := []string{}
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// httpSink holds the plumbing shared by the sinks posting to a plain HTTP endpoint:
+// metrics, throttling and health
+type httpSink struct {
+	sync.Mutex
+	config      appConfig
+	client      *http.Client
+	throttle    *throttle
+	latestError error
+}
+
+func newHTTPSink(config appConfig) *httpSink {
+	initMetrics()
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: config.workers,
+	}
+	return &httpSink{
+		config:   config,
+		client:   &http.Client{Transport: transport, Timeout: config.requestTimeout},
+		throttle: newThrottle(),
+	}
+}
+
+// post sends the body, waiting and sending it again while the destination is throttling,
+// for a while at most
+func (sink *httpSink) post(url string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	requestBytes.Add(float64(len(body)))
+	var waited time.Duration
+	for {
+		if !sink.throttle.wait(&waited) {
+			return nil, nil, errThrottled
+		}
+		r, buf, err := sink.send(url, header, body)
+		if err != nil {
+			return nil, nil, err
+		}
+		pause, hasRetryAfter := retryAfter(r.Header, time.Now())
+		if r.StatusCode != http.StatusTooManyRequests && !(r.StatusCode == http.StatusServiceUnavailable && hasRetryAfter) {
+			return r, buf, nil
+		}
+		throttledCounter.Inc()
+		sink.config.UPPLogger.Infof("Destination is throttling requests with status code %v, pausing for %v\n", r.StatusCode, pause)
+		sink.throttle.pauseFor(pause)
+	}
+}
+
+func (sink *httpSink) send(url string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	prometheusTimer := prometheus.NewTimer(postTime)
+	defer prometheusTimer.ObserveDuration()
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header = header
+	requestCounter.Inc()
+	sentBytes.Add(float64(len(body)))
+	r, err := sink.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Body.Close()
+	buf, err := ioutil.ReadAll(r.Body)
+	return r, buf, err
+}
+
+// reject fails a whole batch after an unexpected response status
+func (sink *httpSink) reject(batch []*message, r *http.Response, buf []byte, callback func(*message, error)) {
+	errorCounter.Inc()
+	sinkErr := &sinkError{status: r.StatusCode, text: string(buf), policy: policyForStatus(r.StatusCode)}
+	sink.config.UPPLogger.Infof("Unexpected status code %v when sending %v events to %v\n", r.StatusCode, len(batch), sink.config.fwdURL)
+	if sinkErr.policy == policyDeadLetter {
+		sink.setHealth(nil)
+	} else {
+		sink.setHealth(sinkErr)
+	}
+	for _, m := range batch {
+		callback(m, sinkErr)
+	}
+}
+
+// fail fails a whole batch after a request error
+func (sink *httpSink) fail(batch []*message, err error, callback func(*message, error)) {
+	errorCounter.Inc()
+	sink.config.UPPLogger.Infof(err.Error())
+	sink.setHealth(err)
+	for _, m := range batch {
+		callback(m, err)
+	}
+}
+
+func (sink *httpSink) stopping() {
+	sink.throttle.stopping()
+}
+
+func (sink *httpSink) pausedUntil() time.Time {
+	return sink.throttle.pausedUntil()
+}
+
+func (sink *httpSink) getHealth() error {
+	sink.Lock()
+	defer sink.Unlock()
+	return sink.latestError
+}
+
+func (sink *httpSink) setHealth(err error) {
+	sink.Lock()
+	defer sink.Unlock()
+	sink.latestError = err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewForwarder(t *testing.T) {
+	sinkConfig := config
+
+	sinkConfig.sink = ""
+	forwarder, err := NewForwarder(sinkConfig)
+	assert.NoError(t, err)
+	assert.IsType(t, &splunkClient{}, forwarder)
+
+	sinkConfig.sink = "elasticsearch"
+	forwarder, err = NewForwarder(sinkConfig)
+	assert.NoError(t, err)
+	assert.IsType(t, &elasticsearchClient{}, forwarder)
+
+	sinkConfig.sink = "http"
+	forwarder, err = NewForwarder(sinkConfig)
+	assert.NoError(t, err)
+	assert.IsType(t, &httpJSONClient{}, forwarder)
+}
+
+func Test_NewForwarder_UnknownSink(t *testing.T) {
+	sinkConfig := config
+	sinkConfig.sink = "carrier-pigeon"
+
+	_, err := NewForwarder(sinkConfig)
+
+	assert.EqualError(t, err, `unknown sink "carrier-pigeon", expected one of elasticsearch, http, splunk`)
+}
+
+func Test_ValidateParams_TokenOptionalForOtherSinks(t *testing.T) {
+	sinkConfig := config
+	sinkConfig.sink = "http"
+	sinkConfig.token = ""
+
+	assert.NoError(t, validateParams(sinkConfig))
+
+	sinkConfig.sink = "splunk"
+	assert.Error(t, validateParams(sinkConfig))
+}
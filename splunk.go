@@ -1,14 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/tls"
-	"errors"
-	"io"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/pborman/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -16,21 +19,38 @@ var (
 	requestCounter   prometheus.Counter
 	errorCounter     prometheus.Counter
 	discardedCounter prometheus.Counter
+	requestBytes     prometheus.Counter
+	sentBytes        prometheus.Counter
 	postTime         prometheus.Observer
 )
 
 type Forwarder interface {
 	Healthy
-	forward(s string, callback func(string, error))
+	// forward sends a batch of events and invokes the callback once per event
+	forward(batch []*message, callback func(*message, error))
 }
 
+const channelHeader = "X-Splunk-Request-Channel"
+
 type splunkClient struct {
 	sync.Mutex
 	config      appConfig
 	client      *http.Client
+	channel     string
+	acks        *ackTracker
+	throttle    *throttle
 	latestError error
 }
 
+// hecResponse is the JSON body returned by the HEC endpoints
+type hecResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId,omitempty"`
+	// index of the event that caused a batch to be rejected
+	InvalidEventNumber *int `json:"invalid-event-number,omitempty"`
+}
+
 func NewSplunkForwarder(config appConfig) Forwarder {
 	initMetrics()
 	tlsConfig := &tls.Config{InsecureSkipVerify: true}
@@ -38,45 +58,161 @@ func NewSplunkForwarder(config appConfig) Forwarder {
 		TLSClientConfig:     tlsConfig,
 		MaxIdleConnsPerHost: config.workers,
 	}
-	client := &http.Client{Transport: transport}
+	client := &http.Client{Transport: transport, Timeout: config.requestTimeout}
+
+	splunk := &splunkClient{
+		client:   client,
+		config:   config,
+		throttle: newThrottle(),
+	}
+	if config.ack {
+		splunk.channel = uuid.New()
+		splunk.acks = newAckTracker(client, config, splunk.channel)
+		splunk.acks.start()
+	}
+	return splunk
+}
+
+func (splunk *splunkClient) forward(batch []*message, callback func(*message, error)) {
+	// HEC accepts several events in a single request body, one after the other
+	body := []byte(joinBodies(batch))
+	requestBytes.Add(float64(len(body)))
+	compressed := false
+	if splunk.config.gzip && len(body) >= splunk.config.gzipMinSize {
+		gzipped, err := compress(body, splunk.config.gzipLevel)
+		if err != nil {
+			splunk.config.UPPLogger.Infof("Sending uncompressed request: %v", err)
+		} else {
+			body = gzipped
+			compressed = true
+		}
+	}
+
+	var r *http.Response
+	var resp hecResponse
+	var err error
+	var waited time.Duration
+	for {
+		// all workers hold their batches while the destination asks us to back off, for
+		// a while at most
+		if !splunk.throttle.wait(&waited) {
+			err = errThrottled
+			break
+		}
+		r, resp, err = splunk.post(body, compressed)
+		if err != nil {
+			break
+		}
+		pause, throttled := throttledFor(r, resp)
+		if !throttled {
+			break
+		}
+		throttledCounter.Inc()
+		splunk.config.UPPLogger.Infof("Splunk is throttling requests with status code %v (%v), pausing for %v\n", r.StatusCode, resp.Text, pause)
+		splunk.throttle.pauseFor(pause)
+	}
+
+	if err != nil {
+		errorCounter.Inc()
+		splunk.config.UPPLogger.Infof(err.Error())
+		splunk.setHealth(err)
+		for _, m := range batch {
+			callback(m, err)
+		}
+		return
+	}
 
-	return &splunkClient{
-		client: client,
-		config: config,
+	if r.StatusCode == 200 {
+		splunk.setHealth(nil)
+		if splunk.acks != nil && resp.AckID != nil {
+			// the events have been received but the callback waits until they are indexed
+			splunk.acks.add(*resp.AckID, batch, callback)
+			return
+		}
+		for _, m := range batch {
+			callback(m, nil)
+		}
+		return
+	}
+
+	errorCounter.Inc()
+	hecErrorCounter.WithLabelValues(hecCodeLabel(r.StatusCode, resp)).Inc()
+	hecErr := newHecError(r.StatusCode, resp)
+	splunk.config.UPPLogger.Infof("Unexpected status code %v (%v) when sending %v events to %v\n", r.StatusCode, hecErr, len(batch), splunk.config.fwdURL)
+	switch hecErr.policy {
+	case policyRetry, policyStop:
+		splunk.setHealth(hecErr)
+	default:
+		// the destination is fine, the events are not
+		splunk.setHealth(nil)
+	}
+
+	// HEC stops at the first invalid event: the ones before it have been accepted
+	// and the ones after it have not been looked at
+	invalid := -1
+	if n := resp.InvalidEventNumber; n != nil && *n >= 0 && *n < len(batch) {
+		invalid = *n
+	}
+	notProcessed := &hecError{status: r.StatusCode, code: hecErr.code, text: "event not processed", policy: policyRetry}
+	for i, m := range batch {
+		switch {
+		case i < invalid:
+			callback(m, nil)
+		case i == invalid || invalid < 0:
+			if hecErr.policy == policyDiscard {
+				discardedCounter.Inc()
+			}
+			callback(m, hecErr)
+		default:
+			callback(m, notProcessed)
+		}
 	}
 }
 
-func (splunk *splunkClient) forward(s string, callback func(string, error)) {
+// post sends a request body to HEC and decodes the JSON response, if any
+func (splunk *splunkClient) post(body []byte, compressed bool) (*http.Response, hecResponse, error) {
 	prometheusTimer := prometheus.NewTimer(postTime)
 	defer prometheusTimer.ObserveDuration()
 
-	req, err := http.NewRequest("POST", splunk.config.fwdURL, strings.NewReader(s))
+	resp := hecResponse{}
+	req, err := http.NewRequest("POST", splunk.config.fwdURL, bytes.NewReader(body))
 	if err != nil {
-		splunk.config.UPPLogger.Infof(err.Error())
+		return nil, resp, err
+	}
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
 	}
 	tokenWithKeyword := strings.Join([]string{"Splunk", splunk.config.token}, " ") //join strings "Splunk" and value of -token argument
 	req.Header.Set("Authorization", tokenWithKeyword)
+	if splunk.channel != "" {
+		req.Header.Set(channelHeader, splunk.channel)
+	}
 	requestCounter.Inc()
+	sentBytes.Add(float64(len(body)))
 	r, err := splunk.client.Do(req)
 	if err != nil {
-		errorCounter.Inc()
-		splunk.config.UPPLogger.Infof(err.Error())
-	} else {
-		defer r.Body.Close()
-		io.Copy(ioutil.Discard, r.Body)
-		if r.StatusCode != 200 {
-			errorCounter.Inc()
-			splunk.config.UPPLogger.Infof("Unexpected status code %v (%v) when sending %v to %v\n", r.StatusCode, r.Status, s, splunk.config.fwdURL)
-			if r.StatusCode != 400 {
-				err = errors.New(r.Status)
-			} else {
-				discardedCounter.Inc()
-				splunk.config.UPPLogger.Infof("Discarding malformed message\n")
-			}
-		}
+		return nil, resp, err
+	}
+	defer r.Body.Close()
+	buf, _ := ioutil.ReadAll(r.Body)
+	// not every response carries a HEC body, e.g. those coming from a load balancer
+	json.Unmarshal(buf, &resp)
+	return r, resp, nil
+}
+
+func (splunk *splunkClient) stopping() {
+	splunk.throttle.stopping()
+}
+
+// stop stops polling for indexer acknowledgements
+func (splunk *splunkClient) stop() {
+	if splunk.acks != nil {
+		splunk.acks.stop()
 	}
-	splunk.setHealth(err)
-	callback(s, err)
+}
+
+func (splunk *splunkClient) pausedUntil() time.Time {
+	return splunk.throttle.pausedUntil()
 }
 
 func (splunk *splunkClient) getHealth() error {
@@ -91,9 +227,38 @@ func (splunk *splunkClient) setHealth(err error) {
 	splunk.latestError = err
 }
 
+func joinBodies(batch []*message) string {
+	bodies := make([]string, len(batch))
+	for i, m := range batch {
+		bodies[i] = m.body
+	}
+	return strings.Join(bodies, "\n")
+}
+
+func compress(body []byte, level int) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(body); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func initMetrics() {
+	if postTime != nil {
+		return
+	}
 	postTime = registerHistogram("post_time", "HTTP Post time", []float64{.002, .003, .0035, .004, .0045, .005, .006, .007, .008, .009})
 	errorCounter = registerCounter("error_count", "Number of errors connecting to splunk")
 	requestCounter = registerCounter("request_count", "Number of requests to splunk")
 	discardedCounter = registerCounter("discarded_count", "Number of discarded messages")
+	requestBytes = registerCounter("request_bytes", "Size of HEC request bodies before compression")
+	sentBytes = registerCounter("sent_bytes", "Size of HEC request bodies as sent, after compression")
+	hecErrorCounter = registerCounterVec("hec_error_count", "Number of HEC error responses by HEC status code", "code")
 }
@@ -1,6 +1,12 @@
 package main
 
 import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
@@ -43,24 +49,60 @@ func (splunk *splunkMock) getErrorCount() int {
 
 type s3ServiceMock struct {
 	sync.RWMutex
-	cache []string
+	cache       []string
+	deadLetters []string
+	acked       int
 }
 
 var splunk = splunkMock{}
 
-func (s3 *s3ServiceMock) ListAndDelete() ([]string, error) {
+func (s3 *s3ServiceMock) Claim() ([]*message, error) {
 	s3.Lock()
 	items := s3.cache
 	s3.cache = make([]string, 0)
 	s3.Unlock()
-	return items, nil
+	msgs := []*message{}
+	for i, item := range items {
+		msgs = append(msgs, &message{body: item, key: fmt.Sprintf("lease-%v", i)})
+	}
+	return msgs, nil
+}
+
+func (s3 *s3ServiceMock) Ack(keys ...string) error {
+	s3.Lock()
+	s3.acked += len(keys)
+	s3.Unlock()
+	return nil
+}
+
+func (s3 *s3ServiceMock) getAcked() int {
+	s3.RLock()
+	defer s3.RUnlock()
+	return s3.acked
+}
+
+func (s3 *s3ServiceMock) Put(objs ...string) error {
+	s3.Lock()
+	defer s3.Unlock()
+	for _, obj := range objs {
+		obj = strings.Replace(obj, "retry", "safe", -1)
+		obj = strings.Replace(obj, "error", "retry", -1)
+		s3.cache = append(s3.cache, obj)
+	}
+	return nil
 }
 
-func (s3 *s3ServiceMock) Put(obj string) error {
-	obj = strings.Replace(obj, "retry", "safe", -1)
-	obj = strings.Replace(obj, "error", "retry", -1)
+func (s3 *s3ServiceMock) Requeue(msgs ...*message) error {
+	objs := []string{}
+	for _, m := range msgs {
+		objs = append(objs, m.body)
+	}
+	return s3.Put(objs...)
+}
+
+func (s3 *s3ServiceMock) DeadLetter(obj string, reason error) error {
 	s3.Lock()
-	s3.cache = append(s3.cache, obj)
+	s3.deadLetters = append(s3.deadLetters, obj)
 	s3.Unlock()
 	return nil
 }
@@ -69,6 +111,14 @@ func (s3 *s3ServiceMock) getHealth() error {
 	return nil
 }
 
+func messages(bodies ...string) []*message {
+	msgs := []*message{}
+	for _, body := range bodies {
+		msgs = append(msgs, &message{body: body})
+	}
+	return msgs
+}
+
 func Test_Forwarder(t *testing.T) {
 	s3 := &s3ServiceMock{}
 	splunkForwarder := NewSplunkForwarder(config)
@@ -88,7 +138,7 @@ func Test_Forwarder(t *testing.T) {
 	time.Sleep(3 * time.Second)
 
 	go func() {
-		logProcessor.Stop()
+		logProcessor.Stop(time.Now().Add(config.gracePeriod))
 	}()
 
 	assert.Equal(t, messageCount, len(splunk.getIndex()))
@@ -96,3 +146,106 @@ func Test_Forwarder(t *testing.T) {
 	assert.Equal(t, nil, splunkForwarder.getHealth())
 	assert.Contains(t, strings.Join(splunk.getIndex(), ""), "simulated_safe")
 }
+
+func newRecordingServer(t *testing.T, encodings chan<- string, bodies chan<- string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			assert.NoError(t, err)
+			body = gz
+		}
+		buf, err := ioutil.ReadAll(body)
+		assert.NoError(t, err)
+		encodings <- r.Header.Get("Content-Encoding")
+		bodies <- string(buf)
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func Test_Forwarder_Gzip(t *testing.T) {
+	encodings := make(chan string, 1)
+	bodies := make(chan string, 1)
+	server := newRecordingServer(t, encodings, bodies)
+	defer server.Close()
+
+	gzipConfig := config
+	gzipConfig.fwdURL = server.URL
+	gzipConfig.gzip = true
+	gzipConfig.gzipLevel = gzip.BestCompression
+	gzipConfig.gzipMinSize = 10
+	forwarder := NewSplunkForwarder(gzipConfig)
+
+	forwarder.forward(messages(`{"event":"first"}`, `{"event":"second"}`), func(m *message, err error) {
+		assert.NoError(t, err)
+	})
+
+	assert.Equal(t, "gzip", <-encodings)
+	assert.Equal(t, "{\"event\":\"first\"}\n{\"event\":\"second\"}", <-bodies)
+}
+
+func Test_Forwarder_GzipBelowMinSize(t *testing.T) {
+	encodings := make(chan string, 1)
+	bodies := make(chan string, 1)
+	server := newRecordingServer(t, encodings, bodies)
+	defer server.Close()
+
+	gzipConfig := config
+	gzipConfig.fwdURL = server.URL
+	gzipConfig.gzip = true
+	gzipConfig.gzipLevel = gzip.DefaultCompression
+	gzipConfig.gzipMinSize = 1024
+	forwarder := NewSplunkForwarder(gzipConfig)
+
+	forwarder.forward(messages(`{"event":"small"}`), func(m *message, err error) {
+		assert.NoError(t, err)
+	})
+
+	assert.Equal(t, "", <-encodings)
+	assert.Equal(t, `{"event":"small"}`, <-bodies)
+}
+
+func Test_Forwarder_InvalidEventNumber(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"text":"Invalid data format","code":6,"invalid-event-number":1}`))
+	}))
+	defer server.Close()
+
+	invalidConfig := config
+	invalidConfig.fwdURL = server.URL
+	forwarder := NewSplunkForwarder(invalidConfig)
+
+	policies := map[string]errorPolicy{}
+	forwarder.forward(messages("indexed", "invalid", "not processed"), func(m *message, err error) {
+		if err == nil {
+			policies[m.body] = -1
+			return
+		}
+		policies[m.body] = policyOf(err)
+	})
+
+	assert.Equal(t, errorPolicy(-1), policies["indexed"])
+	assert.Equal(t, policyDeadLetter, policies["invalid"])
+	assert.Equal(t, policyRetry, policies["not processed"])
+	assert.NoError(t, forwarder.getHealth())
+}
+
+func Test_Forwarder_InvalidToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"text":"Invalid token","code":4}`))
+	}))
+	defer server.Close()
+
+	invalidConfig := config
+	invalidConfig.fwdURL = server.URL
+	forwarder := NewSplunkForwarder(invalidConfig)
+
+	forwarder.forward(messages("first", "second"), func(m *message, err error) {
+		assert.Equal(t, policyStop, policyOf(err))
+	})
+
+	assert.Error(t, forwarder.getHealth())
+}
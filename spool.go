@@ -0,0 +1,554 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	spoolSuffix = ".spool"
+	// segments are closed once they reach this size, or when the ones before them are flushed
+	spoolSegmentBytes  = 4 * 1024 * 1024
+	spoolFlushInterval = time.Second
+	// every record starts with the length and the CRC32 of the event
+	spoolHeaderSize = 8
+	// the length of a requeued event is flagged, and followed by its attempts and first failure
+	spoolRequeuedFlag = 1 << 31
+	spoolAttemptsSize = 12
+)
+
+// what to do with an event when the spool is full
+const (
+	overflowS3         = "s3"
+	overflowDropOldest = "drop-oldest"
+	overflowReject     = "reject"
+)
+
+var errSpoolFull = errors.New("local spool is full")
+
+var (
+	spoolBytesGauge      prometheus.Gauge
+	spoolFlushedCounter  prometheus.Counter
+	spoolOverflowCounter prometheus.Counter
+	spoolDroppedCounter  prometheus.Counter
+)
+
+// diskSpool is a write-ahead spool on local disk in front of the S3 cache. Events are
+// appended to segment files and synced before Put or Requeue returns, and a background
+// flusher writes them to S3, oldest segment first, deleting each segment once it is
+// flushed. Claims, acknowledgements and dead letters go to S3 directly.
+type diskSpool struct {
+	sync.Mutex
+	s3       Cache
+	dir      string
+	maxBytes int64
+	overflow string
+	// events flushed to S3 at once
+	batchSize int
+	uppLogger *logger.UPPLogger
+	// closed segments waiting to be flushed, oldest first
+	segments []*spoolSegment
+	// segment being appended to, if any
+	current     *spoolSegment
+	file        *os.File
+	size        int64
+	nextSeq     int64
+	latestError error
+	// only one flush runs at a time
+	flushLock sync.Mutex
+	stopChan  chan struct{}
+	wg        sync.WaitGroup
+}
+
+// spoolRecord is a spooled event, along with its failed attempts when it has been requeued
+type spoolRecord struct {
+	body      string
+	requeued  bool
+	attempts  int
+	firstSeen time.Time
+}
+
+type spoolSegment struct {
+	path   string
+	bytes  int64
+	events int
+	// events of the segment already written to S3
+	flushed int
+}
+
+// newDiskSpool opens the spool directory, picking up the segments left by a previous run
+func newDiskSpool(s3 Cache, config appConfig) (*diskSpool, error) {
+	if spoolBytesGauge == nil {
+		spoolBytesGauge = registerGauge("spool_bytes", "Size in bytes of the events in the local spool")
+		spoolFlushedCounter = registerCounter("spool_flushed_count", "Number of events flushed from the local spool to S3")
+		spoolOverflowCounter = registerCounter("spool_overflow_count", "Number of events that did not fit into the local spool")
+		spoolDroppedCounter = registerCounter("spool_dropped_count", "Number of spooled events dropped to make room for newer ones")
+	}
+	if err := os.MkdirAll(config.spoolDir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create spool directory: %v", err)
+	}
+	batchSize := config.cacheBatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	s := &diskSpool{
+		s3:        s3,
+		dir:       config.spoolDir,
+		maxBytes:  config.spoolMaxBytes,
+		overflow:  config.spoolOverflow,
+		batchSize: batchSize,
+		uppLogger: config.UPPLogger,
+		stopChan:  make(chan struct{}),
+	}
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolSuffix))
+	if err != nil {
+		return nil, err
+	}
+	// segment names are zero-padded sequence numbers
+	sort.Strings(paths)
+	events := 0
+	for _, path := range paths {
+		records, bytes, err := readSpoolSegment(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read spool segment %v: %v", path, err)
+		}
+		s.segments = append(s.segments, &spoolSegment{path: path, bytes: bytes, events: len(records)})
+		s.size += bytes
+		events += len(records)
+		seq, _ := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), spoolSuffix), 10, 64)
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+	if events > 0 {
+		s.uppLogger.Infof("Found %v spooled events to flush to S3\n", events)
+	}
+	spoolBytesGauge.Set(float64(s.size))
+	return s, nil
+}
+
+func (s *diskSpool) start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(spoolFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopChan:
+				return
+			case <-ticker.C:
+				if err := s.flush(); err != nil {
+					s.uppLogger.Infof("Unexpected error when flushing the spool to S3: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// stop flushes what is left in the spool until the deadline. Events that could not be
+// flushed stay on disk for the next run.
+func (s *diskSpool) stop(deadline time.Time) {
+	close(s.stopChan)
+	s.wg.Wait()
+	err := s.flush()
+	for err != nil && time.Now().Add(spoolFlushInterval).Before(deadline) {
+		time.Sleep(spoolFlushInterval)
+		err = s.flush()
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.seal()
+	if left := s.pendingEvents(); left > 0 {
+		s.uppLogger.Infof("%v events left in the spool on shutdown: %v\n", left, err)
+	}
+}
+
+// Put appends events to the spool and syncs them to disk. When the spool is full the
+// overflow policy decides whether events go to S3 straight away, make room by dropping
+// the oldest spooled events, or are rejected. Events the spool fails to write go to S3.
+func (s *diskSpool) Put(objs ...string) error {
+	records := []*spoolRecord{}
+	for _, obj := range objs {
+		records = append(records, &spoolRecord{body: obj})
+	}
+	rest, err := s.append(records)
+	if len(rest) == 0 {
+		return nil
+	}
+	if err == errSpoolFull && s.overflow != overflowS3 {
+		return err
+	}
+	objs = []string{}
+	for _, r := range rest {
+		objs = append(objs, r.body)
+	}
+	return s.s3.Put(objs...)
+}
+
+// Requeue spools messages that have failed again along with their count of attempts and
+// first failure, which are written to the object metadata once they are flushed to S3.
+// When the spool is full the overflow policy applies as it does to Put.
+func (s *diskSpool) Requeue(msgs ...*message) error {
+	records := []*spoolRecord{}
+	fannedOut := []*message{}
+	for _, m := range msgs {
+		if len(m.fannedOut) > 0 {
+			fannedOut = append(fannedOut, m)
+			continue
+		}
+		records = append(records, &spoolRecord{body: m.body, requeued: true, attempts: m.attempts, firstSeen: m.firstSeen})
+	}
+	if len(fannedOut) > 0 {
+		// the destinations that have taken them are only recorded in S3
+		if err := s.s3.Requeue(fannedOut...); err != nil {
+			return err
+		}
+	}
+	rest, err := s.append(records)
+	if len(rest) == 0 {
+		return nil
+	}
+	if err == errSpoolFull && s.overflow != overflowS3 {
+		return err
+	}
+	return s.s3.Requeue(recordMessages(rest)...)
+}
+
+// append writes events to the current segment, and returns those it has not written:
+// with errSpoolFull those that don't fit, or with the error the events left once writing
+// to disk fails. Unless they overflow to S3, events are only spooled if they all fit, so
+// that the events rejected are never spooled as well.
+func (s *diskSpool) append(records []*spoolRecord) ([]*spoolRecord, error) {
+	s.Lock()
+	defer s.Unlock()
+	encoded := make([][]byte, len(records))
+	total := int64(0)
+	for i, r := range records {
+		encoded[i] = encodeSpoolRecord(r)
+		total += int64(len(encoded[i]))
+	}
+	if (s.overflow == overflowReject && s.size+total > s.maxBytes) || (s.overflow == overflowDropOldest && total > s.maxBytes) {
+		spoolOverflowCounter.Add(float64(len(records)))
+		return records, errSpoolFull
+	}
+	rest := []*spoolRecord{}
+	var err error
+	for i, r := range records {
+		if err != nil {
+			rest = append(rest, r)
+			continue
+		}
+		record := encoded[i]
+		if s.size+int64(len(record)) > s.maxBytes {
+			if s.overflow != overflowDropOldest || !s.makeRoom(int64(len(record))) {
+				spoolOverflowCounter.Inc()
+				rest = append(rest, r)
+				continue
+			}
+		}
+		if s.current == nil || s.current.bytes >= spoolSegmentBytes {
+			if err = s.open(); err != nil {
+				rest = append(rest, r)
+				continue
+			}
+		}
+		if _, err = s.file.Write(record); err != nil {
+			// a partly written record ends the segment, and is skipped when it is read
+			s.seal()
+			rest = append(rest, r)
+			continue
+		}
+		s.current.bytes += int64(len(record))
+		s.current.events++
+		s.size += int64(len(record))
+	}
+	spoolBytesGauge.Set(float64(s.size))
+	if err == nil && s.file != nil {
+		// the events written are in the segment whether or not they are synced, so they
+		// are not handed to S3 as well
+		if err = s.file.Sync(); err != nil {
+			s.seal()
+		}
+	}
+	s.latestError = err
+	if err != nil {
+		s.uppLogger.Errorf("Failed to write to the local spool, %v events go to S3 instead: %v\n", len(rest), err)
+		return rest, err
+	}
+	if len(rest) > 0 {
+		return rest, errSpoolFull
+	}
+	return nil, nil
+}
+
+// makeRoom drops the oldest segments until the record fits, and tells whether it does
+func (s *diskSpool) makeRoom(record int64) bool {
+	for s.size+record > s.maxBytes {
+		if len(s.segments) == 0 {
+			if s.current == nil {
+				return false
+			}
+			s.seal()
+			if len(s.segments) == 0 {
+				return false
+			}
+		}
+		oldest := s.segments[0]
+		s.uppLogger.Errorf("Local spool is full, dropping %v events of %v\n", oldest.events-oldest.flushed, oldest.path)
+		spoolDroppedCounter.Add(float64(oldest.events - oldest.flushed))
+		s.remove(oldest)
+	}
+	return true
+}
+
+// open starts a new segment, closing the current one
+func (s *diskSpool) open() error {
+	if err := s.seal(); err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%v", s.nextSeq, spoolSuffix))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	// the new file must outlive a crash too
+	if err := syncDir(s.dir); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	s.nextSeq++
+	s.file = file
+	s.current = &spoolSegment{path: path}
+	return nil
+}
+
+// seal syncs and closes the current segment so that it can be flushed
+func (s *diskSpool) seal() error {
+	if s.current == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	s.file.Close()
+	if s.current.events > 0 {
+		s.segments = append(s.segments, s.current)
+	} else {
+		os.Remove(s.current.path)
+	}
+	s.current = nil
+	s.file = nil
+	return err
+}
+
+// remove deletes a segment, which may have been removed already
+func (s *diskSpool) remove(segment *spoolSegment) {
+	for i, seg := range s.segments {
+		if seg == segment {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			s.size -= segment.bytes
+			spoolBytesGauge.Set(float64(s.size))
+			os.Remove(segment.path)
+			return
+		}
+	}
+}
+
+// flush writes the spooled events to S3 until the spool is empty, stopping at the
+// first failure
+func (s *diskSpool) flush() error {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+	for {
+		s.Lock()
+		// keep appending to the current segment while S3 is behind, rather than
+		// closing a small segment on every flush
+		if len(s.segments) == 0 {
+			s.seal()
+		}
+		segments := append([]*spoolSegment{}, s.segments...)
+		s.Unlock()
+		if len(segments) == 0 {
+			return nil
+		}
+		for _, segment := range segments {
+			if err := s.flushSegment(segment); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// flushSegment writes the events of a segment to S3, a batch at a time, and deletes it
+func (s *diskSpool) flushSegment(segment *spoolSegment) error {
+	records, _, err := readSpoolSegment(segment.path)
+	if os.IsNotExist(err) {
+		// dropped to make room
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(records) < segment.events {
+		s.uppLogger.Errorf("Spool segment %v is corrupted, %v events are lost\n", segment.path, segment.events-len(records))
+	}
+	s.Lock()
+	flushed := segment.flushed
+	s.Unlock()
+	for flushed < len(records) {
+		// a batch only holds events failed as many times, so that it is written at once
+		n := 1
+		for n < s.batchSize && flushed+n < len(records) && sameAttempts(records[flushed], records[flushed+n]) {
+			n++
+		}
+		if err := s.flushRecords(records[flushed : flushed+n]); err != nil {
+			return err
+		}
+		flushed += n
+		spoolFlushedCounter.Add(float64(n))
+		s.Lock()
+		segment.flushed = flushed
+		s.Unlock()
+	}
+	s.Lock()
+	s.remove(segment)
+	s.Unlock()
+	return nil
+}
+
+// flushRecords writes events to S3, keeping the attempts of requeued events
+func (s *diskSpool) flushRecords(records []*spoolRecord) error {
+	if records[0].requeued {
+		return s.s3.Requeue(recordMessages(records)...)
+	}
+	objs := []string{}
+	for _, r := range records {
+		objs = append(objs, r.body)
+	}
+	return s.s3.Put(objs...)
+}
+
+func sameAttempts(a *spoolRecord, b *spoolRecord) bool {
+	return a.requeued == b.requeued && a.attempts == b.attempts
+}
+
+func recordMessages(records []*spoolRecord) []*message {
+	msgs := []*message{}
+	for _, r := range records {
+		msgs = append(msgs, &message{body: r.body, attempts: r.attempts, firstSeen: r.firstSeen})
+	}
+	return msgs
+}
+
+func (s *diskSpool) pendingEvents() int {
+	events := 0
+	for _, segment := range s.segments {
+		events += segment.events - segment.flushed
+	}
+	return events
+}
+
+func (s *diskSpool) Claim() ([]*message, error) {
+	return s.s3.Claim()
+}
+
+func (s *diskSpool) leave() {
+	if member, ok := s.s3.(Member); ok {
+		member.leave()
+	}
+}
+
+func (s *diskSpool) Ack(keys ...string) error {
+	return s.s3.Ack(keys...)
+}
+
+func (s *diskSpool) DeadLetter(obj string, reason error) error {
+	return s.s3.DeadLetter(obj, reason)
+}
+
+func (s *diskSpool) getHealth() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.latestError
+}
+
+// encodeSpoolRecord writes the length and checksum of an event followed by the event,
+// preceded by its attempts and first failure when it has been requeued
+func encodeSpoolRecord(r *spoolRecord) []byte {
+	payload := []byte(r.body)
+	length := uint32(len(r.body))
+	if r.requeued {
+		payload = make([]byte, spoolAttemptsSize+len(r.body))
+		binary.BigEndian.PutUint32(payload, uint32(r.attempts))
+		if !r.firstSeen.IsZero() {
+			binary.BigEndian.PutUint64(payload[4:], uint64(r.firstSeen.UnixNano()))
+		}
+		copy(payload[spoolAttemptsSize:], r.body)
+		length = uint32(len(payload)) | spoolRequeuedFlag
+	}
+	record := make([]byte, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record, length)
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	copy(record[spoolHeaderSize:], payload)
+	return record
+}
+
+// readSpoolSegment returns the events of a segment and its size. Reading stops at the
+// first record that is incomplete or does not match its checksum.
+func readSpoolSegment(path string) ([]*spoolRecord, int64, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	records := []*spoolRecord{}
+	for rest := buf; len(rest) >= spoolHeaderSize; {
+		length := binary.BigEndian.Uint32(rest)
+		requeued := length&spoolRequeuedFlag != 0
+		length &^= spoolRequeuedFlag
+		checksum := binary.BigEndian.Uint32(rest[4:])
+		if len(rest) < spoolHeaderSize+int(length) {
+			break
+		}
+		payload := rest[spoolHeaderSize : spoolHeaderSize+int(length)]
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+		r := &spoolRecord{body: string(payload)}
+		if requeued {
+			if len(payload) < spoolAttemptsSize {
+				break
+			}
+			r.requeued = true
+			r.attempts = int(binary.BigEndian.Uint32(payload))
+			if nanos := int64(binary.BigEndian.Uint64(payload[4:])); nanos != 0 {
+				r.firstSeen = time.Unix(0, nanos)
+			}
+			r.body = string(payload[spoolAttemptsSize:])
+		}
+		records = append(records, r)
+		rest = rest[spoolHeaderSize+int(length):]
+	}
+	return records, int64(len(buf)), nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSpoolMock(t *testing.T, s3 Cache, dir string, maxBytes int64, overflow string) *diskSpool {
+	spoolConfig := config
+	spoolConfig.spoolDir = dir
+	spoolConfig.spoolMaxBytes = maxBytes
+	spoolConfig.spoolOverflow = overflow
+	spool, err := newDiskSpool(s3, spoolConfig)
+	assert.NoError(t, err)
+	return spool
+}
+
+func spoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	return dir
+}
+
+func Test_Spool_FlushesToS3(t *testing.T) {
+	dir := spoolDir(t)
+	defer os.RemoveAll(dir)
+	s3 := &s3ServiceMock{}
+	spool := newSpoolMock(t, s3, dir, 1024, overflowS3)
+
+	assert.NoError(t, spool.Put("a"))
+	assert.NoError(t, spool.Put("multi\nline"))
+	assert.Empty(t, s3.cache, "events should only be written to disk")
+
+	assert.NoError(t, spool.flush())
+	assert.Equal(t, []string{"a", "multi\nline"}, s3.cache)
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	assert.Empty(t, segments, "flushed segments should be deleted")
+	assert.Equal(t, int64(0), spool.size)
+}
+
+func Test_Spool_KeepsEventsWhileS3IsDown(t *testing.T) {
+	dir := spoolDir(t)
+	defer os.RemoveAll(dir)
+	spool := newSpoolMock(t, &failingCacheMock{}, dir, 1024, overflowS3)
+
+	assert.NoError(t, spool.Put("a"))
+	assert.Error(t, spool.flush())
+	assert.NoError(t, spool.Put("b"))
+	assert.Error(t, spool.flush())
+	assert.Len(t, spool.segments, 1, "events should be appended to the segment waiting for S3")
+	spool.stop(time.Now())
+
+	// a restart picks up the segments left on disk
+	s3 := &s3ServiceMock{}
+	restarted := newSpoolMock(t, s3, dir, 1024, overflowS3)
+	assert.NoError(t, restarted.Put("c"))
+	assert.NoError(t, restarted.flush())
+	assert.Equal(t, []string{"a", "b", "c"}, s3.cache)
+}
+
+func Test_Spool_Overflow(t *testing.T) {
+	event := strings.Repeat("x", 100)
+	// room for two events
+	maxBytes := int64(2 * (spoolHeaderSize + len(event)))
+
+	dir := spoolDir(t)
+	defer os.RemoveAll(dir)
+	s3 := &s3ServiceMock{}
+	spool := newSpoolMock(t, s3, dir, maxBytes, overflowS3)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, spool.Put(event))
+	}
+	assert.Len(t, s3.cache, 1, "the event that does not fit should go to S3")
+
+	rejectDir := spoolDir(t)
+	defer os.RemoveAll(rejectDir)
+	rejecting := newSpoolMock(t, &s3ServiceMock{}, rejectDir, maxBytes, overflowReject)
+	assert.NoError(t, rejecting.Put(event))
+	assert.NoError(t, rejecting.Put(event))
+	assert.Equal(t, errSpoolFull, rejecting.Put(event))
+
+	partialDir := spoolDir(t)
+	defer os.RemoveAll(partialDir)
+	partial := newSpoolMock(t, &s3ServiceMock{}, partialDir, maxBytes, overflowReject)
+	assert.NoError(t, partial.Put(event))
+	assert.Equal(t, errSpoolFull, partial.Put(event, event), "events should be rejected together")
+	assert.Equal(t, int64(spoolHeaderSize+len(event)), partial.size, "rejected events should not be spooled")
+
+	dropDir := spoolDir(t)
+	defer os.RemoveAll(dropDir)
+	s3 = &s3ServiceMock{}
+	dropping := newSpoolMock(t, s3, dropDir, maxBytes, overflowDropOldest)
+	assert.NoError(t, dropping.Put("a"+event[1:]))
+	assert.NoError(t, dropping.Put("b"+event[1:]))
+	assert.NoError(t, dropping.Put("c"+event[1:]))
+	assert.NoError(t, dropping.flush())
+	assert.Equal(t, []string{"c" + event[1:]}, s3.cache, "the oldest segment should be dropped")
+}
+
+func Test_Spool_WritesToS3WhenDiskFails(t *testing.T) {
+	dir := spoolDir(t)
+	defer os.RemoveAll(dir)
+	s3 := &s3ServiceMock{}
+	spool := newSpoolMock(t, s3, dir, 1024, overflowReject)
+	assert.NoError(t, spool.Put("a"))
+	// the segment can no longer be written to
+	spool.file.Close()
+
+	assert.NoError(t, spool.Put("b", "c"))
+	assert.Equal(t, []string{"b", "c"}, s3.cache, "events that could not be spooled should go to S3")
+	assert.Error(t, spool.latestError)
+
+	assert.NoError(t, spool.Put("d"))
+	assert.Nil(t, spool.latestError, "a new segment should be started")
+	assert.NoError(t, spool.flush())
+	assert.Equal(t, []string{"b", "c", "a", "d"}, s3.cache)
+}
+
+func Test_Spool_IgnoresTornRecord(t *testing.T) {
+	dir := spoolDir(t)
+	defer os.RemoveAll(dir)
+	spool := newSpoolMock(t, &failingCacheMock{}, dir, 1024, overflowS3)
+	assert.NoError(t, spool.Put("a"))
+	assert.NoError(t, spool.Put("b"))
+	spool.stop(time.Now())
+
+	// simulate a crash in the middle of writing the last record
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	assert.Len(t, segments, 1)
+	info, _ := os.Stat(segments[0])
+	assert.NoError(t, os.Truncate(segments[0], info.Size()-1))
+
+	records, _, err := readSpoolSegment(segments[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []*spoolRecord{{body: "a"}}, records)
+}
+
+func Test_Spool_RequeueKeepsAttempts(t *testing.T) {
+	dir := spoolDir(t)
+	defer os.RemoveAll(dir)
+	firstSeen := time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)
+	// S3 is not written to until the spool is flushed
+	spool := newSpoolMock(t, &failingCacheMock{}, dir, 1024, overflowS3)
+	assert.NoError(t, spool.Requeue(
+		&message{body: "a", attempts: 2, firstSeen: firstSeen},
+		&message{body: "b", attempts: 2, firstSeen: firstSeen.Add(time.Minute)},
+		&message{body: "c", attempts: 3, firstSeen: firstSeen},
+	))
+	assert.NoError(t, spool.Put("d"))
+	assert.NoError(t, spool.Requeue(&message{body: "e"}))
+	spool.stop(time.Now())
+
+	s3 := &requeueingCacheMock{}
+	restarted := newSpoolMock(t, s3, dir, 1024, overflowS3)
+	assert.NoError(t, restarted.flush())
+	assert.Equal(t, []string{"d"}, s3.cache)
+	assert.Len(t, s3.requeued, 4)
+	for i, expected := range []*message{
+		{body: "a", attempts: 2, firstSeen: firstSeen},
+		{body: "b", attempts: 2, firstSeen: firstSeen.Add(time.Minute)},
+		{body: "c", attempts: 3, firstSeen: firstSeen},
+		{body: "e"},
+	} {
+		assert.Equal(t, expected.body, s3.requeued[i].body)
+		assert.Equal(t, expected.attempts, s3.requeued[i].attempts, expected.body)
+		assert.True(t, expected.firstSeen.Equal(s3.requeued[i].firstSeen), expected.body)
+	}
+}
+
+func Test_ValidateParamsSpool(t *testing.T) {
+	spoolConfig := config
+	spoolConfig.spoolDir = "/var/spool/forwarder"
+	spoolConfig.spoolMaxBytes = 1024
+	spoolConfig.spoolOverflow = "block"
+	assert.Error(t, validateParams(spoolConfig))
+
+	spoolConfig.spoolOverflow = overflowDropOldest
+	assert.NoError(t, validateParams(spoolConfig))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// long polling wait of the first receive of a claim, it delays shutdown by as much
+	sqsWaitTime = int64(5)
+	// ReceiveMessage and DeleteMessageBatch take at most 10 messages
+	maxSQSMessages = 10
+)
+
+var sqsNotificationCounter prometheus.Counter
+
+type sqsInterface interface {
+	ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageBatch(input *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error)
+}
+
+// s3Notification is the body of an S3 event notification, either sent to SQS directly or
+// wrapped by SNS in the Message of a notification
+type s3Notification struct {
+	Message string `json:"Message"`
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// NewNotifiedS3Service creates a cache that learns which objects to claim from the S3
+// ObjectCreated notifications sent to an SQS queue, and lists them every listInterval
+// in case notifications are lost
+var NewNotifiedS3Service = func(prefix string, config appConfig) (Cache, error) {
+	s, err := newS3Service(prefix, config)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := newAWSSession(config.awsRegion, 1)
+	if err != nil {
+		return nil, err
+	}
+	if sqsNotificationCounter == nil {
+		sqsNotificationCounter = registerCounter("sqs_notification_count", "Number of S3 object notifications received from SQS")
+	}
+	s.queue = sqs.New(sess)
+	s.queueURL = config.sqsQueueURL
+	s.listInterval = config.sqsListInterval
+	s.lastList = time.Now()
+	return s, nil
+}
+
+// notifiedKeys receives notifications until a full claim is gathered or the queue is
+// empty, and returns the cached objects they refer to along with their receipt handles
+func (s *s3Service) notifiedKeys() ([]string, []*string, error) {
+	keys := []string{}
+	receipts := []*string{}
+	// S3 may notify an object more than once, and it must only be claimed once
+	seen := map[string]bool{}
+	wait := sqsWaitTime
+	for int64(len(keys)) < s.getPageSize() {
+		out, err := s.queue.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(s.queueURL),
+			MaxNumberOfMessages: aws.Int64(maxSQSMessages),
+			WaitTimeSeconds:     aws.Int64(wait),
+		})
+		if err != nil {
+			s.latestError = err
+			return keys, receipts, err
+		}
+		s.latestError = nil
+		if len(out.Messages) == 0 {
+			break
+		}
+		for _, msg := range out.Messages {
+			notified := s.notificationKeys(aws.StringValue(msg.Body))
+			owned := []string{}
+			for _, key := range notified {
+				if s.owns(key) {
+					owned = append(owned, key)
+				}
+			}
+			// notifications of shards owned by other replicas are left on the queue,
+			// for their owner to receive once they are visible again
+			if len(owned) == len(notified) {
+				receipts = append(receipts, msg.ReceiptHandle)
+			}
+			for _, key := range owned {
+				if !seen[key] {
+					seen[key] = true
+					keys = append(keys, key)
+				}
+			}
+		}
+		// don't wait for more once there is something to claim
+		wait = 0
+	}
+	return keys, receipts, nil
+}
+
+// notificationKeys returns the keys of the cached objects created according to a notification.
+// Other notifications, such as the test event sent when notifications are set up, are ignored.
+func (s *s3Service) notificationKeys(body string) []string {
+	notification := s3Notification{}
+	if err := json.Unmarshal([]byte(body), &notification); err != nil {
+		return nil
+	}
+	if notification.Message != "" {
+		return s.notificationKeys(notification.Message)
+	}
+	keys := []string{}
+	for _, record := range notification.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			continue
+		}
+		// keys are URL encoded in notifications
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil || !strings.HasPrefix(key, s.prefix+"/") {
+			continue
+		}
+		sqsNotificationCounter.Inc()
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (s *s3Service) deleteNotifications(receipts []*string) {
+	for len(receipts) > 0 {
+		n := len(receipts)
+		if n > maxSQSMessages {
+			n = maxSQSMessages
+		}
+		entries := []*sqs.DeleteMessageBatchRequestEntry{}
+		for i, receipt := range receipts[:n] {
+			entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{Id: aws.String(strconv.Itoa(i)), ReceiptHandle: receipt})
+		}
+		// notifications that are not deleted come back, and refer to objects already claimed
+		_, err := s.queue.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(s.queueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			s.latestError = err
+		}
+		receipts = receipts[n:]
+	}
+}
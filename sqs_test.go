@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockSQSInterface returns a batch of messages on each receive, and then nothing
+type mockSQSInterface struct {
+	lock     sync.Mutex
+	batches  [][]string
+	waits    []int64
+	deleted  []string
+	received int
+}
+
+func (m *mockSQSInterface) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.waits = append(m.waits, *input.WaitTimeSeconds)
+	out := &sqs.ReceiveMessageOutput{}
+	if len(m.batches) == 0 {
+		return out, nil
+	}
+	for _, body := range m.batches[0] {
+		m.received++
+		out.Messages = append(out.Messages, &sqs.Message{Body: aws.String(body), ReceiptHandle: aws.String(fmt.Sprintf("receipt-%v", m.received))})
+	}
+	m.batches = m.batches[1:]
+	return out, nil
+}
+
+func (m *mockSQSInterface) DeleteMessageBatch(input *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, entry := range input.Entries {
+		m.deleted = append(m.deleted, *entry.ReceiptHandle)
+	}
+	return &sqs.DeleteMessageBatchOutput{}, nil
+}
+
+var _ sqsInterface = (*mockSQSInterface)(nil)
+
+// claimedS3Interface fails to copy objects that another instance has claimed already
+type claimedS3Interface struct {
+	mockS3Interface
+	claimed map[string]bool
+}
+
+func (m *claimedS3Interface) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	source, _ := url.PathUnescape(*input.CopySource)
+	if m.claimed[source] {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return m.mockS3Interface.CopyObject(input)
+}
+
+func notification(eventName string, key string) string {
+	return fmt.Sprintf(`{"Records":[{"eventName":%q,"s3":{"bucket":{"name":"test-bucket"},"object":{"key":%q,"size":42}}}]}`, eventName, url.QueryEscape(key))
+}
+
+func newNotifiedMock(t *testing.T, svc s3Interface, queue sqsInterface) *s3Service {
+	sqsConfig := appConfig{bucket: "test-bucket", awsRegion: "no-region", leaseTimeout: time.Minute, sqsQueueURL: "https://sqs/queue", sqsListInterval: time.Hour}
+	cache, err := NewNotifiedS3Service("test-prefix", sqsConfig)
+	assert.NoError(t, err)
+	s3service := cache.(*s3Service)
+	s3service.svc = svc
+	s3service.queue = queue
+	// leases are not reaped in these tests
+	s3service.lastReap = time.Now()
+	return s3service
+}
+
+func Test_SQS_claimsNotifiedObjects(t *testing.T) {
+	s3InterfaceMock := &mockS3Interface{}
+	sns := fmt.Sprintf(`{"Type":"Notification","Message":%q}`, notification("ObjectCreated:Put", "test-prefix/2_b"))
+	queue := &mockSQSInterface{batches: [][]string{
+		{notification("ObjectCreated:Put", "test-prefix/1_a"), `{"Service":"Amazon S3","Event":"s3:TestEvent"}`},
+		{sns, notification("ObjectCreated:Put", "test-prefix/1_a")},
+		{notification("ObjectCreated:Put", "test-prefix-dlq/3_c"), notification("ObjectRemoved:Delete", "test-prefix/4_d")},
+	}}
+	s3service := newNotifiedMock(t, s3InterfaceMock, queue)
+
+	result, err := s3service.Claim()
+
+	assert.NoError(t, err)
+	assert.Len(t, result, 2)
+	assert.Empty(t, s3InterfaceMock.listPrefixes, "the cache should not be listed")
+	assert.ElementsMatch(t, []string{"test-prefix/1_a", "test-prefix/2_b"}, s3InterfaceMock.deleted)
+	assert.Equal(t, []string{"receipt-1", "receipt-2", "receipt-3", "receipt-4", "receipt-5", "receipt-6"}, queue.deleted)
+	assert.Equal(t, []int64{sqsWaitTime, 0, 0, 0}, queue.waits)
+}
+
+func Test_SQS_skipsObjectsClaimedElsewhere(t *testing.T) {
+	s3InterfaceMock := &claimedS3Interface{claimed: map[string]bool{"test-bucket/test-prefix/1_a": true}}
+	queue := &mockSQSInterface{batches: [][]string{
+		{notification("ObjectCreated:Put", "test-prefix/1_a"), notification("ObjectCreated:Put", "test-prefix/2_b")},
+	}}
+	s3service := newNotifiedMock(t, s3InterfaceMock, queue)
+
+	result, err := s3service.Claim()
+
+	assert.NoError(t, err)
+	assert.Len(t, result, 1)
+	assert.Equal(t, []string{"test-prefix/2_b"}, s3InterfaceMock.deleted)
+	assert.Nil(t, s3service.getHealth())
+}
+
+func Test_SQS_listsPeriodically(t *testing.T) {
+	s3InterfaceMock := &mockS3Interface{}
+	queue := &mockSQSInterface{}
+	s3service := newNotifiedMock(t, s3InterfaceMock, queue)
+
+	result, err := s3service.Claim()
+	assert.NoError(t, err)
+	assert.Empty(t, result)
+	assert.Empty(t, s3InterfaceMock.listPrefixes)
+
+	// notifications may be lost, so the cache is listed once the interval has elapsed
+	s3service.lastList = time.Now().Add(-2 * time.Hour)
+	result, err = s3service.Claim()
+	assert.NoError(t, err)
+	assert.Len(t, result, 1)
+	assert.Equal(t, []string{"test-prefix/"}, s3InterfaceMock.listPrefixes)
+	assert.Len(t, queue.waits, 1, "the queue should not be read when listing")
+}
+
+func Test_ValidateParamsSQS(t *testing.T) {
+	sqsConfig := config
+	sqsConfig.sqsQueueURL = "https://sqs/queue"
+	assert.Error(t, validateParams(sqsConfig))
+
+	sqsConfig.sqsListInterval = time.Minute
+	assert.NoError(t, validateParams(sqsConfig))
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// longest syslog message accepted, larger ones are truncated over UDP and end the connection over TCP
+	maxSyslogMessage = 64 * 1024
+	syslogSourcetype = "syslog"
+)
+
+var (
+	syslogCounter         *prometheus.CounterVec
+	syslogUnparsedCounter *prometheus.CounterVec
+	syslogSeverities      = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+	syslogFacilities      = []string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv",
+		"ftp", "ntp", "security", "console", "solaris-cron", "local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7"}
+)
+
+// syslogMessage is a message parsed from RFC5424 or RFC3164 syslog
+type syslogMessage struct {
+	facility  int
+	severity  int
+	timestamp time.Time
+	hostname  string
+	appname   string
+	procid    string
+	msgid     string
+	// structured data parameters, keyed by <sd-id>.<param-name>
+	structuredData map[string]string
+	message        string
+}
+
+// syslogEnvelope is the HEC event a syslog message is turned into
+type syslogEnvelope struct {
+	Time       json.Number       `json:"time"`
+	Host       string            `json:"host,omitempty"`
+	Source     string            `json:"source"`
+	Sourcetype string            `json:"sourcetype"`
+	Event      string            `json:"event"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+// syslogServer listens for syslog messages over UDP, TCP and TLS and submits them to
+// the processor, which caches them if they can not be delivered
+type syslogServer struct {
+	sync.Mutex
+	input     LogInput
+	udpAddr   string
+	tcpAddr   string
+	tlsAddr   string
+	tlsConfig *tls.Config
+	uppLogger *logger.UPPLogger
+	now       func() time.Time
+	packet    net.PacketConn
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	stopped   bool
+	wg        sync.WaitGroup
+}
+
+func newSyslogServer(input LogInput, config appConfig) (*syslogServer, error) {
+	if syslogCounter == nil {
+		syslogCounter = registerCounterVec("syslog_message_count", "Number of syslog messages received by protocol", "protocol")
+		syslogUnparsedCounter = registerCounterVec("syslog_unparsed_count", "Number of syslog messages forwarded as is because they could not be parsed, by protocol", "protocol")
+	}
+	server := &syslogServer{
+		input:     input,
+		udpAddr:   config.syslogUDP,
+		tcpAddr:   config.syslogTCP,
+		tlsAddr:   config.syslogTLS,
+		uppLogger: config.UPPLogger,
+		now:       time.Now,
+		conns:     map[net.Conn]struct{}{},
+	}
+	if config.syslogTLS != "" {
+		cert, err := tls.LoadX509KeyPair(config.syslogTLSCert, config.syslogTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load syslog TLS certificate: %v", err)
+		}
+		server.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	return server, nil
+}
+
+// start opens the configured listeners
+func (server *syslogServer) start() error {
+	if server.udpAddr != "" {
+		packet, err := net.ListenPacket("udp", server.udpAddr)
+		if err != nil {
+			return err
+		}
+		server.packet = packet
+		server.wg.Add(1)
+		go server.servePackets(packet)
+	}
+	if server.tcpAddr != "" {
+		listener, err := net.Listen("tcp", server.tcpAddr)
+		if err != nil {
+			server.stop()
+			return err
+		}
+		server.serveListener(listener, "tcp")
+	}
+	if server.tlsAddr != "" {
+		listener, err := tls.Listen("tcp", server.tlsAddr, server.tlsConfig)
+		if err != nil {
+			server.stop()
+			return err
+		}
+		server.serveListener(listener, "tls")
+	}
+	return nil
+}
+
+// stop closes the listeners and open connections, and waits for the messages being
+// received to be submitted
+func (server *syslogServer) stop() {
+	server.Lock()
+	server.stopped = true
+	if server.packet != nil {
+		server.packet.Close()
+	}
+	for _, listener := range server.listeners {
+		listener.Close()
+	}
+	for conn := range server.conns {
+		conn.Close()
+	}
+	server.Unlock()
+	server.wg.Wait()
+}
+
+func (server *syslogServer) servePackets(packet net.PacketConn) {
+	defer server.wg.Done()
+	buf := make([]byte, maxSyslogMessage)
+	for {
+		n, addr, err := packet.ReadFrom(buf)
+		if err != nil {
+			if !server.isStopped() {
+				server.uppLogger.Errorf("Syslog UDP listener stopped: %v\n", err)
+			}
+			return
+		}
+		server.receive(string(buf[:n]), peerHost(addr), "udp")
+	}
+}
+
+func (server *syslogServer) serveListener(listener net.Listener, protocol string) {
+	server.Lock()
+	server.listeners = append(server.listeners, listener)
+	server.Unlock()
+	server.wg.Add(1)
+	go func() {
+		defer server.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !server.isStopped() {
+					server.uppLogger.Errorf("Syslog %v listener stopped: %v\n", protocol, err)
+				}
+				return
+			}
+			if !server.track(conn) {
+				conn.Close()
+				return
+			}
+			server.wg.Add(1)
+			go server.serveConn(conn, protocol)
+		}
+	}()
+}
+
+// serveConn reads messages from a stream, framed either by octet counting or by newlines (RFC6587)
+func (server *syslogServer) serveConn(conn net.Conn, protocol string) {
+	defer server.wg.Done()
+	defer server.untrack(conn)
+	defer conn.Close()
+	host := peerHost(conn.RemoteAddr())
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxSyslogMessage+16)
+	scanner.Split(splitSyslogFrames)
+	for scanner.Scan() {
+		server.receive(scanner.Text(), host, protocol)
+	}
+	if err := scanner.Err(); err != nil && !server.isStopped() {
+		server.uppLogger.Infof("Closing syslog connection from %v: %v\n", host, err)
+	}
+}
+
+func (server *syslogServer) receive(raw string, peer string, protocol string) {
+	raw = strings.TrimRight(raw, "\r\n\x00")
+	if strings.TrimSpace(raw) == "" {
+		return
+	}
+	syslogCounter.WithLabelValues(protocol).Inc()
+	received := server.now()
+	msg, err := parseSyslog(raw, received)
+	if err != nil {
+		// don't lose what could not be parsed
+		syslogUnparsedCounter.WithLabelValues(protocol).Inc()
+		msg = &syslogMessage{timestamp: received, message: raw, severity: -1}
+	}
+	server.input.Submit(&message{body: syslogEvent(msg, peer, protocol)})
+}
+
+func (server *syslogServer) track(conn net.Conn) bool {
+	server.Lock()
+	defer server.Unlock()
+	if server.stopped {
+		return false
+	}
+	server.conns[conn] = struct{}{}
+	return true
+}
+
+func (server *syslogServer) untrack(conn net.Conn) {
+	server.Lock()
+	defer server.Unlock()
+	delete(server.conns, conn)
+}
+
+func (server *syslogServer) isStopped() bool {
+	server.Lock()
+	defer server.Unlock()
+	return server.stopped
+}
+
+func peerHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// splitSyslogFrames splits a stream into messages. Octet counted frames start with the
+// length of the message, while messages framed by newlines start with their priority.
+func splitSyslogFrames(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) == 0 || data[0] < '0' || data[0] > '9' {
+		return bufio.ScanLines(data, atEOF)
+	}
+	sp := bytes.IndexByte(data, ' ')
+	if sp < 0 {
+		if atEOF || len(data) > 10 {
+			return 0, nil, errors.New("invalid syslog frame length")
+		}
+		return 0, nil, nil
+	}
+	n, err := strconv.Atoi(string(data[:sp]))
+	if err != nil || n > maxSyslogMessage {
+		return 0, nil, fmt.Errorf("invalid syslog frame length %q", data[:sp])
+	}
+	if len(data) < sp+1+n {
+		if atEOF {
+			return 0, nil, errors.New("truncated syslog frame")
+		}
+		return 0, nil, nil
+	}
+	return sp + 1 + n, data[sp+1 : sp+1+n], nil
+}
+
+// syslogEvent builds the HEC event of a syslog message. The host defaults to the address
+// of the peer, and the time to when the message was received.
+func syslogEvent(msg *syslogMessage, peer string, protocol string) string {
+	envelope := syslogEnvelope{
+		Time:       json.Number(hecEpoch(msg.timestamp)),
+		Host:       msg.hostname,
+		Source:     "syslog:" + protocol,
+		Sourcetype: syslogSourcetype,
+		Event:      msg.message,
+		Fields:     map[string]string{},
+	}
+	if envelope.Host == "" {
+		envelope.Host = peer
+	}
+	if msg.severity >= 0 {
+		envelope.Fields["severity"] = syslogSeverities[msg.severity]
+		envelope.Fields["facility"] = syslogFacilities[msg.facility]
+	}
+	for name, value := range map[string]string{"appname": msg.appname, "procid": msg.procid, "msgid": msg.msgid} {
+		if value != "" {
+			envelope.Fields[name] = value
+		}
+	}
+	for name, value := range msg.structuredData {
+		envelope.Fields[name] = value
+	}
+	buf, _ := json.Marshal(envelope)
+	return string(buf)
+}
+
+// parseSyslog parses an RFC5424 message, or else an RFC3164 one. The time a message was
+// received stands in for a missing timestamp, and gives the year of RFC3164 timestamps.
+func parseSyslog(raw string, received time.Time) (*syslogMessage, error) {
+	if !strings.HasPrefix(raw, "<") {
+		return nil, errors.New("missing priority")
+	}
+	end := strings.IndexByte(raw, '>')
+	if end < 2 || end > 4 {
+		return nil, errors.New("invalid priority")
+	}
+	pri, err := strconv.Atoi(raw[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return nil, errors.New("invalid priority")
+	}
+	msg := &syslogMessage{facility: pri / 8, severity: pri % 8, timestamp: received}
+	rest := raw[end+1:]
+	if strings.HasPrefix(rest, "1 ") {
+		return msg, parseRFC5424(msg, rest[2:])
+	}
+	parseRFC3164(msg, rest, received)
+	return msg, nil
+}
+
+// parseRFC5424 parses TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parseRFC5424(msg *syslogMessage, rest string) error {
+	header := make([]string, 5)
+	for i := range header {
+		sp := strings.IndexByte(rest, ' ')
+		if sp < 0 {
+			return errors.New("truncated header")
+		}
+		header[i] = nilValue(rest[:sp])
+		rest = rest[sp+1:]
+	}
+	if header[0] != "" {
+		timestamp, err := time.Parse(time.RFC3339Nano, header[0])
+		if err != nil {
+			return fmt.Errorf("invalid timestamp: %v", err)
+		}
+		msg.timestamp = timestamp
+	}
+	msg.hostname, msg.appname, msg.procid, msg.msgid = header[1], header[2], header[3], header[4]
+
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else {
+		sd, n, err := parseStructuredData(rest)
+		if err != nil {
+			return err
+		}
+		msg.structuredData = sd
+		rest = rest[n:]
+	}
+	rest = strings.TrimPrefix(rest, " ")
+	msg.message = strings.TrimPrefix(rest, "\xEF\xBB\xBF")
+	return nil
+}
+
+// parseStructuredData parses one or more [SD-ID PARAM-NAME="PARAM-VALUE" ...] elements and
+// returns the number of bytes read
+func parseStructuredData(s string) (map[string]string, int, error) {
+	sd := map[string]string{}
+	i := 0
+	for i < len(s) && s[i] == '[' {
+		i++
+		start := i
+		for i < len(s) && s[i] != ' ' && s[i] != ']' {
+			i++
+		}
+		id := s[start:i]
+		if id == "" || i == len(s) {
+			return nil, 0, errors.New("invalid structured data")
+		}
+		for i < len(s) && s[i] == ' ' {
+			i++
+			eq := strings.Index(s[i:], "=\"")
+			if eq <= 0 {
+				return nil, 0, errors.New("invalid structured data parameter")
+			}
+			name := s[i : i+eq]
+			i += eq + 2
+			value := strings.Builder{}
+			for ; i < len(s) && s[i] != '"'; i++ {
+				// \", \\ and \] are escaped
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+					i++
+				}
+				value.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, 0, errors.New("unterminated structured data value")
+			}
+			i++
+			sd[id+"."+name] = value.String()
+		}
+		if i == len(s) || s[i] != ']' {
+			return nil, 0, errors.New("unterminated structured data element")
+		}
+		i++
+	}
+	return sd, i, nil
+}
+
+// parseRFC3164 parses the loosely specified BSD format, Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG.
+// Whatever can not be parsed is kept in the message.
+func parseRFC3164(msg *syslogMessage, rest string, received time.Time) {
+	msg.message = rest
+	if len(rest) < len(time.Stamp)+1 {
+		return
+	}
+	timestamp, err := time.ParseInLocation(time.Stamp, rest[:len(time.Stamp)], received.Location())
+	if err != nil {
+		return
+	}
+	// the year is not sent, a timestamp in the future comes from the end of the previous year
+	timestamp = timestamp.AddDate(received.Year(), 0, 0)
+	if timestamp.After(received.Add(24 * time.Hour)) {
+		timestamp = timestamp.AddDate(-1, 0, 0)
+	}
+	msg.timestamp = timestamp
+	rest = strings.TrimLeft(rest[len(time.Stamp):], " ")
+
+	sp := strings.IndexByte(rest, ' ')
+	if sp < 0 {
+		msg.message = rest
+		return
+	}
+	msg.hostname = rest[:sp]
+	rest = rest[sp+1:]
+	msg.message = rest
+
+	tagEnd := strings.IndexFunc(rest, func(r rune) bool {
+		return !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_./", r))
+	})
+	if tagEnd <= 0 {
+		return
+	}
+	tag, after := rest[:tagEnd], rest[tagEnd:]
+	procid := ""
+	if strings.HasPrefix(after, "[") {
+		end := strings.IndexByte(after, ']')
+		if end < 0 {
+			return
+		}
+		procid, after = after[1:end], after[end+1:]
+	}
+	if !strings.HasPrefix(after, ":") {
+		return
+	}
+	msg.appname, msg.procid = tag, procid
+	msg.message = strings.TrimPrefix(after[1:], " ")
+}
+
+// nilValue turns the RFC5424 nil value "-" into an empty string
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type inputMock struct {
+	sync.Mutex
+	submitted []string
+}
+
+func (input *inputMock) Submit(m *message) {
+	input.Lock()
+	defer input.Unlock()
+	input.submitted = append(input.submitted, m.body)
+}
+
+func (input *inputMock) getSubmitted() []string {
+	input.Lock()
+	defer input.Unlock()
+	return append([]string{}, input.submitted...)
+}
+
+func Test_ParseSyslog_RFC5424(t *testing.T) {
+	received := time.Date(2017, 10, 11, 22, 0, 0, 0, time.UTC)
+	msg, err := parseSyslog(`<165>1 2017-10-11T22:14:15.003Z mymachine.example.com evntslog 1234 ID47 [exampleSDID@32473 iut="3" eventSource="Application \"main\""][origin ip="192.0.2.1"] `+"\xEF\xBB\xBF"+`An application event`, received)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 20, msg.facility)
+	assert.Equal(t, 5, msg.severity)
+	assert.Equal(t, time.Date(2017, 10, 11, 22, 14, 15, 3000000, time.UTC), msg.timestamp.UTC())
+	assert.Equal(t, "mymachine.example.com", msg.hostname)
+	assert.Equal(t, "evntslog", msg.appname)
+	assert.Equal(t, "1234", msg.procid)
+	assert.Equal(t, "ID47", msg.msgid)
+	assert.Equal(t, map[string]string{
+		"exampleSDID@32473.iut":         "3",
+		"exampleSDID@32473.eventSource": `Application "main"`,
+		"origin.ip":                     "192.0.2.1",
+	}, msg.structuredData)
+	assert.Equal(t, "An application event", msg.message)
+}
+
+func Test_ParseSyslog_RFC5424NilValues(t *testing.T) {
+	received := time.Date(2017, 10, 11, 22, 0, 0, 0, time.UTC)
+	msg, err := parseSyslog(`<34>1 - - - - - -`, received)
+
+	assert.NoError(t, err)
+	assert.Equal(t, received, msg.timestamp)
+	assert.Equal(t, "", msg.hostname)
+	assert.Nil(t, msg.structuredData)
+	assert.Equal(t, "", msg.message)
+
+	_, err = parseSyslog(`<34>1 2017-10-11T22:14:15Z host app - - [unterminated a="b"`, received)
+	assert.Error(t, err)
+}
+
+func Test_ParseSyslog_RFC3164(t *testing.T) {
+	received := time.Date(2017, 10, 11, 22, 0, 0, 0, time.UTC)
+	msg, err := parseSyslog(`<34>Oct  6 22:14:15 mymachine su[230]: 'su root' failed for lonvick on /dev/pts/8`, received)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 4, msg.facility)
+	assert.Equal(t, 2, msg.severity)
+	assert.Equal(t, time.Date(2017, 10, 6, 22, 14, 15, 0, time.UTC), msg.timestamp)
+	assert.Equal(t, "mymachine", msg.hostname)
+	assert.Equal(t, "su", msg.appname)
+	assert.Equal(t, "230", msg.procid)
+	assert.Equal(t, "'su root' failed for lonvick on /dev/pts/8", msg.message)
+}
+
+func Test_ParseSyslog_RFC3164PreviousYear(t *testing.T) {
+	received := time.Date(2018, 1, 1, 0, 0, 5, 0, time.UTC)
+	msg, err := parseSyslog(`<13>Dec 31 23:59:58 host message without tag`, received)
+
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2017, 12, 31, 23, 59, 58, 0, time.UTC), msg.timestamp)
+	assert.Equal(t, "", msg.appname)
+	assert.Equal(t, "message without tag", msg.message)
+}
+
+func Test_ParseSyslog_Invalid(t *testing.T) {
+	_, err := parseSyslog("no priority", time.Now())
+	assert.Error(t, err)
+	_, err = parseSyslog("<999>1 - - - - - -", time.Now())
+	assert.Error(t, err)
+}
+
+func Test_SyslogEvent(t *testing.T) {
+	msg := &syslogMessage{
+		facility:       20,
+		severity:       5,
+		timestamp:      time.Unix(1507760055, 3000000),
+		appname:        "evntslog",
+		structuredData: map[string]string{"origin.ip": "192.0.2.1"},
+		message:        "An application event",
+	}
+	envelope := syslogEnvelope{}
+	assert.NoError(t, json.Unmarshal([]byte(syslogEvent(msg, "10.0.0.1", "tcp")), &envelope))
+
+	assert.Equal(t, json.Number("1507760055.003"), envelope.Time)
+	assert.Equal(t, "10.0.0.1", envelope.Host)
+	assert.Equal(t, "syslog:tcp", envelope.Source)
+	assert.Equal(t, "syslog", envelope.Sourcetype)
+	assert.Equal(t, "An application event", envelope.Event)
+	assert.Equal(t, map[string]string{
+		"severity":  "notice",
+		"facility":  "local4",
+		"appname":   "evntslog",
+		"origin.ip": "192.0.2.1",
+	}, envelope.Fields)
+}
+
+func Test_SplitSyslogFrames(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("<13>first\n11 <13>second\n<13>third\r\n"))
+	scanner.Split(splitSyslogFrames)
+	frames := []string{}
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+	assert.NoError(t, scanner.Err())
+	assert.Equal(t, []string{"<13>first", "<13>second\n", "<13>third"}, frames)
+
+	scanner = bufio.NewScanner(strings.NewReader("20 <13>truncated"))
+	scanner.Split(splitSyslogFrames)
+	for scanner.Scan() {
+	}
+	assert.Error(t, scanner.Err())
+}
+
+func Test_SyslogServer(t *testing.T) {
+	input := &inputMock{}
+	syslogConfig := config
+	syslogConfig.syslogUDP = "127.0.0.1:0"
+	syslogConfig.syslogTCP = "127.0.0.1:0"
+	server, err := newSyslogServer(input, syslogConfig)
+	assert.NoError(t, err)
+	assert.NoError(t, server.start())
+
+	udp, err := net.Dial("udp", server.packet.LocalAddr().String())
+	assert.NoError(t, err)
+	defer udp.Close()
+	fmt.Fprint(udp, "<13>1 2017-10-11T22:14:15Z udphost app - - - over udp")
+
+	tcp, err := net.Dial("tcp", server.listeners[0].Addr().String())
+	assert.NoError(t, err)
+	fmt.Fprint(tcp, "<13>Oct 11 22:14:15 tcphost app: over tcp\nnot syslog at all\n")
+	tcp.Close()
+
+	assert.True(t, eventually(func() bool {
+		return len(input.getSubmitted()) == 3
+	}, 2*time.Second))
+	server.stop()
+
+	events := strings.Join(input.getSubmitted(), "\n")
+	assert.Contains(t, events, `"host":"udphost","source":"syslog:udp","sourcetype":"syslog","event":"over udp"`)
+	assert.Contains(t, events, `"host":"tcphost","source":"syslog:tcp","sourcetype":"syslog","event":"over tcp"`)
+	assert.Contains(t, events, `"host":"127.0.0.1","source":"syslog:tcp","sourcetype":"syslog","event":"not syslog at all"`)
+}
+
+func Test_ValidateParamsSyslogTLS(t *testing.T) {
+	syslogConfig := config
+	syslogConfig.syslogTLS = ":6514"
+	assert.Error(t, validateParams(syslogConfig))
+
+	syslogConfig.syslogTLSCert = "cert.pem"
+	syslogConfig.syslogTLSKey = "key.pem"
+	assert.NoError(t, validateParams(syslogConfig))
+}
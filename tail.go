@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	tailPollInterval   = 250 * time.Millisecond
+	checkpointInterval = time.Second
+	// time without new data after which a multiline record is considered complete
+	multilineFlushDelay = time.Second
+	// longest record sent as a single event, longer lines are split
+	maxTailRecord = 1024 * 1024
+	tailReadSize  = 64 * 1024
+)
+
+var tailedLinesCounter prometheus.Counter
+
+// tailer follows local files matching a set of globs and submits each record to the
+// processor. The offset of each file is checkpointed once the records before it have been
+// delivered or cached, so that restarts neither skip nor repeat records.
+type tailer struct {
+	sync.Mutex
+	input      LogInput
+	globs      []string
+	multiline  *regexp.Regexp
+	sourcetype string
+	host       string
+	stateFile  string
+	uppLogger  *logger.UPPLogger
+	now        func() time.Time
+	// files being tailed by identity, so that they are followed when renamed
+	files map[string]*tailedFile
+	// offsets read from the state file, used when a file is first seen
+	checkpoints    map[string]tailCheckpoint
+	lastCheckpoint time.Time
+	stopChan       chan struct{}
+	wg             sync.WaitGroup
+}
+
+// tailCheckpoint is the state file entry of a file
+type tailCheckpoint struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+}
+
+type tailedFile struct {
+	id   string
+	path string
+	file *os.File
+	// offset of the end of the last complete line read
+	offset  int64
+	partial []byte
+	// multiline record being joined, ending at pendingEnd
+	pending    []byte
+	pendingEnd int64
+	lastData   time.Time
+	// offset up to which every record submitted is done
+	offsets *offsetQueue
+	// the file no longer matches the globs and is read until its end
+	gone bool
+}
+
+// tailEnvelope is the HEC event a record is turned into
+type tailEnvelope struct {
+	Time       json.Number `json:"time"`
+	Host       string      `json:"host,omitempty"`
+	Source     string      `json:"source"`
+	Sourcetype string      `json:"sourcetype,omitempty"`
+	Event      string      `json:"event"`
+}
+
+func newTailer(input LogInput, config appConfig) (*tailer, error) {
+	if tailedLinesCounter == nil {
+		tailedLinesCounter = registerCounter("tailed_record_count", "Number of records read from tailed files")
+	}
+	t := &tailer{
+		input:       input,
+		globs:       config.tailPaths,
+		sourcetype:  config.tailSourcetype,
+		stateFile:   config.tailStateFile,
+		uppLogger:   config.UPPLogger,
+		now:         time.Now,
+		files:       map[string]*tailedFile{},
+		checkpoints: map[string]tailCheckpoint{},
+		stopChan:    make(chan struct{}),
+	}
+	if config.tailMultiline != "" {
+		multiline, err := regexp.Compile(config.tailMultiline)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid multiline pattern: %v", err)
+		}
+		t.multiline = multiline
+	}
+	t.host, _ = os.Hostname()
+	buf, err := ioutil.ReadFile(t.stateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed to read tail state file: %v", err)
+	}
+	if len(buf) > 0 {
+		if err := json.Unmarshal(buf, &t.checkpoints); err != nil {
+			return nil, fmt.Errorf("Invalid tail state file %v: %v", t.stateFile, err)
+		}
+	}
+	return t, nil
+}
+
+func (t *tailer) start() {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ticker := time.NewTicker(tailPollInterval)
+		defer ticker.Stop()
+		for {
+			t.poll()
+			select {
+			case <-t.stopChan:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stop stops reading files. The checkpoint should be saved once the processor has
+// settled the records already submitted.
+func (t *tailer) stop() {
+	close(t.stopChan)
+	t.wg.Wait()
+}
+
+// poll reads what has been appended to the files since the last poll
+func (t *tailer) poll() {
+	seen := map[string]bool{}
+	for _, glob := range t.globs {
+		paths, err := filepath.Glob(glob)
+		if err != nil {
+			t.uppLogger.Errorf("Invalid tail path %v: %v\n", glob, err)
+			continue
+		}
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			id := fileID(info)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			f, ok := t.files[id]
+			if !ok {
+				f, err = t.open(path, id, info)
+				if err != nil {
+					t.uppLogger.Errorf("Failed to open %v: %v\n", path, err)
+					continue
+				}
+				t.files[id] = f
+			}
+			f.path = path
+			if info.Size() < f.offset+int64(len(f.partial)) {
+				t.uppLogger.Infof("%v has been truncated, reading it from the start\n", path)
+				f.truncate()
+			}
+		}
+	}
+
+	for id, f := range t.files {
+		// a file renamed out of the globs, or deleted, is read until its end
+		f.gone = !seen[id]
+		t.read(f)
+		if f.gone && f.isCommitted() {
+			f.file.Close()
+			delete(t.files, id)
+		}
+	}
+
+	if time.Since(t.lastCheckpoint) >= checkpointInterval {
+		if err := t.checkpoint(); err != nil {
+			t.uppLogger.Errorf("Failed to save tail state file: %v\n", err)
+		}
+	}
+}
+
+// open starts tailing a file from its checkpoint, if any, or else from its start
+func (t *tailer) open(path string, id string, info os.FileInfo) (*tailedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	offset := int64(0)
+	if c, ok := t.checkpoints[id]; ok && c.Offset <= info.Size() {
+		offset = c.Offset
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	t.uppLogger.Infof("Tailing %v from offset %v\n", path, offset)
+	return &tailedFile{id: id, path: path, file: file, offset: offset, offsets: newOffsetQueue(offset), lastData: t.now()}, nil
+}
+
+// read submits the records appended to a file
+func (t *tailer) read(f *tailedFile) {
+	buf := make([]byte, tailReadSize)
+	read := false
+	for {
+		n, err := f.file.Read(buf)
+		if n > 0 {
+			read = true
+			f.lastData = t.now()
+			t.consume(f, buf[:n])
+		}
+		if err != nil || n == 0 {
+			break
+		}
+	}
+	if read {
+		return
+	}
+	if f.gone && len(f.partial) > 0 {
+		// the file won't grow anymore
+		f.offset += int64(len(f.partial))
+		t.record(f, f.partial, f.offset)
+		f.partial = nil
+	}
+	if len(f.pending) > 0 && (f.gone || t.now().Sub(f.lastData) >= multilineFlushDelay) {
+		t.submit(f, f.pending, f.pendingEnd)
+		f.pending = nil
+	}
+}
+
+// consume splits data into lines, keeping an incomplete last line for later
+func (t *tailer) consume(f *tailedFile, data []byte) {
+	data = append(f.partial, data...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		f.offset += int64(i + 1)
+		t.record(f, bytes.TrimSuffix(data[:i], []byte("\r")), f.offset)
+		data = data[i+1:]
+	}
+	for len(data) >= maxTailRecord {
+		f.offset += maxTailRecord
+		t.record(f, data[:maxTailRecord], f.offset)
+		data = data[maxTailRecord:]
+	}
+	f.partial = append([]byte{}, data...)
+}
+
+// record joins lines into multiline records: a line matching the pattern starts a new
+// record and the other lines are appended to the current one
+func (t *tailer) record(f *tailedFile, line []byte, end int64) {
+	if t.multiline == nil {
+		t.submit(f, line, end)
+		return
+	}
+	if len(f.pending) > 0 && (t.multiline.Match(line) || len(f.pending)+len(line) >= maxTailRecord) {
+		t.submit(f, f.pending, f.pendingEnd)
+		f.pending = nil
+	}
+	if len(f.pending) > 0 {
+		f.pending = append(f.pending, '\n')
+	}
+	f.pending = append(f.pending, line...)
+	f.pendingEnd = end
+}
+
+func (t *tailer) submit(f *tailedFile, record []byte, end int64) {
+	if len(bytes.TrimSpace(record)) == 0 {
+		f.offsets.done(f.offsets.track(end))
+		return
+	}
+	tailedLinesCounter.Inc()
+	envelope := tailEnvelope{
+		Time:       json.Number(hecEpoch(t.now())),
+		Host:       t.host,
+		Source:     f.path,
+		Sourcetype: t.sourcetype,
+		Event:      string(record),
+	}
+	buf, _ := json.Marshal(envelope)
+	r := f.offsets.track(end)
+	t.input.Submit(&message{body: string(buf), done: func() {
+		f.offsets.done(r)
+	}})
+}
+
+// checkpoint saves the committed offsets of the files being tailed
+func (t *tailer) checkpoint() error {
+	t.Lock()
+	defer t.Unlock()
+	t.lastCheckpoint = time.Now()
+	state := map[string]tailCheckpoint{}
+	for id, f := range t.files {
+		state[id] = tailCheckpoint{Path: f.path, Offset: f.offsets.getCommitted()}
+	}
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// replace the state file at once so that it is never half written
+	tmp := t.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.stateFile)
+}
+
+func (f *tailedFile) isCommitted() bool {
+	return f.offsets.pending() == 0 && len(f.partial) == 0 && len(f.pending) == 0
+}
+
+// truncate starts reading a truncated file again from its start. Records of the previous
+// content that are still in flight no longer matter to the checkpoint.
+func (f *tailedFile) truncate() {
+	f.file.Seek(0, io.SeekStart)
+	f.offset = 0
+	f.partial = nil
+	f.pending = nil
+	f.offsets.reset(0)
+}
+
+// fileID identifies a file by device and inode, which survive renames
+func fileID(info os.FileInfo) string {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%v:%v", stat.Dev, stat.Ino)
+	}
+	return info.Name()
+}
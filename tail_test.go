@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// settlingInputMock keeps submitted messages so that tests decide when they are done
+type settlingInputMock struct {
+	messages []*message
+}
+
+func (input *settlingInputMock) Submit(m *message) {
+	input.messages = append(input.messages, m)
+}
+
+func (input *settlingInputMock) events() []string {
+	events := []string{}
+	for _, m := range input.messages {
+		envelope := tailEnvelope{}
+		json.Unmarshal([]byte(m.body), &envelope)
+		events = append(events, envelope.Event)
+	}
+	return events
+}
+
+func (input *settlingInputMock) settle() {
+	for _, m := range input.messages {
+		m.done()
+	}
+}
+
+func newTestTailer(t *testing.T, dir string, input LogInput, multiline string) *tailer {
+	tailConfig := config
+	tailConfig.tailPaths = []string{filepath.Join(dir, "*.log")}
+	tailConfig.tailStateFile = filepath.Join(dir, "state.json")
+	tailConfig.tailMultiline = multiline
+	tailConfig.tailSourcetype = "app"
+	tail, err := newTailer(input, tailConfig)
+	assert.NoError(t, err)
+	return tail
+}
+
+func appendFile(t *testing.T, path string, data string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteString(data)
+	assert.NoError(t, err)
+	f.Close()
+}
+
+func Test_Tail_ResumesFromCheckpoint(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tail")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "first\nsecond\nthi")
+
+	input := &settlingInputMock{}
+	tail := newTestTailer(t, dir, input, "")
+	tail.poll()
+	assert.Equal(t, []string{"first", "second"}, input.events())
+
+	envelope := tailEnvelope{}
+	json.Unmarshal([]byte(input.messages[0].body), &envelope)
+	assert.Equal(t, path, envelope.Source)
+	assert.Equal(t, "app", envelope.Sourcetype)
+
+	// only the first record is done when the service stops
+	input.messages[0].done()
+	assert.NoError(t, tail.checkpoint())
+	tail.files[fileIDOf(t, path)].file.Close()
+
+	appendFile(t, path, "rd\n")
+	input = &settlingInputMock{}
+	tail = newTestTailer(t, dir, input, "")
+	tail.poll()
+	assert.Equal(t, []string{"second", "third"}, input.events())
+}
+
+func Test_Tail_CheckpointsInFileOrder(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tail")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "a\nb\nc\n")
+
+	input := &settlingInputMock{}
+	tail := newTestTailer(t, dir, input, "")
+	tail.poll()
+	f := tail.files[fileIDOf(t, path)]
+
+	input.messages[1].done()
+	assert.Equal(t, int64(0), f.offsets.getCommitted())
+	input.messages[0].done()
+	assert.Equal(t, int64(4), f.offsets.getCommitted())
+	input.messages[2].done()
+	assert.Equal(t, int64(6), f.offsets.getCommitted())
+}
+
+func Test_Tail_RotationByRename(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tail")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "before\n")
+
+	input := &settlingInputMock{}
+	tail := newTestTailer(t, dir, input, "")
+	tail.poll()
+
+	appendFile(t, path, "last of old file")
+	assert.NoError(t, os.Rename(path, path+".1"))
+	appendFile(t, path, "new file\n")
+	tail.poll()
+	// an incomplete last line is sent once the rotated file has stopped growing
+	tail.poll()
+	assert.ElementsMatch(t, []string{"before", "last of old file", "new file"}, input.events())
+
+	// the rotated file is let go once its records are done
+	assert.Len(t, tail.files, 2)
+	input.settle()
+	tail.poll()
+	assert.Len(t, tail.files, 1)
+}
+
+func Test_Tail_Truncate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tail")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "a long line before truncation\n")
+
+	input := &settlingInputMock{}
+	tail := newTestTailer(t, dir, input, "")
+	tail.poll()
+
+	assert.NoError(t, os.Truncate(path, 0))
+	appendFile(t, path, "after\n")
+	tail.poll()
+	assert.Equal(t, []string{"a long line before truncation", "after"}, input.events())
+}
+
+func Test_Tail_Multiline(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tail")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "2017-10-11 ERROR failed\n  at main.go:1\n  at main.go:2\n2017-10-11 INFO ok\n")
+
+	input := &settlingInputMock{}
+	tail := newTestTailer(t, dir, input, `^\d{4}-\d{2}-\d{2} `)
+	now := time.Now()
+	tail.now = func() time.Time { return now }
+	tail.poll()
+	assert.Equal(t, []string{"2017-10-11 ERROR failed\n  at main.go:1\n  at main.go:2"}, input.events())
+
+	// the last record is sent once no more lines have come for a while
+	now = now.Add(multilineFlushDelay)
+	tail.poll()
+	assert.Equal(t, []string{"2017-10-11 ERROR failed\n  at main.go:1\n  at main.go:2", "2017-10-11 INFO ok"}, input.events())
+
+	input.settle()
+	assert.Equal(t, int64(73), tail.files[fileIDOf(t, path)].offsets.getCommitted())
+}
+
+func Test_ValidateParamsTailMultiline(t *testing.T) {
+	tailConfig := config
+	tailConfig.tailMultiline = "("
+	assert.Error(t, validateParams(tailConfig))
+}
+
+func fileIDOf(t *testing.T, path string) string {
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	return fileID(info)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultThrottlePause = 10 * time.Second
+	// shortest pause, so that a destination asking to retry at once is not flooded
+	minThrottlePause = time.Second
+	maxThrottlePause = 5 * time.Minute
+	// how long a batch waits in total for the destination to stop throttling before it
+	// is cached again
+	maxThrottleWait   = time.Minute
+	hecCodeServerBusy = 9
+)
+
+var errThrottled = errors.New("destination kept throttling requests")
+
+var (
+	pausedUntilGauge prometheus.Gauge
+	throttledCounter prometheus.Counter
+)
+
+// Throttled is implemented by forwarders that honour throttling responses from their destination
+type Throttled interface {
+	pausedUntil() time.Time
+}
+
+// Stoppable is implemented by forwarders that hold batches back while their destination
+// is throttling, and give up on them once the processor is stopping
+type Stoppable interface {
+	stopping()
+}
+
+// notifyStopping tells a forwarder that the processor is stopping, if it holds batches back
+func notifyStopping(forwarder Forwarder) {
+	if s, ok := forwarder.(Stoppable); ok {
+		s.stopping()
+	}
+}
+
+// pausedUntilOf tells until when a forwarder is paused by its destination, the zero time
+// if it does not honour throttling responses
+func pausedUntilOf(forwarder Forwarder) time.Time {
+	if t, ok := forwarder.(Throttled); ok {
+		return t.pausedUntil()
+	}
+	return time.Time{}
+}
+
+// throttle holds the "paused until" state shared by all the forward workers of a destination
+type throttle struct {
+	sync.Mutex
+	until   time.Time
+	maxWait time.Duration
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func newThrottle() *throttle {
+	if pausedUntilGauge == nil {
+		pausedUntilGauge = registerGauge("paused_until", "Unix time until which forwarding is paused at the request of the destination")
+		throttledCounter = registerCounter("throttled_count", "Number of requests throttled by the destination")
+	}
+	return &throttle{maxWait: maxThrottleWait, stop: make(chan struct{})}
+}
+
+func (t *throttle) pauseFor(d time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	until := time.Now().Add(d)
+	if until.After(t.until) {
+		t.until = until
+		pausedUntilGauge.Set(float64(until.Unix()))
+	}
+}
+
+func (t *throttle) pausedUntil() time.Time {
+	t.Lock()
+	defer t.Unlock()
+	return t.until
+}
+
+// wait blocks until the destination is no longer paused, adding the time waited to the
+// total waited for a batch. It returns false, without waiting, when the pause would take
+// the total beyond the longest wait or the processor is stopping.
+func (t *throttle) wait(waited *time.Duration) bool {
+	for {
+		d := time.Until(t.pausedUntil())
+		if d <= 0 {
+			return true
+		}
+		if *waited+d > t.maxWait {
+			return false
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+			*waited += d
+		case <-t.stop:
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// stopping stops the batches waiting on the destination, and those to come, from waiting
+func (t *throttle) stopping() {
+	t.once.Do(func() {
+		close(t.stop)
+	})
+}
+
+// throttledFor tells whether a HEC response asks the client to back off, and for how long
+func throttledFor(r *http.Response, resp hecResponse) (time.Duration, bool) {
+	pause, hasRetryAfter := retryAfter(r.Header, time.Now())
+	switch {
+	case r.StatusCode == http.StatusTooManyRequests,
+		r.StatusCode == http.StatusServiceUnavailable && hasRetryAfter,
+		resp.Code == hecCodeServerBusy:
+		return pause, true
+	}
+	return 0, false
+}
+
+// retryAfter parses the Retry-After header, given either in seconds or as an HTTP date
+func retryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return defaultThrottlePause, false
+	}
+	pause := defaultThrottlePause
+	if seconds, err := strconv.Atoi(value); err == nil {
+		pause = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		pause = date.Sub(now)
+	}
+	if pause < minThrottlePause {
+		pause = minThrottlePause
+	}
+	if pause > maxThrottlePause {
+		pause = maxThrottlePause
+	}
+	return pause, true
+}
+
+func throttleHealth(t Throttled) error {
+	if until := t.pausedUntil(); time.Now().Before(until) {
+		return fmt.Errorf("destination paused until %v", until.Format(time.RFC3339))
+	}
+	return nil
+}
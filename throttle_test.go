@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RetryAfter(t *testing.T) {
+	now := time.Now()
+
+	pause, ok := retryAfter(http.Header{"Retry-After": {"30"}}, now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, pause)
+
+	pause, ok = retryAfter(http.Header{"Retry-After": {now.Add(time.Minute).UTC().Format(http.TimeFormat)}}, now)
+	assert.True(t, ok)
+	assert.InDelta(t, float64(time.Minute), float64(pause), float64(time.Second))
+
+	pause, ok = retryAfter(http.Header{"Retry-After": {"86400"}}, now)
+	assert.True(t, ok)
+	assert.Equal(t, maxThrottlePause, pause)
+
+	pause, ok = retryAfter(http.Header{"Retry-After": {"0"}}, now)
+	assert.True(t, ok)
+	assert.Equal(t, minThrottlePause, pause, "a destination asking to retry at once should not be flooded")
+
+	pause, ok = retryAfter(http.Header{"Retry-After": {now.Add(-time.Minute).UTC().Format(http.TimeFormat)}}, now)
+	assert.True(t, ok)
+	assert.Equal(t, minThrottlePause, pause)
+
+	pause, ok = retryAfter(http.Header{}, now)
+	assert.False(t, ok)
+	assert.Equal(t, defaultThrottlePause, pause)
+}
+
+func Test_ThrottledFor(t *testing.T) {
+	_, throttled := throttledFor(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}, hecResponse{})
+	assert.True(t, throttled)
+
+	_, throttled = throttledFor(&http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": {"5"}}}, hecResponse{})
+	assert.True(t, throttled)
+
+	_, throttled = throttledFor(&http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}}, hecResponse{Code: hecCodeServerBusy})
+	assert.True(t, throttled)
+
+	_, throttled = throttledFor(&http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}}, hecResponse{})
+	assert.False(t, throttled)
+}
+
+func Test_Forwarder_Throttled(t *testing.T) {
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	throttleConfig := config
+	throttleConfig.fwdURL = server.URL
+	forwarder := NewSplunkForwarder(throttleConfig)
+
+	start := time.Now()
+	forwarder.forward(messages(`{"event":"throttled"}`), func(m *message, err error) {
+		assert.NoError(t, err, "throttled events are retried rather than re-cached")
+	})
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.True(t, time.Since(start) >= time.Second)
+	assert.NoError(t, throttleHealth(forwarder.(Throttled)))
+}
+
+func Test_Forwarder_ThrottledForTooLong(t *testing.T) {
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	throttleConfig := config
+	throttleConfig.fwdURL = server.URL
+	forwarder := NewSplunkForwarder(throttleConfig).(*splunkClient)
+	forwarder.throttle.maxWait = 1500 * time.Millisecond
+
+	results := collectResults(forwarder, messages(`{"event":"throttled"}`))
+	assert.Equal(t, errThrottled, results[`{"event":"throttled"}`])
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests), "the batch should be given up on rather than wait beyond the longest wait")
+	assert.Equal(t, policyRetry, policyOf(errThrottled))
+}
+
+func Test_Throttle_Stopping(t *testing.T) {
+	throttle := newThrottle()
+	throttle.pauseFor(time.Minute)
+	done := make(chan bool)
+	go func() {
+		waited := time.Duration(0)
+		done <- throttle.wait(&waited)
+	}()
+
+	throttle.stopping()
+	select {
+	case ok := <-done:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the wait should end once the processor is stopping")
+	}
+	waited := time.Duration(0)
+	assert.False(t, throttle.wait(&waited))
+}
+
+func Test_ThrottleHealth(t *testing.T) {
+	throttle := newThrottle()
+	assert.NoError(t, throttleHealth(throttle))
+
+	throttle.pauseFor(time.Minute)
+	assert.Error(t, throttleHealth(throttle))
+}
+
+// pausedForwarderMock is a destination that has asked to pause
+type pausedForwarderMock struct {
+	rejectingForwarderMock
+	until time.Time
+}
+
+func (forwarder *pausedForwarderMock) pausedUntil() time.Time {
+	return forwarder.until
+}
+
+func Test_Throttle_ProcessorKeepsEventsCachedWhilePaused(t *testing.T) {
+	guardConfig := config
+	guardConfig.maxWorkers = 2
+	guardConfig.rateLimitEvents = 1000
+	guardConfig.breakerFailureRate = 50
+	guardConfig.breakerWindow = time.Minute
+	forwarder := guardForwarder("test", &pausedForwarderMock{until: time.Now().Add(time.Minute)}, guardConfig)
+	assert.False(t, pausedUntilOf(forwarder).IsZero(), "the pause should be seen through the guards of the destination")
+	s3 := &s3ServiceMock{}
+	processor := NewLogProcessor(forwarder, s3, guardConfig)
+	processor.Start()
+	defer processor.Stop(time.Now())
+
+	s3.Put(`{event:"waiting"}`)
+
+	time.Sleep(300 * time.Millisecond)
+	s3.RLock()
+	defer s3.RUnlock()
+	assert.Len(t, s3.cache, 1, "the cache should not be read while the destination is paused")
+	assert.Equal(t, 0, s3.acked)
+}